@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"gorm.io/gorm"
 
@@ -34,6 +38,19 @@ func initialize() {
 		databaseConfig.SSL = false
 	}
 
+	jwtConfig := utils.JwtConfig{
+		Algorithm:      os.Getenv("JWT_ALGORITHM"),
+		Secret:         os.Getenv("JWT_SECRET"),
+		PrivateKeyFile: os.Getenv("JWT_PRIVATE_KEY_FILE"),
+		KeyId:          os.Getenv("JWT_KEY_ID"),
+	}
+	// With JWT_KEY_DIR the signing key ring is loaded when the server starts instead
+	if os.Getenv("JWT_KEY_DIR") == "" {
+		if err := utils.InitJwtKeys(jwtConfig); err != nil {
+			log.Fatal("Failed to load JWT signing key ", err)
+		}
+	}
+
 	var err error
 	databaseConnection, err = utils.GetMainDatabaseConnections(databaseConfig)
 	if err != nil {
@@ -53,8 +70,60 @@ func initialize() {
 	log.Println(asciiArt)
 }
 
+// durationFromEnv reads a duration such as "15s" from the environment or returns the fallback
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return duration
+}
+
 func main() {
 	initialize()
-	apiServer := apiserver.NewAPIServer(os.Getenv("SERVER_ADDRESS"), os.Getenv("SERVER_PORT"), databaseConnection)
-	apiServer.Run()
+	serverConfig := apiserver.ServerConfig{
+		ServerName:                os.Getenv("SERVER_ADDRESS"),
+		Port:                      os.Getenv("SERVER_PORT"),
+		ReadTimeout:               durationFromEnv("SERVER_READ_TIMEOUT", 15*time.Second),
+		ReadHeaderTimeout:         durationFromEnv("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:              durationFromEnv("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:               durationFromEnv("SERVER_IDLE_TIMEOUT", 120*time.Second),
+		ShutdownTimeout:           durationFromEnv("SERVER_SHUTDOWN_TIMEOUT", 30*time.Second),
+		CleanupInterval:           durationFromEnv("CLEANUP_INTERVAL", 24*time.Hour),
+		RevocationRefreshInterval: durationFromEnv("REVOCATION_REFRESH_INTERVAL", 10*time.Second),
+		// Only used when JWT_KEY_DIR enables the signing key ring
+		KeyRefreshInterval: durationFromEnv("JWT_KEY_REFRESH_INTERVAL", time.Minute),
+	}
+
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		serverConfig.TLS = &apiserver.TLSConfig{
+			CertFile:       certFile,
+			KeyFile:        os.Getenv("TLS_KEY_FILE"),
+			MinVersion:     os.Getenv("TLS_MIN_VERSION"),
+			CipherPolicy:   os.Getenv("TLS_CIPHER_POLICY"),
+			ClientCAFile:   os.Getenv("TLS_CLIENT_CA_FILE"),
+			ReloadInterval: durationFromEnv("TLS_RELOAD_INTERVAL", time.Minute),
+		}
+	}
+
+	apiServer := apiserver.NewAPIServer(serverConfig, databaseConnection)
+	if err := apiServer.Start(); err != nil {
+		log.Fatal("Failed to start Service ", err)
+	}
+
+	// Wait for SIGINT/SIGTERM or an unexpected server failure
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+	case err := <-apiServer.Errors():
+		log.Println("Service failed ", err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+	defer cancel()
+	if err := apiServer.Shutdown(shutdownCtx); err != nil {
+		log.Println("Shutdown did not complete cleanly ", err)
+		os.Exit(1)
+	}
 }
@@ -1,38 +1,173 @@
 package apiserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"os"
+	"sync"
+	"time"
 
+	"github.com/bachdang2k/security-golang/internal/controllers"
 	"github.com/bachdang2k/security-golang/internal/middlewares"
 	"gorm.io/gorm"
 
 	"github.com/bachdang2k/security-golang/internal/services"
 )
 
+const apiPrefix = "/api/v1"
+
+// ServerConfig holds the listener address, http timeouts and background job settings
+type ServerConfig struct {
+	ServerName        string
+	Port              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// ShutdownTimeout is the deadline given to in-flight requests when draining
+	ShutdownTimeout time.Duration
+	// CleanupInterval is how often expired tokens are deleted
+	CleanupInterval time.Duration
+	// TLS enables a TLS listener when set
+	TLS *TLSConfig
+	// RevocationRefreshInterval is how often revoked tokens are reloaded from the database
+	RevocationRefreshInterval time.Duration
+	// KeyRefreshInterval is how often the signing key ring is reloaded and checked for scheduled rotation
+	KeyRefreshInterval time.Duration
+}
+
 type APIServer struct {
-	port       string
-	serverName string
-	db         *gorm.DB
+	config ServerConfig
+	db     *gorm.DB
+	router *Router
+	server *http.Server
+	errors chan error
+	stop   chan struct{}
+	jobs   sync.WaitGroup
+	certs  *certReloader
+	keys   *services.KeyService
+	// revocations backs the revoked token check in middlewares.JwtAuth
+	revocations *services.RevocationService
 }
 
-func NewAPIServer(serverName string, port string, db *gorm.DB) *APIServer {
-	return &APIServer{serverName: serverName, port: port, db: db}
+func NewAPIServer(config ServerConfig, db *gorm.DB) *APIServer {
+	ap := &APIServer{
+		config: config,
+		db:     db,
+		router: NewRouter(),
+		errors: make(chan error, 1),
+		stop:   make(chan struct{}),
+	}
+	ap.server = &http.Server{
+		Addr:              fmt.Sprintf("%s:%s", config.ServerName, config.Port),
+		Handler:           middlewares.LogRequest(ap.router),
+		ReadTimeout:       config.ReadTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+	return ap
 }
 
-func (ap *APIServer) Run() {
-	ap.cleanUp()
+// Start binds the listener, starts background jobs and serves requests without blocking
+func (ap *APIServer) Start() error {
+	if ap.config.TLS != nil {
+		certs, err := newCertReloader(ap.config.TLS.CertFile, ap.config.TLS.KeyFile)
+		if err != nil {
+			log.Println("Failed to load TLS certificate ", err)
+			return err
+		}
+		tlsConfig, err := newTLSConfig(ap.config.TLS, certs)
+		if err != nil {
+			log.Println("Invalid TLS configuration ", err)
+			return err
+		}
+		ap.certs = certs
+		ap.server.TLSConfig = tlsConfig
+	}
+
+	if err := services.CheckSecrets(); err != nil {
+		log.Println("Missing configuration ", err)
+		return err
+	}
+
+	if keyService := services.NewKeyService(ap.db); keyService.Enabled() {
+		if err := keyService.LoadKeyRing(); err != nil {
+			log.Println("Failed to load the signing key ring ", err)
+			return err
+		}
+		ap.keys = keyService
+	}
+
+	if err := services.NewOIDCService(ap.db).CheckSigningAlgorithm(); err != nil {
+		log.Println("Invalid OpenID Connect configuration ", err)
+		return err
+	}
+
+	ap.revocations = services.NewRevocationService(ap.db)
+	if err := ap.revocations.Refresh(); err != nil {
+		log.Println("Failed to load revoked tokens ", err)
+		return err
+	}
+	middlewares.SetTokenRevocationChecker(ap.revocations)
+
 	ap.setupRoutes()
-	// Listen to incoming connections
-	log.Println("Starting SpeedyAuth listening for requests on port " + os.Getenv("SERVER_PORT"))
-	err := http.ListenAndServe(fmt.Sprintf("%s:%s", ap.serverName, ap.port), middlewares.LogRequest(http.DefaultServeMux))
 
-	// Exit if fail to start service
+	listener, err := net.Listen("tcp", ap.server.Addr)
 	if err != nil {
-		log.Fatal("Failed to start Service ")
+		log.Println("Failed to start Service ", err)
+		return err
 	}
+
+	ap.startBackgroundJobs()
+
+	// Listen to incoming connections
+	log.Println("Starting SpeedyAuth listening for requests on " + listener.Addr().String())
+	go func() {
+		var err error
+		if ap.server.TLSConfig != nil {
+			// Certificates are served by the TLSConfig so no files are passed here
+			err = ap.server.ServeTLS(listener, "", "")
+		} else {
+			err = ap.server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Service stopped unexpectedly ", err)
+			ap.errors <- err
+		}
+	}()
+	return nil
+}
+
+// Errors reports failures of the server after Start has returned
+func (ap *APIServer) Errors() <-chan error {
+	return ap.errors
+}
+
+// Shutdown drains in-flight requests until ctx expires, stops background jobs and closes the database pool
+func (ap *APIServer) Shutdown(ctx context.Context) error {
+	log.Println("Shutting down SpeedyAuth")
+	var errArr []error
+
+	if err := ap.server.Shutdown(ctx); err != nil {
+		log.Println("Failed to drain requests ", err)
+		errArr = append(errArr, err)
+	}
+
+	close(ap.stop)
+	ap.jobs.Wait()
+
+	if databaseConnection, err := ap.db.DB(); err == nil {
+		if err := databaseConnection.Close(); err != nil {
+			log.Println("Failed to close database connections ", err)
+			errArr = append(errArr, err)
+		}
+	}
+
+	return errors.Join(errArr...)
 }
 
 func (ap *APIServer) setupRoutes() {
@@ -41,17 +176,173 @@ func (ap *APIServer) setupRoutes() {
 	ap.registerUSerFunctions()
 }
 
+// register functions that do not require authentication
 func (ap *APIServer) registerGlobalFunctions() {
+	authController := controllers.NewAuthController(ap.db)
+
+	wellKnownController := controllers.NewWellKnownController(ap.db)
 
+	wellKnown := ap.router.Group("/.well-known")
+	wellKnown.Get("/jwks.json", wellKnownController.JWKS)
+	wellKnown.Get("/openid-configuration", wellKnownController.OpenIDConfiguration)
+
+	oauthController := controllers.NewOAuthController(ap.db)
+
+	oauth := ap.router.Group("/oauth")
+	oauth.Get("/authorize", oauthController.Authorize)
+	oauth.Post("/authorize", oauthController.ApproveAuthorization)
+	oauth.Post("/token", oauthController.Token)
+	oauth.Post("/device_authorization", oauthController.DeviceAuthorization)
+	oauth.Get("/device", oauthController.Device)
+	oauth.Post("/device", oauthController.ApproveDevice)
+	oauth.Post("/introspect", oauthController.Introspect)
+	oauth.Post("/revoke", oauthController.Revoke)
+
+	userInfo := oauth.Group("/userinfo", middlewares.JwtAuth, middlewares.RequireUser)
+	userInfo.Get("/", oauthController.UserInfo)
+	userInfo.Post("/", oauthController.UserInfo)
+
+	api := ap.router.Group(apiPrefix)
+	api.Get("/health", authController.Health)
+
+	auth := api.Group("/auth")
+	auth.Post("/login", authController.Login)
+	auth.Post("/register", authController.Register)
+	auth.Get("/verify-email", authController.VerifyEmail)
+	auth.Post("/verify-email/resend", authController.ResendVerification)
+	auth.Post("/passwordless", authController.PasswordLessLogin)
+	auth.Post("/passwordless/complete", authController.CompletePasswordLogin)
+	auth.Get("/passwordless/link", authController.MagicLinkLogin)
+	auth.Post("/two-factor", authController.ValidateTwoFactor)
+	auth.Post("/refresh-token", authController.RefreshToken)
+	auth.Post("/password-reset", authController.PasswordResetRequest)
+	auth.Post("/password-reset/verify", authController.VerifyAndChangePassword)
+
+	federationController := controllers.NewFederationController(ap.db)
+
+	federated := auth.Group("/federated")
+	federated.Get("/providers", federationController.Providers)
+	federated.Get("/login", federationController.Login)
+	federated.Get("/callback", federationController.Callback)
+
+	samlController := controllers.NewSAMLController(ap.db)
+
+	saml := auth.Group("/saml")
+	saml.Get("/providers", samlController.Providers)
+	saml.Get("/metadata", samlController.Metadata)
+	saml.Get("/login", samlController.Login)
+	saml.Post("/acs", samlController.ACS)
+
+	passkeyController := controllers.NewPasskeyController(ap.db)
+
+	passkeys := auth.Group("/passkeys")
+	passkeys.Post("/login/begin", passkeyController.BeginLogin)
+	passkeys.Post("/login/finish", passkeyController.FinishLogin)
+	passkeys.Post("/two-factor/begin", passkeyController.BeginTwoFactor)
+	passkeys.Post("/two-factor/finish", passkeyController.FinishTwoFactor)
 }
 
+// register functions that require an authenticated user
 func (ap *APIServer) registerUSerFunctions() {
+	userController := controllers.NewUserController(ap.db)
+
+	user := ap.router.Group(apiPrefix+"/user", middlewares.JwtAuth, middlewares.RequireUser, middlewares.RequireFirstParty)
+	user.Get("/", userController.Index)
+	user.Put("/", userController.Update)
+	user.Post("/logout", userController.Logout)
+	user.Post("/two-factor/enable", userController.EnableTwoFactor)
+	user.Post("/two-factor/verify", userController.VerifyPassCode)
+	user.Post("/two-factor/totp/confirm", userController.ConfirmTOTP)
+	user.Get("/two-factor/totp/qr", userController.TOTPQRCode)
+	user.Post("/two-factor/disable", userController.DisableTwoFactor)
+	user.Post("/phone/verify", userController.StartPhoneVerification)
+	user.Post("/phone/verify/confirm", userController.ConfirmPhoneVerification)
+	user.Get("/two-factor/recovery-codes", userController.RecoveryCodes)
+	user.Post("/two-factor/recovery-codes", userController.RegenerateRecoveryCodes)
 
+	passkeyController := controllers.NewPasskeyController(ap.db)
+
+	user.Get("/passkeys", passkeyController.List)
+	user.Post("/passkeys/register/begin", passkeyController.BeginRegistration)
+	user.Post("/passkeys/register/finish", passkeyController.FinishRegistration)
+	user.Post("/passkeys/rename", passkeyController.Rename)
+	user.Post("/passkeys/delete", passkeyController.Delete)
 }
 
 // register admin functions
 func (ap *APIServer) registerAdminFunctions() {
+	adminController := controllers.NewAdminController(ap.db)
 
+	adminMiddlewares := []Middleware{middlewares.JwtAuth, middlewares.RequireUser, middlewares.RequireFirstParty, middlewares.RequireRole("ADMIN")}
+	if ap.config.TLS.MutualTLS() {
+		adminMiddlewares = append([]Middleware{middlewares.RequireClientCert}, adminMiddlewares...)
+	}
+	admin := ap.router.Group(apiPrefix+"/admin", adminMiddlewares...)
+	admin.Get("/users", adminController.ListUsers)
+	admin.Post("/users/disable", adminController.DisableUser)
+	admin.Post("/users/enable", adminController.EnableUser)
+	admin.Post("/users/unlock", adminController.UnlockUser)
+	admin.Get("/clients", adminController.ListClients)
+	admin.Post("/clients", adminController.CreateClient)
+	admin.Post("/clients/rotate-secret", adminController.RotateClientSecret)
+	admin.Post("/clients/disable", adminController.DisableClient)
+	admin.Post("/clients/enable", adminController.EnableClient)
+	admin.Get("/keys", adminController.ListSigningKeys)
+	admin.Post("/keys/rotate", adminController.RotateSigningKey)
+}
+
+// startBackgroundJobs runs the periodic jobs until Shutdown is called
+func (ap *APIServer) startBackgroundJobs() {
+	cleanupInterval := ap.config.CleanupInterval
+	if cleanupInterval <= 0 {
+		cleanupInterval = 24 * time.Hour
+	}
+	ap.cleanUp()
+	ap.runEvery(cleanupInterval, ap.cleanUp)
+
+	revocationInterval := ap.config.RevocationRefreshInterval
+	if revocationInterval <= 0 {
+		revocationInterval = 10 * time.Second
+	}
+	ap.runEvery(revocationInterval, func() {
+		if err := ap.revocations.Refresh(); err != nil {
+			log.Println("Failed to reload revoked tokens ", err)
+		}
+	})
+
+	if ap.keys != nil {
+		keyInterval := ap.config.KeyRefreshInterval
+		if keyInterval <= 0 {
+			keyInterval = time.Minute
+		}
+		ap.runEvery(keyInterval, ap.refreshKeys)
+	}
+
+	if ap.certs != nil {
+		certInterval := ap.config.TLS.ReloadInterval
+		if certInterval <= 0 {
+			certInterval = time.Minute
+		}
+		ap.runEvery(certInterval, ap.certs.reloadAndLog)
+	}
+}
+
+// runEvery calls job on every tick of interval until Shutdown is called
+func (ap *APIServer) runEvery(interval time.Duration, job func()) {
+	ap.jobs.Add(1)
+	go func() {
+		defer ap.jobs.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				job()
+			case <-ap.stop:
+				return
+			}
+		}
+	}()
 }
 
 // Cleanup
@@ -60,6 +351,19 @@ func (ap *APIServer) cleanUp() {
 	// Deletes expired tokens after 30 days
 	err := authService.DeleteExpiredTokens(30)
 	if err != nil {
-		log.Fatal("There was a problem cleaning up ")
+		log.Println("There was a problem cleaning up ", err)
+	}
+}
+
+// refreshKeys rotates the signing key when due and picks up rotations made by other instances
+func (ap *APIServer) refreshKeys() {
+	if err := ap.keys.RotateIfDue(); err != nil {
+		log.Println("Scheduled signing key rotation failed ", err)
+	}
+	if err := ap.keys.DeleteExpiredKeys(); err != nil {
+		log.Println("Failed to delete expired signing keys ", err)
+	}
+	if err := ap.keys.LoadKeyRing(); err != nil {
+		log.Println("Failed to reload the signing key ring ", err)
 	}
 }
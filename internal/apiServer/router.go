@@ -0,0 +1,103 @@
+package apiserver
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bachdang2k/security-golang/internal/utils"
+)
+
+// Middleware wraps a handler, it has the same shape as middlewares.JwtAuth
+type Middleware func(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc
+
+// Router dispatches requests on exact path and method
+type Router struct {
+	routes map[string]map[string]http.HandlerFunc
+}
+
+// RouteGroup registers routes under a common prefix sharing the same middlewares
+type RouteGroup struct {
+	router      *Router
+	prefix      string
+	middlewares []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]map[string]http.HandlerFunc)}
+}
+
+// Group creates a route group mounted at prefix
+func (router *Router) Group(prefix string, middlewares ...Middleware) *RouteGroup {
+	return &RouteGroup{router: router, prefix: cleanPath(prefix), middlewares: middlewares}
+}
+
+// Group creates a nested route group which inherits the parent middlewares
+func (group *RouteGroup) Group(prefix string, middlewares ...Middleware) *RouteGroup {
+	combined := append(append([]Middleware{}, group.middlewares...), middlewares...)
+	return &RouteGroup{router: group.router, prefix: cleanPath(group.prefix + "/" + prefix), middlewares: combined}
+}
+
+// Handle registers a handler for the method and path relative to the group prefix
+func (group *RouteGroup) Handle(method, path string, handler func(w http.ResponseWriter, r *http.Request)) {
+	wrapped := http.HandlerFunc(handler)
+	// Apply middlewares so that the first one registered runs first
+	for i := len(group.middlewares) - 1; i >= 0; i-- {
+		wrapped = group.middlewares[i](wrapped)
+	}
+
+	fullPath := cleanPath(group.prefix + "/" + path)
+	if group.router.routes[fullPath] == nil {
+		group.router.routes[fullPath] = make(map[string]http.HandlerFunc)
+	}
+	group.router.routes[fullPath][method] = wrapped
+}
+
+func (group *RouteGroup) Get(path string, handler func(w http.ResponseWriter, r *http.Request)) {
+	group.Handle(http.MethodGet, path, handler)
+}
+
+func (group *RouteGroup) Post(path string, handler func(w http.ResponseWriter, r *http.Request)) {
+	group.Handle(http.MethodPost, path, handler)
+}
+
+func (group *RouteGroup) Put(path string, handler func(w http.ResponseWriter, r *http.Request)) {
+	group.Handle(http.MethodPut, path, handler)
+}
+
+func (group *RouteGroup) Delete(path string, handler func(w http.ResponseWriter, r *http.Request)) {
+	group.Handle(http.MethodDelete, path, handler)
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	methods, ok := router.routes[cleanPath(r.URL.Path)]
+	if !ok {
+		utils.JSONError(w, "Resource Not Found", http.StatusNotFound)
+		return
+	}
+
+	handler, ok := methods[r.Method]
+	if !ok {
+		allowed := make([]string, 0, len(methods))
+		for method := range methods {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		utils.JSONError(w, "This Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	handler(w, r)
+}
+
+// cleanPath collapses duplicate slashes and removes the trailing slash
+func cleanPath(path string) string {
+	segments := strings.Split(path, "/")
+	parts := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if segment != "" {
+			parts = append(parts, segment)
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
@@ -0,0 +1,54 @@
+package apiserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	api := router.Group("/api/v1")
+	api.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var tests = []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/api/v1/health", http.StatusOK},
+		{http.MethodGet, "/api/v1/health/", http.StatusOK},
+		{http.MethodPost, "/api/v1/health", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/v1/unknown", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+			if recorder.Code != tt.want {
+				t.Errorf("Expected %d got %d", tt.want, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestRouterGroupMiddleware(t *testing.T) {
+	router := NewRouter()
+	blocked := func(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}
+	router.Group("/admin", blocked).Get("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/admin/users", nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected middleware to block request got %d", recorder.Code)
+	}
+}
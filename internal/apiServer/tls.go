@@ -0,0 +1,184 @@
+package apiserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig holds the settings used when the server terminates TLS itself
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is one of "1.2" or "1.3", defaults to "1.2"
+	MinVersion string
+	// CipherPolicy is either "modern", "intermediate" or a comma separated list of cipher suite names
+	CipherPolicy string
+	// ClientCAFile enables mutual TLS, admin routes then require a client certificate signed by this CA
+	ClientCAFile string
+	// ReloadInterval is how often the certificate files are checked for changes
+	ReloadInterval time.Duration
+}
+
+// MutualTLS reports whether client certificates are requested
+func (config *TLSConfig) MutualTLS() bool {
+	return config != nil && config.ClientCAFile != ""
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// intermediateCipherSuites are TLS 1.2 suites with forward secrecy and AEAD ciphers
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// ParseTLSVersion converts a version such as "1.3" to its crypto/tls constant
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	if value, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]; ok {
+		return value, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q", version)
+}
+
+// ParseCipherPolicy converts a cipher policy to the TLS 1.2 cipher suites it allows
+func ParseCipherPolicy(policy string) ([]uint16, error) {
+	switch strings.ToLower(policy) {
+	case "", "modern":
+		// TLS 1.3 suites are not configurable, restrict 1.2 to the strongest suites
+		return intermediateCipherSuites[:4], nil
+	case "intermediate":
+		return intermediateCipherSuites, nil
+	}
+
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, name := range strings.Split(policy, ",") {
+		id, ok := available[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// newTLSConfig builds the crypto/tls configuration served by the listener
+func newTLSConfig(config *TLSConfig, reloader *certReloader) (*tls.Config, error) {
+	minVersion, err := ParseTLSVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := ParseCipherPolicy(config.CipherPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.MutualTLS() {
+		caFile, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caFile) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = clientCAs
+		// Only the admin routes require a certificate, the rest of the API stays reachable without one
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// certReloader serves the current certificate and reloads it when the files change on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate
+func (reloader *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.certificate, nil
+}
+
+// reload loads the key pair again if either file was modified, it reports whether the certificate changed
+func (reloader *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(reloader.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	reloader.mu.RLock()
+	unchanged := reloader.certificate != nil &&
+		certInfo.ModTime().Equal(reloader.certModTime) && keyInfo.ModTime().Equal(reloader.keyModTime)
+	reloader.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	reloader.mu.Lock()
+	reloader.certificate = &certificate
+	reloader.certModTime = certInfo.ModTime()
+	reloader.keyModTime = keyInfo.ModTime()
+	reloader.mu.Unlock()
+	return true, nil
+}
+
+// reloadAndLog reloads the certificate, a failed reload keeps the previous certificate
+func (reloader *certReloader) reloadAndLog() {
+	changed, err := reloader.reload()
+	if err != nil {
+		log.Println("Failed to reload TLS certificate ", err)
+	} else if changed {
+		log.Println("Reloaded TLS certificate from " + reloader.certFile)
+	}
+}
@@ -0,0 +1,93 @@
+package apiserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a certificate and key for commonName and returns the file paths
+func writeSelfSignedCert(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir, "first")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal("Failed to load certificate ", err)
+	}
+
+	changed, err := reloader.reload()
+	if err != nil || changed {
+		t.Error("Expected unchanged files not to be reloaded")
+	}
+
+	writeSelfSignedCert(t, dir, "second")
+	// Make sure the modification time moves even on coarse grained file systems
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, later, later)
+	_ = os.Chtimes(keyFile, later, later)
+
+	changed, err = reloader.reload()
+	if err != nil || !changed {
+		t.Fatal("Expected the new certificate to be loaded ", err)
+	}
+	certificate, _ := reloader.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil || parsed.Subject.CommonName != "second" {
+		t.Error("Expected the reloaded certificate to be served")
+	}
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	if _, err := ParseTLSVersion("1.1"); err == nil {
+		t.Error("Expected TLS 1.1 to be rejected")
+	}
+	if _, err := ParseTLSVersion("1.3"); err != nil {
+		t.Error("Expected TLS 1.3 to be accepted")
+	}
+	if _, err := ParseCipherPolicy("TLS_RSA_WITH_RC4_UNKNOWN"); err == nil {
+		t.Error("Expected unknown cipher suite to be rejected")
+	}
+	suites, err := ParseCipherPolicy("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	if err != nil || len(suites) != 1 {
+		t.Error("Expected named cipher suite to be accepted")
+	}
+}
@@ -0,0 +1,245 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/services"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+type AdminController struct {
+	db            *gorm.DB
+	userService   services.UserService
+	authService   services.AuthService
+	keyService    services.KeyService
+	clientService services.ClientService
+	lockout       *services.LockoutService
+	validate      *validator.Validate
+}
+
+func NewAdminController(db *gorm.DB) *AdminController {
+	return &AdminController{
+		db:            db,
+		userService:   *services.NewUserService(db),
+		authService:   *services.NewAuthService(db),
+		keyService:    *services.NewKeyService(db),
+		clientService: *services.NewClientService(db),
+		lockout:       services.NewLockoutService(db),
+		validate:      validator.New(),
+	}
+}
+
+// ListUsers Lists users paginated by the offset and limit query parameters
+func (controller *AdminController) ListUsers(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 20
+	}
+
+	users, err := controller.userService.List(offset, limit)
+	if err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.JSONResponse(w, users)
+}
+
+// ListSigningKeys Lists the JWT signing keys that can still verify tokens
+func (controller *AdminController) ListSigningKeys(w http.ResponseWriter, r *http.Request) {
+	if !controller.keyService.Enabled() {
+		utils.JSONError(w, services.ErrKeyRingDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	keys, err := controller.keyService.List()
+	if err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.JSONResponse(w, keys)
+}
+
+// RotateSigningKey Starts signing with a new key, the previous key keeps verifying until its tokens expire
+func (controller *AdminController) RotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	if !controller.keyService.Enabled() {
+		utils.JSONError(w, services.ErrKeyRingDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	if _, err := controller.keyService.Rotate(); err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	keys, err := controller.keyService.List()
+	if err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.JSONResponse(w, keys)
+}
+
+// DisableUser Deactivates the account and revokes all of its tokens
+func (controller *AdminController) DisableUser(w http.ResponseWriter, r *http.Request) {
+	controller.setUserActive(w, r, false)
+}
+
+// EnableUser Reactivates the account
+func (controller *AdminController) EnableUser(w http.ResponseWriter, r *http.Request) {
+	controller.setUserActive(w, r, true)
+}
+
+// UnlockUser Lifts the lockout of an account after too many failed attempts before it expires
+func (controller *AdminController) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	request := models.AdminUserRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.lockout.Unlock(request.UserId, r.RemoteAddr, r.UserAgent()); err != nil {
+		if errors.Is(err, services.ErrUserNotFound) {
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+func (controller *AdminController) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	request := models.AdminUserRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.userService.SetActive(request.UserId, active); err != nil {
+		if errors.Is(err, services.ErrUserNotFound) {
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+// ListClients Lists the registered OAuth clients
+func (controller *AdminController) ListClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := controller.clientService.List()
+	if err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.JSONResponse(w, clients)
+}
+
+// CreateClient Registers an OAuth client, the secret is only shown in this response
+func (controller *AdminController) CreateClient(w http.ResponseWriter, r *http.Request) {
+	request := models.CreateClientRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := controller.clientService.Create(request)
+	if err != nil {
+		if errors.Is(err, services.ErrPublicClient) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, client)
+}
+
+// RotateClientSecret Issues a new secret for the client, the old one stops working immediately
+func (controller *AdminController) RotateClientSecret(w http.ResponseWriter, r *http.Request) {
+	request := models.AdminClientRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	client, err := controller.clientService.RotateSecret(request.ClientId)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrClientNotFound):
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, services.ErrPublicClient):
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, client)
+}
+
+// DisableClient Deactivates the client and revokes every token issued to it
+func (controller *AdminController) DisableClient(w http.ResponseWriter, r *http.Request) {
+	controller.setClientActive(w, r, false)
+}
+
+// EnableClient Reactivates the client
+func (controller *AdminController) EnableClient(w http.ResponseWriter, r *http.Request) {
+	controller.setClientActive(w, r, true)
+}
+
+func (controller *AdminController) setClientActive(w http.ResponseWriter, r *http.Request, active bool) {
+	request := models.AdminClientRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.clientService.SetActive(request.ClientId, active); err != nil {
+		if errors.Is(err, services.ErrClientNotFound) {
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"strings"
 
 	"github.com/bachdang2k/security-golang/internal/models"
 	"github.com/bachdang2k/security-golang/internal/utils"
@@ -15,18 +16,25 @@ import (
 
 type AuthController struct {
 	// Registered Services
-	db          *gorm.DB
-	userService services.UserService
-	authService services.AuthService
-	validate    *validator.Validate
+	db                  *gorm.DB
+	userService         services.UserService
+	authService         services.AuthService
+	verificationService services.VerificationService
+	magicLinkService    *services.MagicLinkService
+	validate            *validator.Validate
 }
 
+// magicLinkCookie ties a magic link to the browser that asked for it
+const magicLinkCookie = "passwordless_link"
+
 func NewAuthController(db *gorm.DB) *AuthController {
 	return &AuthController{
-		db:          db,
-		userService: *services.NewUserService(db),
-		authService: *services.NewAuthService(db),
-		validate:    validator.New(),
+		db:                  db,
+		userService:         *services.NewUserService(db),
+		authService:         *services.NewAuthService(db),
+		verificationService: *services.NewVerificationService(db),
+		magicLinkService:    services.NewMagicLinkService(db),
+		validate:            validator.New(),
 	}
 }
 
@@ -47,6 +55,10 @@ func (controller *AuthController) Login(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		if errors.Is(err, services.ErrInvalidUsername) || errors.Is(err, services.ErrInvalidPassword) || errors.Is(err, services.ErrAccountNotActive) {
 			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if errors.Is(err, services.ErrDirectoryUnavailable) {
+			utils.JSONError(w, err.Error(), http.StatusServiceUnavailable)
+		} else if errors.Is(err, services.ErrTooManyAttempts) || errors.Is(err, services.ErrAccountLocked) {
+			lockoutError(w, err)
 		} else {
 			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
 		}
@@ -70,10 +82,34 @@ func (controller *AuthController) PasswordLessLogin(w http.ResponseWriter, r *ht
 		return
 	}
 	var response *models.PasswordLessAuthResponse
-	response, err = controller.authService.PasswordLessLogin(request.Username, request.SendMethod, "", "")
+	switch strings.ToUpper(request.Mode) {
+	case "", "CODE":
+		response, err = controller.authService.PasswordLessLogin(request.Username, request.SendMethod, "", "")
+	case "LINK":
+		var binding string
+		response, binding, err = controller.magicLinkService.Send(request.Username, r.RemoteAddr, r.UserAgent())
+		if err == nil && binding != "" {
+			http.SetCookie(w, &http.Cookie{
+				Name:     magicLinkCookie,
+				Value:    binding,
+				Path:     "/api/v1/auth/passwordless",
+				MaxAge:   int(controller.magicLinkService.Expiry().Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	default:
+		utils.JSONError(w, "mode must be CODE or LINK", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		if errors.Is(err, services.ErrInvalidUsername) || errors.Is(err, services.ErrInvalidPassword) || errors.Is(err, services.ErrAccountNotActive) {
 			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if errors.Is(err, services.ErrSendMethod) || errors.Is(err, services.ErrPhoneNotVerified) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, services.ErrSMSUnavailable) || errors.Is(err, services.ErrSendingSMS) || errors.Is(err, services.ErrSendingMail) {
+			utils.JSONError(w, err.Error(), http.StatusServiceUnavailable)
 		} else {
 			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
 		}
@@ -99,8 +135,10 @@ func (controller *AuthController) CompletePasswordLogin(w http.ResponseWriter, r
 	//var response *models.AuthenticationResponse
 	response, err := controller.authService.CompletePasswordLessLogin(request.Code, request.RequestId)
 	if err != nil {
-		if errors.Is(err, services.ErrInvalidCode) {
+		if errors.Is(err, services.ErrInvalidCode) || errors.Is(err, services.ErrAccountNotActive) {
 			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if errors.Is(err, services.ErrTooManyAttempts) || errors.Is(err, services.ErrAccountLocked) {
+			lockoutError(w, err)
 		} else {
 			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
 		}
@@ -109,6 +147,26 @@ func (controller *AuthController) CompletePasswordLogin(w http.ResponseWriter, r
 	utils.JSONResponse(w, response)
 }
 
+// MagicLinkLogin Completes a passwordless login from the emailed link and redirects to the app with the tokens
+func (controller *AuthController) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	var binding string
+	if cookie, err := r.Cookie(magicLinkCookie); err == nil {
+		binding = cookie.Value
+		// The cookie is only needed once, whatever the outcome
+		http.SetCookie(w, &http.Cookie{Name: magicLinkCookie, Path: "/api/v1/auth/passwordless", MaxAge: -1, HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	}
+
+	response, err := controller.magicLinkService.CompleteLogin(r.URL.Query().Get("token"), binding)
+	if err != nil && !errors.Is(err, services.ErrInvalidMagicLink) && !errors.Is(err, services.ErrAccountNotActive) &&
+		!errors.Is(err, services.ErrTooManyAttempts) && !errors.Is(err, services.ErrAccountLocked) {
+		log.Println("Magic link login failed ", err)
+		err = services.ErrServer
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, controller.magicLinkService.RedirectURL(response, err), http.StatusFound)
+}
+
 // RefreshToken Function To Refresh Token
 func (controller *AuthController) RefreshToken(w http.ResponseWriter, r *http.Request) {
 	request := models.TokenRefreshRequest{}
@@ -118,7 +176,7 @@ func (controller *AuthController) RefreshToken(w http.ResponseWriter, r *http.Re
 	}
 	response, err := controller.authService.GenerateRefreshToken(request.RefreshToken, r.RemoteAddr, r.UserAgent())
 	if err != nil {
-		if errors.Is(err, services.ErrInvalidToken) {
+		if errors.Is(err, services.ErrInvalidToken) || errors.Is(err, services.ErrTokenReuse) || errors.Is(err, services.ErrAccountNotActive) {
 			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
 		} else {
 			utils.JSONError(w, services.ErrServer.Error(), http.StatusUnauthorized)
@@ -130,22 +188,187 @@ func (controller *AuthController) RefreshToken(w http.ResponseWriter, r *http.Re
 
 // PasswordResetRequest Reset Password Request
 func (controller *AuthController) PasswordResetRequest(w http.ResponseWriter, r *http.Request) {
+	request := models.PasswordResetRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Always report success so the endpoint cannot be used to discover usernames
+	if err := controller.authService.RequestPasswordReset(request.Username); err != nil {
+		log.Println("Password reset request failed ", err)
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
 }
 
 // VerifyAndChangePassword Verify and update the password
 func (controller *AuthController) VerifyAndChangePassword(w http.ResponseWriter, r *http.Request) {
+	request := models.VerifyChangePasswordRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	success, err := controller.authService.VerifyAndSetNewPassWord(request.Code, request.Password)
+	if err != nil {
+		if errors.Is(err, services.ErrStrongPassword) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, services.ErrInvalidCode) {
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: success})
 }
 
 // Register Function register User
 func (controller *AuthController) Register(w http.ResponseWriter, r *http.Request) {
+	request := models.UserRegistrationRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	user, err := controller.userService.Register(request)
+	if err != nil {
+		if errors.Is(err, services.ErrUserNameExists) {
+			utils.JSONError(w, err.Error(), http.StatusConflict)
+		} else if errors.Is(err, services.ErrStrongPassword) || errors.Is(err, services.ErrInvalidPhoneNumber) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// The account stays inactive until the link is followed, a failed send can be retried through resend
+	if err := controller.verificationService.SendVerification(*user); err != nil {
+		log.Println("Failed to send verification email ", err)
+	}
+	utils.JSONResponse(w, user)
+}
+
+// VerifyEmail Activates the account the verification link was issued for
+func (controller *AuthController) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		utils.JSONError(w, services.ErrInvalidVerification.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.verificationService.VerifyEmail(token); err != nil {
+		if errors.Is(err, services.ErrInvalidVerification) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else if errors.Is(err, services.ErrEmailAddressExists) {
+			utils.JSONError(w, err.Error(), http.StatusConflict)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+// ResendVerification Sends a new verification link, the response does not reveal whether the address is registered
+func (controller *AuthController) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	request := models.ResendVerificationRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.verificationService.ResendVerification(request.EmailAddress); err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
 }
 
 // ValidateTwoFactor Validates Two Factor authCtrl function is only called when two factor is required
 func (controller *AuthController) ValidateTwoFactor(w http.ResponseWriter, r *http.Request) {
+	request := models.VerifyTwoFactorRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var (
+		response *models.AuthenticationResponse
+		err      error
+	)
+	switch strings.ToUpper(request.Method) {
+	case "TOTP":
+		// The token is the short lived JWT returned after the password step
+		userId, tokenErr := utils.ValidateTwoFactorJwtAndGetUserId(request.Token)
+		if tokenErr != nil {
+			utils.JSONError(w, services.ErrInvalidToken.Error(), http.StatusUnauthorized)
+			return
+		}
+		response, err = controller.authService.VerifyOTP(uint(userId), request.Code, r.RemoteAddr, r.UserAgent())
+	case "EMAIL", "SMS":
+		// The token is the request id of the code that was sent
+		response, err = controller.authService.ValidateTwoFactor(request.Code, request.Token, r.RemoteAddr, r.UserAgent())
+	case "RECOVERY":
+		// The token is the one returned for any of the methods, the code is a recovery code
+		response, err = controller.authService.ValidateRecoveryCode(request.Token, request.Code, r.RemoteAddr, r.UserAgent())
+	default:
+		utils.JSONError(w, "Unsupported two factor method", http.StatusBadRequest)
+		return
+	}
 
+	if err != nil {
+		if errors.Is(err, services.ErrTwoFactorCode) || errors.Is(err, services.ErrPassCode) ||
+			errors.Is(err, services.ErrRecoveryCode) || errors.Is(err, services.ErrInvalidToken) {
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		} else if errors.Is(err, services.ErrTooManyAttempts) || errors.Is(err, services.ErrAccountLocked) {
+			lockoutError(w, err)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, response)
+}
+
+// lockoutError reports a rejected attempt, 423 while the account is locked and 429 while the caller must wait
+func lockoutError(w http.ResponseWriter, err error) {
+	if errors.Is(err, services.ErrAccountLocked) {
+		utils.JSONError(w, err.Error(), http.StatusLocked)
+	} else {
+		utils.JSONError(w, err.Error(), http.StatusTooManyRequests)
+	}
 }
 
 func (controller *AuthController) Health(w http.ResponseWriter, r *http.Request) {
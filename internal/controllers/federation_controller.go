@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bachdang2k/security-golang/internal/services"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// federatedLoginCookie ties the provider callback to the browser that started the login
+const federatedLoginCookie = "federated_login"
+
+type FederationController struct {
+	db                *gorm.DB
+	federationService *services.FederationService
+}
+
+func NewFederationController(db *gorm.DB) *FederationController {
+	return &FederationController{
+		db:                db,
+		federationService: services.NewFederationService(db),
+	}
+}
+
+// Providers lists the identity providers users can log in with
+func (controller *FederationController) Providers(w http.ResponseWriter, r *http.Request) {
+	utils.JSONResponse(w, map[string][]string{"providers": controller.federationService.Providers()})
+}
+
+// Login redirects the user to the identity provider given by the provider query parameter
+func (controller *FederationController) Login(w http.ResponseWriter, r *http.Request) {
+	redirectUrl, binding, err := controller.federationService.StartLogin(r.Context(), r.URL.Query().Get("provider"))
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownProvider) {
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		} else {
+			utils.JSONError(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     federatedLoginCookie,
+		Value:    binding,
+		Path:     "/api/v1/auth/federated",
+		MaxAge:   int(controller.federationService.RequestTime().Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		// Lax lets the cookie through on the top level redirect back from the provider
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+// Callback completes the login when the identity provider redirects the user back
+func (controller *FederationController) Callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	// The cookie is only needed once, whatever the outcome
+	http.SetCookie(w, &http.Cookie{Name: federatedLoginCookie, Path: "/api/v1/auth/federated", MaxAge: -1, HttpOnly: true,
+		Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+
+	if providerError := query.Get("error"); providerError != "" {
+		utils.JSONError(w, "identity provider returned "+providerError, http.StatusUnauthorized)
+		return
+	}
+	cookie, err := r.Cookie(federatedLoginCookie)
+	if err != nil || query.Get("state") == "" || query.Get("code") == "" {
+		utils.JSONError(w, services.ErrFederatedLogin.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := controller.federationService.CompleteLogin(r.Context(), query.Get("state"), query.Get("code"), cookie.Value,
+		utils.GetIpAddress(r), r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrFederatedLogin), errors.Is(err, services.ErrUnknownProvider):
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrAccountNotLinked), errors.Is(err, services.ErrAccountNotActive):
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, response)
+}
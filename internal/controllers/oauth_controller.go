@@ -0,0 +1,518 @@
+package controllers
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/services"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// oauthTemplateDir is the directory holding the html pages of the authorization endpoint
+const oauthTemplateDir = "static/oauth_template/"
+
+// OAuthController serves the OAuth 2.0 endpoints, requests are form encoded and errors follow RFC 6749
+type OAuthController struct {
+	db            *gorm.DB
+	oauthService  services.OAuthService
+	clientService services.ClientService
+	authService   services.AuthService
+	oidcService   services.OIDCService
+	deviceService services.DeviceService
+}
+
+func NewOAuthController(db *gorm.DB) *OAuthController {
+	return &OAuthController{
+		db:            db,
+		oauthService:  *services.NewOAuthService(db),
+		clientService: *services.NewClientService(db),
+		authService:   *services.NewAuthService(db),
+		oidcService:   *services.NewOIDCService(db),
+		deviceService: *services.NewDeviceService(db),
+	}
+}
+
+// loginForm is the state of the login part of the OAuth pages
+type loginForm struct {
+	Username        string
+	TwoFactorMethod string
+	TwoFactorToken  string
+	Error           string
+}
+
+// authorizePage is the data of the login and consent page
+type authorizePage struct {
+	loginForm
+	ClientName string
+	Scopes     []string
+	Request    models.AuthorizationRequest
+}
+
+// devicePage is the data of the device verification page
+type devicePage struct {
+	loginForm
+	UserCode   string
+	ClientName string
+	Scopes     []string
+	Message    string
+}
+
+// Authorize Authorization endpoint (RFC 6749 section 4.1), shows the login and consent page
+func (controller *OAuthController) Authorize(w http.ResponseWriter, r *http.Request) {
+	request := authorizationRequestFromForm(r.URL.Query())
+	client, ok := controller.validAuthorizationRequest(w, r, &request)
+	if !ok {
+		return
+	}
+	renderAuthorizePage(w, http.StatusOK, newAuthorizePage(*client, request))
+}
+
+// ApproveAuthorization Handles the login and consent form, the code is sent to the redirect uri once the user is authenticated
+func (controller *OAuthController) ApproveAuthorization(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		renderAuthorizePage(w, http.StatusBadRequest, authorizePage{loginForm: loginForm{Error: err.Error()}})
+		return
+	}
+	request := authorizationRequestFromForm(r.PostForm)
+	client, ok := controller.validAuthorizationRequest(w, r, &request)
+	if !ok {
+		return
+	}
+	if r.PostForm.Get("action") != "approve" {
+		redirectAuthorizationError(w, r, request, "access_denied", "the user denied the request")
+		return
+	}
+
+	userDetails, form, code := controller.authenticateUser(r)
+	if userDetails == nil {
+		page := newAuthorizePage(*client, request)
+		page.loginForm = form
+		renderOAuthPage(w, code, "Authorize.html", page)
+		return
+	}
+
+	authorizationCode, err := controller.oauthService.CreateAuthorizationCode(request, userDetails.ID)
+	if err != nil {
+		redirectAuthorizationError(w, r, request, "server_error", services.ErrServer.Error())
+		return
+	}
+	redirectWithParams(w, r, request.RedirectUri, url.Values{"code": {authorizationCode}, "state": {request.State}})
+}
+
+// DeviceAuthorization Device authorization endpoint (RFC 8628 section 3.1)
+func (controller *OAuthController) DeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	client, ok := controller.authenticateClient(w, r, true)
+	if !ok {
+		return
+	}
+
+	response, err := controller.deviceService.StartAuthorization(*client, r.PostForm.Get("scope"))
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUnauthorizedClient):
+			utils.OAuthError(w, "unauthorized_client", err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrInvalidScope):
+			utils.OAuthError(w, "invalid_scope", err.Error(), http.StatusBadRequest)
+		default:
+			utils.OAuthError(w, "server_error", services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	utils.JSONResponse(w, response)
+}
+
+// Device Shows the page where the user enters the code displayed by the device
+func (controller *OAuthController) Device(w http.ResponseWriter, r *http.Request) {
+	page := devicePage{UserCode: r.URL.Query().Get("user_code")}
+	if page.UserCode == "" {
+		renderOAuthPage(w, http.StatusOK, "Device.html", page)
+		return
+	}
+
+	authorization, client, err := controller.deviceService.PendingAuthorization(page.UserCode, utils.GetIpAddress(r))
+	if err != nil {
+		page.Error = err.Error()
+		renderOAuthPage(w, userCodeStatus(err), "Device.html", page)
+		return
+	}
+	renderOAuthPage(w, http.StatusOK, "Device.html", newDevicePage(*authorization, *client, page.UserCode))
+}
+
+// ApproveDevice Handles the device login and consent form, the device receives tokens on its next poll
+func (controller *OAuthController) ApproveDevice(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		renderOAuthPage(w, http.StatusBadRequest, "Device.html", devicePage{loginForm: loginForm{Error: err.Error()}})
+		return
+	}
+	userCode := r.PostForm.Get("user_code")
+	authorization, client, err := controller.deviceService.PendingAuthorization(userCode, utils.GetIpAddress(r))
+	if err != nil {
+		renderOAuthPage(w, userCodeStatus(err), "Device.html", devicePage{UserCode: userCode, loginForm: loginForm{Error: err.Error()}})
+		return
+	}
+
+	if r.PostForm.Get("action") != "approve" {
+		if err := controller.deviceService.Deny(userCode); err != nil {
+			renderOAuthPage(w, http.StatusBadRequest, "Device.html", devicePage{loginForm: loginForm{Error: err.Error()}})
+			return
+		}
+		renderOAuthPage(w, http.StatusOK, "Device.html", devicePage{Message: "The device was denied access"})
+		return
+	}
+
+	userDetails, form, code := controller.authenticateUser(r)
+	if userDetails == nil {
+		page := newDevicePage(*authorization, *client, userCode)
+		page.loginForm = form
+		renderOAuthPage(w, code, "Device.html", page)
+		return
+	}
+
+	if err := controller.deviceService.Approve(userCode, userDetails.ID); err != nil {
+		renderOAuthPage(w, http.StatusBadRequest, "Device.html", devicePage{loginForm: loginForm{Error: err.Error()}})
+		return
+	}
+	renderOAuthPage(w, http.StatusOK, "Device.html", devicePage{Message: "Your device is connected"})
+}
+
+// Token Token endpoint (RFC 6749 section 3.2), supports the authorization_code, refresh_token, client_credentials and device_code grants
+func (controller *OAuthController) Token(w http.ResponseWriter, r *http.Request) {
+	client, ok := controller.authenticateClient(w, r, true)
+	if !ok {
+		return
+	}
+
+	var (
+		response *models.TokenResponse
+		err      error
+	)
+	switch grantType := r.PostForm.Get("grant_type"); grantType {
+	case services.GrantTypeAuthorizationCode:
+		code := r.PostForm.Get("code")
+		if code == "" {
+			utils.OAuthError(w, "invalid_request", "code is required", http.StatusBadRequest)
+			return
+		}
+		response, err = controller.oauthService.ExchangeAuthorizationCode(*client, code, r.PostForm.Get("redirect_uri"),
+			r.PostForm.Get("code_verifier"), r.RemoteAddr, r.UserAgent())
+	case services.GrantTypeRefreshToken:
+		refreshToken := r.PostForm.Get("refresh_token")
+		if refreshToken == "" {
+			utils.OAuthError(w, "invalid_request", "refresh_token is required", http.StatusBadRequest)
+			return
+		}
+		response, err = controller.oauthService.RefreshClientToken(*client, refreshToken, r.RemoteAddr, r.UserAgent())
+	case services.GrantTypeClientCredentials:
+		response, err = controller.oauthService.ClientCredentials(*client, r.PostForm.Get("scope"))
+	case services.GrantTypeDeviceCode:
+		deviceCode := r.PostForm.Get("device_code")
+		if deviceCode == "" {
+			utils.OAuthError(w, "invalid_request", "device_code is required", http.StatusBadRequest)
+			return
+		}
+		response, err = controller.deviceService.PollToken(*client, deviceCode, r.RemoteAddr, r.UserAgent())
+	case "":
+		utils.OAuthError(w, "invalid_request", "grant_type is required", http.StatusBadRequest)
+		return
+	default:
+		utils.OAuthError(w, "unsupported_grant_type", services.ErrUnsupportedGrantType.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidGrant):
+			utils.OAuthError(w, "invalid_grant", err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrUnauthorizedClient):
+			utils.OAuthError(w, "unauthorized_client", err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrInvalidScope):
+			utils.OAuthError(w, "invalid_scope", err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrAuthorizationPending):
+			utils.OAuthError(w, "authorization_pending", err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrSlowDown):
+			utils.OAuthError(w, "slow_down", err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrExpiredToken):
+			utils.OAuthError(w, "expired_token", err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrAccessDenied):
+			utils.OAuthError(w, "access_denied", err.Error(), http.StatusBadRequest)
+		default:
+			utils.OAuthError(w, "server_error", services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	utils.JSONResponse(w, response)
+}
+
+// UserInfo OpenID Connect userinfo endpoint, must be used after JwtAuth
+func (controller *OAuthController) UserInfo(w http.ResponseWriter, r *http.Request) {
+	scope := utils.GetScopeFromHttpContext(r)
+	if !models.StringList(strings.Fields(scope)).Contains(services.ScopeOpenId) {
+		utils.OAuthError(w, "insufficient_scope", "the access token was not granted the openid scope", http.StatusForbidden)
+		return
+	}
+
+	userInfo, err := controller.oidcService.UserInfo(utils.GetUserIdFromHttpContext(r), scope)
+	if err != nil {
+		utils.OAuthError(w, "invalid_token", err.Error(), http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	utils.JSONResponse(w, userInfo)
+}
+
+// Introspect Token introspection endpoint (RFC 7662)
+func (controller *OAuthController) Introspect(w http.ResponseWriter, r *http.Request) {
+	client, ok := controller.authenticateClient(w, r, false)
+	if !ok {
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		utils.OAuthError(w, "invalid_request", "token is required", http.StatusBadRequest)
+		return
+	}
+
+	response := controller.oauthService.Introspect(*client, token, r.PostForm.Get("token_type_hint"))
+	w.Header().Set("Cache-Control", "no-store")
+	utils.JSONResponse(w, response)
+}
+
+// Revoke Token revocation endpoint (RFC 7009)
+func (controller *OAuthController) Revoke(w http.ResponseWriter, r *http.Request) {
+	client, ok := controller.authenticateClient(w, r, false)
+	if !ok {
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		utils.OAuthError(w, "invalid_request", "token is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := controller.oauthService.Revoke(*client, token, r.PostForm.Get("token_type_hint")); err != nil {
+		utils.OAuthError(w, "server_error", services.ErrServer.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+// authenticateClient parses the form and checks client_secret_basic or client_secret_post credentials
+// When allowPublic is set a public client may identify itself with client_id alone
+func (controller *OAuthController) authenticateClient(w http.ResponseWriter, r *http.Request, allowPublic bool) (*models.OAuthClient, bool) {
+	if err := r.ParseForm(); err != nil {
+		utils.OAuthError(w, "invalid_request", err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	clientId, clientSecret, ok := r.BasicAuth()
+	if ok {
+		// RFC 6749 form encodes the credentials before placing them in the header
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if allowPublic && clientId != "" && clientSecret == "" {
+		client, err := controller.clientService.Get(clientId)
+		if err != nil || !client.Public {
+			utils.OAuthError(w, "invalid_client", services.ErrInvalidClient.Error(), http.StatusUnauthorized)
+			return nil, false
+		}
+		return client, true
+	}
+	if clientId == "" || clientSecret == "" {
+		utils.OAuthError(w, "invalid_client", "client authentication is required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	client, err := controller.clientService.Authenticate(clientId, clientSecret)
+	if err != nil {
+		utils.OAuthError(w, "invalid_client", err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return client, true
+}
+
+// validAuthorizationRequest validates the request and reports a failure to the user agent
+// Errors are only redirected once the client and redirect uri are known to be valid
+func (controller *OAuthController) validAuthorizationRequest(w http.ResponseWriter, r *http.Request, request *models.AuthorizationRequest) (*models.OAuthClient, bool) {
+	client, err := controller.oauthService.ValidateAuthorizationRequest(request)
+	if err == nil {
+		return client, true
+	}
+	if client == nil {
+		renderAuthorizePage(w, http.StatusBadRequest, authorizePage{loginForm: loginForm{Error: err.Error()}})
+		return nil, false
+	}
+
+	errorCode := "server_error"
+	switch {
+	case errors.Is(err, services.ErrUnsupportedResponse):
+		errorCode = "unsupported_response_type"
+	case errors.Is(err, services.ErrInvalidScope):
+		errorCode = "invalid_scope"
+	case errors.Is(err, services.ErrUnauthorizedClient):
+		errorCode = "unauthorized_client"
+	case errors.Is(err, services.ErrCodeChallenge):
+		errorCode = "invalid_request"
+	}
+	redirectAuthorizationError(w, r, *request, errorCode, err.Error())
+	return nil, false
+}
+
+// authenticateUser runs the password step and then the two factor step of the login form
+// It returns the user once both are complete, otherwise the form to render again with its status code
+func (controller *OAuthController) authenticateUser(r *http.Request) (*models.User, loginForm, int) {
+	form := loginForm{}
+	if twoFactorToken := r.PostForm.Get("two_factor_token"); twoFactorToken != "" {
+		form.TwoFactorToken = twoFactorToken
+		form.TwoFactorMethod = r.PostForm.Get("two_factor_method")
+		method := form.TwoFactorMethod
+		if r.PostForm.Get("recovery_code") != "" {
+			method = "RECOVERY"
+		}
+		userDetails, err := controller.authService.CompleteTwoFactor(method, twoFactorToken, r.PostForm.Get("code"))
+		if errors.Is(err, services.ErrAccountLocked) {
+			form.Error = err.Error()
+			return nil, form, http.StatusLocked
+		} else if errors.Is(err, services.ErrTooManyAttempts) {
+			form.Error = err.Error()
+			return nil, form, http.StatusTooManyRequests
+		} else if errors.Is(err, services.ErrPasskeyPage) {
+			form.Error = err.Error()
+			return nil, form, http.StatusUnauthorized
+		}
+		if err != nil {
+			form.Error = "The code is invalid or has expired"
+			return nil, form, http.StatusUnauthorized
+		}
+		return userDetails, form, http.StatusOK
+	}
+
+	form.Username = r.PostForm.Get("username")
+	userDetails, err := controller.authService.VerifyCredentials(form.Username, r.PostForm.Get("password"))
+	if err != nil {
+		if errors.Is(err, services.ErrAccountLocked) {
+			form.Error = err.Error()
+			return nil, form, http.StatusLocked
+		} else if errors.Is(err, services.ErrTooManyAttempts) {
+			form.Error = err.Error()
+			return nil, form, http.StatusTooManyRequests
+		} else if errors.Is(err, services.ErrAccountNotActive) {
+			form.Error = err.Error()
+		} else {
+			// Do not tell which of the two was wrong
+			form.Error = "Invalid username or password"
+		}
+		return nil, form, http.StatusUnauthorized
+	}
+
+	if userDetails.TwoFactorEnabled {
+		// Same second step as the API login, the code is submitted with the form
+		response, err := controller.authService.BeginTwoFactor(*userDetails, r.RemoteAddr, r.UserAgent())
+		if err != nil {
+			form.Error = services.ErrServer.Error()
+			return nil, form, http.StatusInternalServerError
+		}
+		form.TwoFactorToken = response.Token
+		form.TwoFactorMethod = response.TwoFactorMethod
+		return nil, form, http.StatusOK
+	}
+	return userDetails, form, http.StatusOK
+}
+
+// userCodeStatus is the status of the device page when the user code was not accepted
+func userCodeStatus(err error) int {
+	if errors.Is(err, services.ErrTooManyAttempts) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadRequest
+}
+
+func authorizationRequestFromForm(values url.Values) models.AuthorizationRequest {
+	return models.AuthorizationRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientId:            values.Get("client_id"),
+		RedirectUri:         values.Get("redirect_uri"),
+		RedirectUriSent:     values.Get("redirect_uri") != "",
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+		Nonce:               values.Get("nonce"),
+	}
+}
+
+func newAuthorizePage(client models.OAuthClient, request models.AuthorizationRequest) authorizePage {
+	return authorizePage{
+		ClientName: client.Name,
+		Scopes:     strings.Fields(request.Scope),
+		Request:    request,
+	}
+}
+
+func newDevicePage(authorization models.DeviceAuthorization, client models.OAuthClient, userCode string) devicePage {
+	return devicePage{
+		UserCode:   userCode,
+		ClientName: client.Name,
+		Scopes:     strings.Fields(authorization.Scope),
+	}
+}
+
+func renderAuthorizePage(w http.ResponseWriter, code int, page authorizePage) {
+	renderOAuthPage(w, code, "Authorize.html", page)
+}
+
+func renderOAuthPage(w http.ResponseWriter, code int, templateFile string, page interface{}) {
+	tmpl, err := template.ParseFiles(oauthTemplateDir + templateFile)
+	if err != nil {
+		log.Println(err)
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// The page takes credentials, it must not be framed by another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.WriteHeader(code)
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Println(err)
+	}
+}
+
+// redirectAuthorizationError sends the error to the client through the redirect uri (RFC 6749 section 4.1.2.1)
+func redirectAuthorizationError(w http.ResponseWriter, r *http.Request, request models.AuthorizationRequest, errorCode, description string) {
+	params := url.Values{"error": {errorCode}, "error_description": {description}}
+	if request.State != "" {
+		params.Set("state", request.State)
+	}
+	redirectWithParams(w, r, request.RedirectUri, params)
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectUri string, params url.Values) {
+	target, err := url.Parse(redirectUri)
+	if err != nil {
+		renderAuthorizePage(w, http.StatusBadRequest, authorizePage{loginForm: loginForm{Error: services.ErrInvalidRedirectUri.Error()}})
+		return
+	}
+	query := target.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query[key] = values
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
@@ -0,0 +1,192 @@
+package controllers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/services"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+type PasskeyController struct {
+	db              *gorm.DB
+	webAuthnService *services.WebAuthnService
+	validate        *validator.Validate
+}
+
+func NewPasskeyController(db *gorm.DB) *PasskeyController {
+	return &PasskeyController{
+		db:              db,
+		webAuthnService: services.NewWebAuthnService(db),
+		validate:        validator.New(),
+	}
+}
+
+// BeginLogin returns the options of a passwordless login with a passkey
+func (controller *PasskeyController) BeginLogin(w http.ResponseWriter, r *http.Request) {
+	response, err := controller.webAuthnService.BeginLogin()
+	if err != nil {
+		passkeyError(w, err)
+		return
+	}
+	utils.JSONResponse(w, response)
+}
+
+// FinishLogin verifies the passkey assertion and logs the user in
+func (controller *PasskeyController) FinishLogin(w http.ResponseWriter, r *http.Request) {
+	request := models.PasskeyLoginRequest{}
+	if !controller.readRequest(w, r, &request) {
+		return
+	}
+
+	response, err := controller.webAuthnService.FinishLogin(request, r.RemoteAddr, r.UserAgent())
+	if err != nil {
+		passkeyError(w, err)
+		return
+	}
+	utils.JSONResponse(w, response)
+}
+
+// BeginTwoFactor returns the options of the second step of a login, for users whose two factor method is WEBAUTHN
+func (controller *PasskeyController) BeginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	request := models.PasskeyTwoFactorBeginRequest{}
+	if !controller.readRequest(w, r, &request) {
+		return
+	}
+
+	response, err := controller.webAuthnService.BeginTwoFactor(request.Token)
+	if err != nil {
+		passkeyError(w, err)
+		return
+	}
+	utils.JSONResponse(w, response)
+}
+
+// FinishTwoFactor verifies the passkey assertion of the second step and completes the login
+func (controller *PasskeyController) FinishTwoFactor(w http.ResponseWriter, r *http.Request) {
+	request := models.PasskeyTwoFactorRequest{}
+	if !controller.readRequest(w, r, &request) {
+		return
+	}
+
+	response, err := controller.webAuthnService.FinishTwoFactor(request, r.RemoteAddr, r.UserAgent())
+	if err != nil {
+		passkeyError(w, err)
+		return
+	}
+	utils.JSONResponse(w, response)
+}
+
+// List returns the passkeys of the logged in user
+func (controller *PasskeyController) List(w http.ResponseWriter, r *http.Request) {
+	userId := utils.GetUserIdFromHttpContext(r)
+	passkeys, err := controller.webAuthnService.List(uint(userId))
+	if err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.JSONResponse(w, passkeys)
+}
+
+// BeginRegistration returns the options to create a new passkey for the logged in user
+// The user has to enter their password again, and a current code when the method is TOTP
+func (controller *PasskeyController) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	request := models.PasskeyRegistrationBeginRequest{}
+	if !controller.readRequest(w, r, &request) {
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	response, err := controller.webAuthnService.BeginRegistration(uint(userId), request.Password, request.Code)
+	if err != nil {
+		passkeyError(w, err)
+		return
+	}
+	utils.JSONResponse(w, response)
+}
+
+// FinishRegistration verifies the new passkey and stores it
+func (controller *PasskeyController) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	request := models.PasskeyRegistrationRequest{}
+	if !controller.readRequest(w, r, &request) {
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	response, err := controller.webAuthnService.FinishRegistration(uint(userId), request, r.RemoteAddr, r.UserAgent())
+	if err != nil {
+		if errors.Is(err, services.ErrPasskey) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			passkeyError(w, err)
+		}
+		return
+	}
+	utils.JSONResponse(w, response)
+}
+
+// Rename changes the name of a passkey of the logged in user
+func (controller *PasskeyController) Rename(w http.ResponseWriter, r *http.Request) {
+	request := models.PasskeyRenameRequest{}
+	if !controller.readRequest(w, r, &request) {
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	if err := controller.webAuthnService.Rename(uint(userId), request.Id, request.Name); err != nil {
+		passkeyError(w, err)
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+// Delete removes a passkey of the logged in user
+func (controller *PasskeyController) Delete(w http.ResponseWriter, r *http.Request) {
+	request := models.PasskeyDeleteRequest{}
+	if !controller.readRequest(w, r, &request) {
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	if err := controller.webAuthnService.Delete(uint(userId), request.Id, r.RemoteAddr, r.UserAgent()); err != nil {
+		passkeyError(w, err)
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+// readRequest decodes and validates the JSON body, it reports a bad request and returns false when it is invalid
+func (controller *PasskeyController) readRequest(w http.ResponseWriter, r *http.Request, request interface{}) bool {
+	if err := utils.GetJsonInput(request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func passkeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrPasskeyDisabled), errors.Is(err, services.ErrPasskeyNotFound):
+		utils.JSONError(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, services.ErrPasskey), errors.Is(err, services.ErrPasskeyCloned), errors.Is(err, services.ErrInvalidToken),
+		errors.Is(err, services.ErrAccountNotActive), errors.Is(err, services.ErrUserNotFound):
+		utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, services.ErrInvalidPassword), errors.Is(err, services.ErrPassCode):
+		utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, services.ErrTooManyAttempts), errors.Is(err, services.ErrAccountLocked):
+		lockoutError(w, err)
+	case errors.Is(err, services.ErrLastPasskey):
+		utils.JSONError(w, err.Error(), http.StatusConflict)
+	default:
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+	}
+}
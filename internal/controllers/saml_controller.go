@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/bachdang2k/security-golang/internal/services"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// samlLoginCookie ties the response posted to the ACS to the browser that started the login
+const samlLoginCookie = "saml_login"
+
+type SAMLController struct {
+	db          *gorm.DB
+	samlService *services.SAMLService
+}
+
+func NewSAMLController(db *gorm.DB) *SAMLController {
+	return &SAMLController{
+		db:          db,
+		samlService: services.NewSAMLService(db),
+	}
+}
+
+// Providers lists the SAML identity providers users can log in with
+func (controller *SAMLController) Providers(w http.ResponseWriter, r *http.Request) {
+	utils.JSONResponse(w, map[string][]string{"providers": controller.samlService.Providers()})
+}
+
+// Metadata serves our service provider metadata for the identity provider given by the idp query parameter
+func (controller *SAMLController) Metadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := controller.samlService.Metadata(r.URL.Query().Get("idp"))
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownProvider) {
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(metadata)
+}
+
+// Login redirects the user to the identity provider given by the idp query parameter
+func (controller *SAMLController) Login(w http.ResponseWriter, r *http.Request) {
+	redirectUrl, binding, err := controller.samlService.StartLogin(r.Context(), r.URL.Query().Get("idp"))
+	if err != nil {
+		if errors.Is(err, services.ErrUnknownProvider) {
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		} else {
+			utils.JSONError(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     samlLoginCookie,
+		Value:    binding,
+		Path:     "/api/v1/auth/saml",
+		MaxAge:   int(controller.samlService.RequestTime().Seconds()),
+		HttpOnly: true,
+		// The identity provider posts the response cross site, which browsers only allow for SameSite=None; Secure cookies
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	http.Redirect(w, r, redirectUrl, http.StatusFound)
+}
+
+// ACS is the assertion consumer service the identity provider posts its response to
+func (controller *SAMLController) ACS(w http.ResponseWriter, r *http.Request) {
+	// The cookie is only needed once, whatever the outcome
+	http.SetCookie(w, &http.Cookie{Name: samlLoginCookie, Path: "/api/v1/auth/saml", MaxAge: -1, HttpOnly: true, Secure: true, SameSite: http.SameSiteNoneMode})
+
+	cookie, err := r.Cookie(samlLoginCookie)
+	if err != nil || r.ParseForm() != nil || r.PostForm.Get("SAMLResponse") == "" {
+		utils.JSONError(w, services.ErrFederatedLogin.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response, err := controller.samlService.CompleteLogin(r.Context(), r.URL.Query().Get("idp"), r.PostForm.Get("SAMLResponse"),
+		r.PostForm.Get("RelayState"), cookie.Value, utils.GetIpAddress(r), r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrFederatedLogin):
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrUnknownProvider):
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, services.ErrAccountNotLinked), errors.Is(err, services.ErrAccountNotActive):
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, response)
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"log"
 	"net/http"
 
@@ -12,18 +13,28 @@ import (
 )
 
 type UserController struct {
-	db          *gorm.DB
-	userService services.UserService
-	authService services.AuthService
-	validate    *validator.Validate
+	db                  *gorm.DB
+	userService         services.UserService
+	authService         services.AuthService
+	revocationService   services.RevocationService
+	webAuthnService     services.WebAuthnService
+	recoveryService     services.RecoveryCodeService
+	phoneService        services.PhoneVerificationService
+	verificationService services.VerificationService
+	validate            *validator.Validate
 }
 
 func NewUserController(db *gorm.DB) *UserController {
 	return &UserController{
-		db:          db,
-		userService: *services.NewUserService(db),
-		authService: *services.NewAuthService(db),
-		validate:    validator.New(),
+		db:                  db,
+		userService:         *services.NewUserService(db),
+		authService:         *services.NewAuthService(db),
+		revocationService:   *services.NewRevocationService(db),
+		webAuthnService:     *services.NewWebAuthnService(db),
+		recoveryService:     *services.NewRecoveryCodeService(db),
+		phoneService:        *services.NewPhoneVerificationService(db),
+		verificationService: *services.NewVerificationService(db),
+		validate:            validator.New(),
 	}
 }
 
@@ -49,8 +60,23 @@ func (controller *UserController) Update(w http.ResponseWriter, r *http.Request)
 
 	userId := utils.GetUserIdFromHttpContext(r)
 	response := models.SuccessResponse{}
+	// A new email address is only taken over once the link sent to it was opened
+	if request.EmailAddress != "" {
+		if err := controller.verificationService.ChangeEmailAddress(uint(userId), request.EmailAddress); err != nil {
+			if errors.Is(err, services.ErrEmailAddressExists) {
+				utils.JSONError(w, err.Error(), http.StatusConflict)
+			} else {
+				utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+	}
 	if err := controller.userService.Update(uint(userId), request); err != nil {
-		utils.JSONError(w, "Failed to Update ", http.StatusBadRequest)
+		if errors.Is(err, services.ErrInvalidPhoneNumber) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			utils.JSONError(w, "Failed to Update ", http.StatusBadRequest)
+		}
 		return
 	}
 	response.Success = true
@@ -65,36 +91,86 @@ func (controller *UserController) Logout(w http.ResponseWriter, r *http.Request)
 	}
 	response := models.SuccessResponse{}
 	userId := utils.GetUserIdFromHttpContext(r)
+
 	success, err := controller.userService.DeleteToken(uint(userId), request.RefreshToken)
 	if err != nil {
 		response.Success = false
-		utils.JSONError(w, "Failed to register", http.StatusBadRequest)
+		utils.JSONError(w, "Failed to logout", http.StatusBadRequest)
+		return
+	}
+
+	// The access token used for this request stops working right away, only once the refresh token is gone
+	// so a rejected logout leaves the session untouched
+	jti, expires := utils.GetTokenIdFromHttpContext(r)
+	if err := controller.revocationService.RevokeToken(jti, uint(userId), expires); err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
 		return
 	}
 	response.Success = success
 	utils.JSONResponse(w, response)
 }
 
+// EnableTwoFactor sets or changes the two factor method, the user has to enter their password again
+// and a current code when the method is TOTP
 func (controller *UserController) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
 	request := models.EnableTwoFactorRequest{}
 	if err := utils.GetJsonInput(&request, r); err != nil {
 		utils.JSONError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	userId := utils.GetUserIdFromHttpContext(r)
+	if err := controller.authService.Reauthenticate(uint(userId), request.Password, request.Code); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPassword), errors.Is(err, services.ErrPassCode):
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, services.ErrTooManyAttempts), errors.Is(err, services.ErrAccountLocked):
+			lockoutError(w, err)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
 	if request.Type == "TOTP" {
 		totpResponse, err := controller.userService.Enable2FactorTOTP(uint(userId))
 		if err != nil {
-			utils.JSONError(w, "Failed to Enable Two Factor (TOTP)", http.StatusBadRequest)
+			if errors.Is(err, services.ErrTOTPExists) {
+				utils.JSONError(w, err.Error(), http.StatusConflict)
+			} else {
+				utils.JSONError(w, "Failed to Enable Two Factor (TOTP)", http.StatusBadRequest)
+			}
 			return
 		}
 		utils.JSONResponse(w, totpResponse)
 		return
+	} else if request.Type == "WEBAUTHN" {
+		// Passkeys must be registered first, see /user/passkeys/register
+		if err := controller.webAuthnService.EnableTwoFactor(uint(userId)); err != nil {
+			if errors.Is(err, services.ErrPasskeyNotFound) {
+				utils.JSONError(w, "Register a passkey before enabling it as the second factor", http.StatusBadRequest)
+			} else if errors.Is(err, services.ErrTOTPActive) {
+				utils.JSONError(w, err.Error(), http.StatusConflict)
+			} else {
+				utils.JSONError(w, "Failed to Enable Two Factor (WEBAUTHN)", http.StatusBadRequest)
+			}
+			return
+		}
 	} else {
 		err := controller.userService.Enable2Factor(uint(userId), request.Type)
 		if err != nil {
-			utils.JSONError(w, "Failed to Enabled Two Factor EMAIL OR SMS ", http.StatusBadRequest)
+			if errors.Is(err, services.ErrPhoneNotVerified) || errors.Is(err, services.ErrSendMethod) {
+				utils.JSONError(w, err.Error(), http.StatusBadRequest)
+			} else if errors.Is(err, services.ErrTOTPActive) {
+				utils.JSONError(w, err.Error(), http.StatusConflict)
+			} else {
+				utils.JSONError(w, "Failed to Enabled Two Factor EMAIL OR SMS ", http.StatusBadRequest)
+			}
 			return
 		}
 	}
@@ -119,10 +195,180 @@ func (controller *UserController) VerifyPassCode(w http.ResponseWriter, r *http.
 
 	userId := utils.GetUserIdFromHttpContext(r)
 	response := models.SuccessResponse{}
-	if controller.authService.VerifyPassCode(uint(userId), request.Code) {
-		response.Success = true
-	} else {
-		response.Success = false
+	err = controller.authService.VerifyPassCode(uint(userId), request.Code)
+	if errors.Is(err, services.ErrTooManyAttempts) || errors.Is(err, services.ErrAccountLocked) {
+		lockoutError(w, err)
+		return
 	}
+	response.Success = err == nil
 	utils.JSONResponse(w, response)
 }
+
+// ConfirmTOTP makes the pending TOTP secret the second factor once the user entered a code from it
+func (controller *UserController) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	request := models.VerifyPassCodeRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	codes, err := controller.authService.ConfirmTOTP(uint(userId), request.Code, r.RemoteAddr, r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrPassCode):
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, services.ErrTOTPExists):
+			utils.JSONError(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, services.ErrTOTPEnrollment):
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrTooManyAttempts), errors.Is(err, services.ErrAccountLocked):
+			lockoutError(w, err)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.ConfirmTOTPResponse{Success: true, RecoveryCodes: codes})
+}
+
+// TOTPQRCode serves the pending TOTP secret as a QR code image
+func (controller *UserController) TOTPQRCode(w http.ResponseWriter, r *http.Request) {
+	userId := utils.GetUserIdFromHttpContext(r)
+	qrCode, err := controller.userService.TOTPQRCode(uint(userId))
+	if err != nil {
+		if errors.Is(err, services.ErrTOTPEnrollment) {
+			utils.JSONError(w, err.Error(), http.StatusNotFound)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	// The image carries the secret, it must not end up in a cache
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(qrCode)
+}
+
+// DisableTwoFactor turns two factor authentication off, the user has to enter their password again
+func (controller *UserController) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	request := models.DisableTwoFactorRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	err := controller.authService.DisableTwoFactor(uint(userId), request.Password, request.Code, r.RemoteAddr, r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPassword), errors.Is(err, services.ErrPassCode):
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, services.ErrTwoFactorDisabled):
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrTooManyAttempts), errors.Is(err, services.ErrAccountLocked):
+			lockoutError(w, err)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+// RecoveryCodes returns how many unused recovery codes the user has left
+func (controller *UserController) RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userId := utils.GetUserIdFromHttpContext(r)
+	remaining, err := controller.recoveryService.Remaining(uint(userId))
+	if err != nil {
+		utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		return
+	}
+	utils.JSONResponse(w, models.RecoveryCodesResponse{Remaining: remaining})
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user, the old ones stop working
+// The user has to enter their password again, and a current code when the method is TOTP
+func (controller *UserController) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	request := models.RegenerateRecoveryCodesRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	codes, err := controller.authService.RegenerateRecoveryCodes(uint(userId), request.Password, request.Code, r.RemoteAddr, r.UserAgent())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPassword), errors.Is(err, services.ErrPassCode):
+			utils.JSONError(w, err.Error(), http.StatusUnauthorized)
+		case errors.Is(err, services.ErrTwoFactorDisabled):
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrTooManyAttempts), errors.Is(err, services.ErrAccountLocked):
+			lockoutError(w, err)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.RegenerateRecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// StartPhoneVerification sends a code by SMS to the cell number of the user
+func (controller *UserController) StartPhoneVerification(w http.ResponseWriter, r *http.Request) {
+	userId := utils.GetUserIdFromHttpContext(r)
+	if err := controller.phoneService.Start(uint(userId)); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidPhoneNumber):
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, services.ErrSMSCooldown):
+			utils.JSONError(w, err.Error(), http.StatusTooManyRequests)
+		case errors.Is(err, services.ErrSMSUnavailable), errors.Is(err, services.ErrSendingSMS):
+			utils.JSONError(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
+
+// ConfirmPhoneVerification marks the cell number as verified with the code sent by SMS
+func (controller *UserController) ConfirmPhoneVerification(w http.ResponseWriter, r *http.Request) {
+	request := models.VerifyPassCodeRequest{}
+	if err := utils.GetJsonInput(&request, r); err != nil {
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := controller.validate.Struct(request); err != nil {
+		log.Println(err)
+		utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userId := utils.GetUserIdFromHttpContext(r)
+	if err := controller.phoneService.Confirm(uint(userId), request.Code); err != nil {
+		if errors.Is(err, services.ErrInvalidCode) {
+			utils.JSONError(w, err.Error(), http.StatusBadRequest)
+		} else {
+			utils.JSONError(w, services.ErrServer.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	utils.JSONResponse(w, models.SuccessResponse{Success: true})
+}
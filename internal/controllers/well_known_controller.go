@@ -0,0 +1,37 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/bachdang2k/security-golang/internal/services"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// WellKnownController serves the public discovery documents under /.well-known
+type WellKnownController struct {
+	oidcService services.OIDCService
+}
+
+func NewWellKnownController(db *gorm.DB) *WellKnownController {
+	return &WellKnownController{
+		oidcService: *services.NewOIDCService(db),
+	}
+}
+
+// JWKS Publishes the public keys other services use to verify our tokens
+func (controller *WellKnownController) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(services.JWKSCacheTTL.Seconds())))
+	utils.JSONResponse(w, utils.GetJSONWebKeySet())
+}
+
+// OpenIDConfiguration Publishes the OpenID Connect discovery document, it is not found while OIDC is disabled
+func (controller *WellKnownController) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+	if !controller.oidcService.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.JSONResponse(w, controller.oidcService.Configuration())
+}
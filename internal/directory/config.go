@@ -0,0 +1,47 @@
+package directory
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// LDAPConfigFromEnv reads the directory configuration, it returns false when LDAP_URL is not set
+// LDAP_GROUP_ROLES maps groups to roles as ROLE=group dn entries separated by semicolons
+func LDAPConfigFromEnv() (LDAPConfig, bool) {
+	config := LDAPConfig{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           os.Getenv("LDAP_START_TLS") == "true",
+		InsecureSkipVerify: os.Getenv("LDAP_INSECURE_SKIP_VERIFY") == "true",
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("LDAP_BASE_DN"),
+		UserFilter:         os.Getenv("LDAP_USER_FILTER"),
+		UsernameAttribute:  os.Getenv("LDAP_USERNAME_ATTRIBUTE"),
+		EmailAttribute:     os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		FirstNameAttribute: os.Getenv("LDAP_FIRST_NAME_ATTRIBUTE"),
+		LastNameAttribute:  os.Getenv("LDAP_LAST_NAME_ATTRIBUTE"),
+		GroupAttribute:     os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+		GroupRoles:         make(map[string]string),
+	}
+	if config.URL == "" {
+		return config, false
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("LDAP_TIMEOUT")); err == nil {
+		config.Timeout = timeout
+	}
+
+	for _, mapping := range strings.Split(os.Getenv("LDAP_GROUP_ROLES"), ";") {
+		if strings.TrimSpace(mapping) == "" {
+			continue
+		}
+		role, groupDN, ok := strings.Cut(mapping, "=")
+		if !ok || strings.TrimSpace(role) == "" || strings.TrimSpace(groupDN) == "" {
+			log.Println("Skipping invalid LDAP group mapping " + mapping)
+			continue
+		}
+		config.GroupRoles[strings.TrimSpace(groupDN)] = strings.ToUpper(strings.TrimSpace(role))
+	}
+	return config, true
+}
@@ -0,0 +1,199 @@
+package directory
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user was not found in the directory")
+	ErrInvalidCredentials = errors.New("the directory rejected the credentials")
+	ErrUnavailable        = errors.New("the directory is unavailable")
+)
+
+// LDAPConfig configures the LDAP or Active Directory server users are authenticated against
+type LDAPConfig struct {
+	// URL is the server address, ldap:// or ldaps://
+	URL      string
+	StartTLS bool
+	// InsecureSkipVerify disables certificate verification, it is meant for development only
+	InsecureSkipVerify bool
+	// BindDN and BindPassword are the service account used to search for users, an anonymous search is used when empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the user entry, %s is replaced with the escaped username
+	UserFilter string
+	// Attributes read from the user entry
+	UsernameAttribute  string
+	EmailAttribute     string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	GroupAttribute     string
+	// GroupRoles maps group DNs to the role names given to their members
+	GroupRoles map[string]string
+	Timeout    time.Duration
+}
+
+// Entry is the directory entry of an authenticated user
+type Entry struct {
+	DN        string
+	Username  string
+	Email     string
+	FirstName string
+	LastName  string
+	// Groups are the DNs of the groups the user is a member of
+	Groups []string
+}
+
+// LDAPDirectory authenticates users with a bind as the user's entry
+type LDAPDirectory struct {
+	config LDAPConfig
+}
+
+func NewLDAPDirectory(config LDAPConfig) *LDAPDirectory {
+	if config.UserFilter == "" {
+		config.UserFilter = "(&(objectClass=person)(uid=%s))"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "mail"
+	}
+	if config.FirstNameAttribute == "" {
+		config.FirstNameAttribute = "givenName"
+	}
+	if config.LastNameAttribute == "" {
+		config.LastNameAttribute = "sn"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &LDAPDirectory{config: config}
+}
+
+// Authenticate finds the user entry and binds as it with the password
+func (directory *LDAPDirectory) Authenticate(username, password string) (*Entry, error) {
+	// An empty password would be an unauthenticated bind, which most servers accept for any DN
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := directory.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if directory.config.BindDN != "" {
+		if err := conn.Bind(directory.config.BindDN, directory.config.BindPassword); err != nil {
+			return nil, fmt.Errorf("%w: service account bind: %v", ErrUnavailable, err)
+		}
+	}
+
+	entry, err := directory.findUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return entry, nil
+}
+
+func (directory *LDAPDirectory) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: directory.config.InsecureSkipVerify}
+	if host, _, err := net.SplitHostPort(strings.TrimPrefix(strings.TrimPrefix(directory.config.URL, "ldaps://"), "ldap://")); err == nil {
+		tlsConfig.ServerName = host
+	}
+
+	conn, err := ldap.DialURL(directory.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: directory.config.Timeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	conn.SetTimeout(directory.config.Timeout)
+
+	if directory.config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: start tls: %v", ErrUnavailable, err)
+		}
+	}
+	return conn, nil
+}
+
+// findUser searches for the single entry matching the username
+func (directory *LDAPDirectory) findUser(conn *ldap.Conn, username string) (*Entry, error) {
+	config := directory.config
+	request := ldap.NewSearchRequest(config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2,
+		int(config.Timeout.Seconds()), false, fmt.Sprintf(config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{config.UsernameAttribute, config.EmailAttribute, config.FirstNameAttribute, config.LastNameAttribute, config.GroupAttribute},
+		nil)
+	result, err := conn.Search(request)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("%w: search: %v", ErrUnavailable, err)
+	}
+	// More than one match means the filter is ambiguous, binding to either entry could log in the wrong user
+	if len(result.Entries) != 1 {
+		return nil, ErrUserNotFound
+	}
+
+	entry := result.Entries[0]
+	return &Entry{
+		DN:        entry.DN,
+		Username:  entry.GetAttributeValue(config.UsernameAttribute),
+		Email:     entry.GetAttributeValue(config.EmailAttribute),
+		FirstName: entry.GetAttributeValue(config.FirstNameAttribute),
+		LastName:  entry.GetAttributeValue(config.LastNameAttribute),
+		Groups:    entry.GetAttributeValues(config.GroupAttribute),
+	}, nil
+}
+
+// Roles returns the roles mapped to the groups of the entry, group DNs are compared case insensitively
+func (directory *LDAPDirectory) Roles(entry Entry) []string {
+	roles := []string{}
+	for _, group := range entry.Groups {
+		for groupDN, role := range directory.config.GroupRoles {
+			if strings.EqualFold(normalizeDN(group), normalizeDN(groupDN)) && !contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+// normalizeDN removes the spaces around the separators of a DN, cn=Admins, dc=example matches cn=admins,dc=example
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, part := range parts {
+		parts[i] = strings.TrimSpace(part)
+	}
+	return strings.Join(parts, ",")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
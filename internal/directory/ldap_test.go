@@ -0,0 +1,196 @@
+package directory
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeEntry is a user entry of the fake directory
+type fakeEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// fakeServer is an in-process LDAP server that answers simple binds and searches on its entries
+type fakeServer struct {
+	listener net.Listener
+	entries  []fakeEntry
+	// serviceDN and servicePassword are the only other credentials accepted
+	serviceDN       string
+	servicePassword string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{
+		listener:        listener,
+		serviceDN:       "cn=service,dc=example,dc=com",
+		servicePassword: "service-secret",
+		entries: []fakeEntry{{
+			dn:       "uid=alice,ou=people,dc=example,dc=com",
+			password: "alice-secret",
+			attrs: map[string][]string{
+				"uid": {"alice"}, "mail": {"alice@example.com"}, "givenName": {"Alice"}, "sn": {"Liddell"},
+				"memberOf": {"cn=Admins, ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+			},
+		}},
+	}
+	go server.serve()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (server *fakeServer) url() string {
+	return "ldap://" + server.listener.Addr().String()
+}
+
+func (server *fakeServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageId := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := request.Children[1].Value.(string)
+			password := request.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if server.checkPassword(dn, password) {
+				code = ldap.LDAPResultSuccess
+			}
+			server.write(conn, messageId, result(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			filter, _ := ldap.DecompileFilter(request.Children[6])
+			for _, entry := range server.entries {
+				// A presence filter matches every entry, like on a real server
+				if strings.Contains(filter, "(uid="+entry.attrs["uid"][0]+")") || strings.Contains(filter, "(uid=*)") {
+					server.write(conn, messageId, searchEntry(entry))
+				}
+			}
+			server.write(conn, messageId, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+		default:
+			return
+		}
+	}
+}
+
+func (server *fakeServer) checkPassword(dn, password string) bool {
+	if dn == server.serviceDN {
+		return password == server.servicePassword
+	}
+	for _, entry := range server.entries {
+		if entry.dn == dn {
+			return password == entry.password
+		}
+	}
+	return false
+}
+
+func (server *fakeServer) write(conn net.Conn, messageId int64, response *ber.Packet) {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageId, "MessageID"))
+	envelope.AppendChild(response)
+	_, _ = conn.Write(envelope.Bytes())
+}
+
+func result(tag ber.Tag, code uint16) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "resultCode"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	return packet
+}
+
+func searchEntry(entry fakeEntry) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "objectName"))
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attributes")
+	for name, values := range entry.attrs {
+		attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "attribute")
+		attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "vals")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "value"))
+		}
+		attribute.AppendChild(set)
+		attributes.AppendChild(attribute)
+	}
+	packet.AppendChild(attributes)
+	return packet
+}
+
+func (server *fakeServer) directory() *LDAPDirectory {
+	return NewLDAPDirectory(LDAPConfig{
+		URL:          server.url(),
+		BindDN:       server.serviceDN,
+		BindPassword: server.servicePassword,
+		BaseDN:       "dc=example,dc=com",
+		GroupRoles:   map[string]string{"cn=admins,ou=groups,dc=example,dc=com": "ADMIN"},
+	})
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	directory := newFakeServer(t).directory()
+
+	entry, err := directory.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatal("Expected alice to authenticate", err)
+	}
+	if entry.DN != "uid=alice,ou=people,dc=example,dc=com" || entry.Username != "alice" || entry.Email != "alice@example.com" ||
+		entry.FirstName != "Alice" || entry.LastName != "Liddell" || len(entry.Groups) != 2 {
+		t.Error("Unexpected entry", entry)
+	}
+	if roles := directory.Roles(*entry); len(roles) != 1 || roles[0] != "ADMIN" {
+		t.Error("Expected the admins group to map to ADMIN", roles)
+	}
+}
+
+func TestLDAPAuthenticateRejectsInvalidCredentials(t *testing.T) {
+	directory := newFakeServer(t).directory()
+
+	if _, err := directory.Authenticate("alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("Expected a wrong password to be rejected", err)
+	}
+	if _, err := directory.Authenticate("alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("Expected an empty password to be rejected without an unauthenticated bind", err)
+	}
+	if _, err := directory.Authenticate("bob", "secret"); !errors.Is(err, ErrUserNotFound) {
+		t.Error("Expected an unknown user not to be found", err)
+	}
+	// The filter metacharacters must be escaped, otherwise uid=* would match any entry
+	if _, err := directory.Authenticate("*", "alice-secret"); !errors.Is(err, ErrUserNotFound) {
+		t.Error("Expected the username to be escaped in the filter", err)
+	}
+}
+
+func TestLDAPAuthenticateServiceAccountFailure(t *testing.T) {
+	server := newFakeServer(t)
+	directory := server.directory()
+	server.servicePassword = "rotated"
+	if _, err := directory.Authenticate("alice", "alice-secret"); !errors.Is(err, ErrUnavailable) {
+		t.Error("Expected a failed service account bind to make the directory unavailable", err)
+	}
+}
@@ -0,0 +1,36 @@
+package federation
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// ProvidersFromEnv builds the providers listed in OIDC_PROVIDERS, a comma separated list of names
+// Each provider is configured with OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _SCOPES, _AUTO_PROVISION and _LINK_BY_EMAIL
+func ProvidersFromEnv(callbackUrl string) map[string]*Provider {
+	providers := make(map[string]*Provider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		config := ProviderConfig{
+			Name:          name,
+			Issuer:        os.Getenv(prefix + "ISSUER"),
+			ClientId:      os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret:  os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:        strings.Fields(os.Getenv(prefix + "SCOPES")),
+			RedirectUri:   callbackUrl,
+			AutoProvision: os.Getenv(prefix+"AUTO_PROVISION") == "true",
+			LinkByEmail:   os.Getenv(prefix+"LINK_BY_EMAIL") == "true",
+		}
+		if config.Issuer == "" || config.ClientId == "" {
+			log.Println("Skipping OIDC provider " + name + ", issuer and client id are required")
+			continue
+		}
+		providers[name] = NewProvider(config, nil)
+	}
+	return providers
+}
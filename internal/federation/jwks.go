@@ -0,0 +1,83 @@
+package federation
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// jsonWebKey holds the members of a public JSON Web Key (RFC 7517) needed for signature verification
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyId   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKeys returns the signing keys of the set by kid, encryption keys and unsupported key types are skipped
+func (keySet jsonWebKeySet) publicKeys() (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, ok := jwk.publicKey(); ok {
+			keys[jwk.KeyId] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrUnsupportedKeys
+	}
+	return keys, nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, bool) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, false
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, true
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, false
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return nil, false
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, false
+		}
+		return key, true
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, false
+		}
+		return ed25519.PublicKey(x), true
+	}
+	return nil, false
+}
@@ -0,0 +1,295 @@
+package federation
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrDiscovery       = errors.New("failed to load the provider configuration")
+	ErrTokenExchange   = errors.New("the provider rejected the authorization code")
+	ErrInvalidIDToken  = errors.New("the ID token from the provider is invalid")
+	ErrNonceMismatch   = errors.New("the ID token nonce does not match the login request")
+	ErrUnknownKey      = errors.New("the ID token is signed with an unknown key")
+	ErrMissingIDToken  = errors.New("the provider did not return an ID token")
+	ErrUnsupportedKeys = errors.New("the provider publishes no supported keys")
+)
+
+// idTokenAlgorithms are the ID token signatures accepted from providers, symmetric algorithms are never accepted
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "EdDSA"}
+
+// keyRefreshInterval limits how often an unknown kid triggers fetching the key set again
+const keyRefreshInterval = time.Minute
+
+// ProviderConfig configures an upstream OpenID Connect provider
+type ProviderConfig struct {
+	// Name identifies the provider in our URLs and in linked identities, for example google
+	Name         string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	// RedirectUri is our callback url registered at the provider
+	RedirectUri string
+	// AutoProvision creates a local user on the first login of an unknown identity
+	AutoProvision bool
+	// LinkByEmail links an unknown identity to the local user with the same verified email address
+	LinkByEmail bool
+}
+
+// Claims are the ID token claims used to find or create the local user
+type Claims struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	GivenName         string
+	FamilyName        string
+	PreferredUsername string
+}
+
+// Tokens are the tokens returned by the provider's token endpoint
+type Tokens struct {
+	AccessToken string
+	IdToken     string
+}
+
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// Provider is an OpenID Connect relying party for one upstream provider
+type Provider struct {
+	config     ProviderConfig
+	httpClient *http.Client
+
+	mu            sync.Mutex
+	discovery     *discoveryDocument
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+func NewProvider(config ProviderConfig, httpClient *http.Client) *Provider {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	return &Provider{config: config, httpClient: httpClient}
+}
+
+// Config returns the provider configuration
+func (provider *Provider) Config() ProviderConfig {
+	return provider.config
+}
+
+// AuthCodeURL returns the url the user is redirected to, the code challenge is the S256 PKCE challenge
+func (provider *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	discovery, err := provider.loadDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.config.ClientId},
+		"redirect_uri":          {provider.config.RedirectUri},
+		"scope":                 {strings.Join(provider.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Exchange redeems the authorization code at the provider's token endpoint
+func (provider *Provider) Exchange(ctx context.Context, code, codeVerifier string) (*Tokens, error) {
+	discovery, err := provider.loadDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.config.RedirectUri},
+		"code_verifier": {codeVerifier},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(provider.config.ClientId), url.QueryEscape(provider.config.ClientSecret))
+
+	response, err := provider.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d: %s", ErrTokenExchange, response.StatusCode, body)
+	}
+
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IdToken     string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	if tokens.IdToken == "" {
+		return nil, ErrMissingIDToken
+	}
+	return &Tokens{AccessToken: tokens.AccessToken, IdToken: tokens.IdToken}, nil
+}
+
+type idTokenClaims struct {
+	Nonce             string      `json:"nonce"`
+	Email             string      `json:"email"`
+	EmailVerified     interface{} `json:"email_verified"`
+	GivenName         string      `json:"given_name"`
+	FamilyName        string      `json:"family_name"`
+	PreferredUsername string      `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// VerifyIDToken checks the signature, issuer, audience, expiry and nonce of the ID token
+func (provider *Provider) VerifyIDToken(ctx context.Context, rawIdToken, nonce string) (*Claims, error) {
+	discovery, err := provider.loadDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(rawIdToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return provider.verificationKey(ctx, discovery.JwksUri, kid)
+	}, jwt.WithValidMethods(idTokenAlgorithms), jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(provider.config.ClientId), jwt.WithExpirationRequired(), jwt.WithLeeway(time.Minute))
+	if err != nil {
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, ErrUnknownKey
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if claims.Subject == "" {
+		return nil, ErrInvalidIDToken
+	}
+	if claims.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+
+	return &Claims{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		// Some providers send email_verified as a string
+		EmailVerified:     claims.EmailVerified == true || claims.EmailVerified == "true",
+		GivenName:         claims.GivenName,
+		FamilyName:        claims.FamilyName,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// loadDiscovery fetches the discovery document once, a failed fetch is retried on the next login
+func (provider *Provider) loadDiscovery(ctx context.Context) (*discoveryDocument, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+
+	var discovery discoveryDocument
+	if err := provider.getJSON(ctx, provider.config.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	// The issuer must match exactly, otherwise a compromised document could vouch for another issuer's tokens
+	if strings.TrimSuffix(discovery.Issuer, "/") != provider.config.Issuer {
+		return nil, fmt.Errorf("%w: issuer %q does not match %q", ErrDiscovery, discovery.Issuer, provider.config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return nil, fmt.Errorf("%w: missing endpoints", ErrDiscovery)
+	}
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+// verificationKey returns the provider key with the kid, the key set is fetched again when the kid is unknown
+func (provider *Provider) verificationKey(ctx context.Context, jwksUri, kid string) (crypto.PublicKey, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if key, ok := provider.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(provider.keysFetchedAt) < keyRefreshInterval && provider.keys != nil {
+		return nil, ErrUnknownKey
+	}
+
+	var keySet jsonWebKeySet
+	if err := provider.getJSON(ctx, jwksUri, &keySet); err != nil {
+		return nil, err
+	}
+	keys, err := keySet.publicKeys()
+	if err != nil {
+		return nil, err
+	}
+	provider.keys = keys
+	provider.keysFetchedAt = time.Now()
+
+	if key, ok := provider.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookupKey finds the key by kid, a token without kid is accepted when the provider has a single key
+func (provider *Provider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(provider.keys) == 1 {
+		for _, key := range provider.keys {
+			return key, true
+		}
+	}
+	key, ok := provider.keys[kid]
+	return key, ok
+}
+
+func (provider *Provider) getJSON(ctx context.Context, url string, result interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := provider.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", url, response.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(result)
+}
@@ -0,0 +1,207 @@
+package federation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeProvider is a minimal OpenID Connect provider that authenticates every user as subject
+type fakeProvider struct {
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	keyId    string
+	clientId string
+	secret   string
+	subject  string
+	email    string
+
+	// pending maps an issued code to the nonce and challenge of its authorization request
+	pending map[string][2]string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeProvider{key: key, keyId: "key-1", clientId: "our-client", secret: "our-secret",
+		subject: "external-123", email: "jane@example.com", pending: make(map[string][2]string)}
+
+	mux := http.NewServeMux()
+	discovery := func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fake.server.URL,
+			"authorization_endpoint": fake.server.URL + "/authorize",
+			"token_endpoint":         fake.server.URL + "/token",
+			"jwks_uri":               fake.server.URL + "/jwks",
+		})
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	// Served under another path so the issuer in the document does not match
+	mux.HandleFunc("/other/.well-known/openid-configuration", discovery)
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": fake.keyId, "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(fake.key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(fake.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != fake.clientId || query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		code := "code-" + query.Get("state")
+		fake.pending[code] = [2]string{query.Get("nonce"), query.Get("code_challenge")}
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code="+code+"&state="+query.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientId, secret, _ := r.BasicAuth()
+		request, ok := fake.pending[r.PostFormValue("code")]
+		if clientId != fake.clientId || secret != fake.secret || !ok ||
+			!utils.VerifyCodeChallenge(r.PostFormValue("code_verifier"), request[1]) {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(fake.pending, r.PostFormValue("code"))
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "upstream-access-token",
+			"token_type":   "Bearer",
+			"id_token":     fake.idToken(t, fake.clientId, request[0]),
+		})
+	})
+	fake.server = httptest.NewServer(mux)
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func (fake *fakeProvider) idToken(t *testing.T, audience, nonce string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            fake.server.URL,
+		"sub":            fake.subject,
+		"aud":            audience,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          fake.email,
+		"email_verified": true,
+		"given_name":     "Jane",
+	})
+	token.Header["kid"] = fake.keyId
+	signed, err := token.SignedString(fake.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (fake *fakeProvider) provider() *Provider {
+	return NewProvider(ProviderConfig{
+		Name:         "fake",
+		Issuer:       fake.server.URL,
+		ClientId:     fake.clientId,
+		ClientSecret: fake.secret,
+		RedirectUri:  "https://auth.example.com/callback",
+	}, fake.server.Client())
+}
+
+// login follows the redirect to the fake provider and returns the code sent to our callback
+func (fake *fakeProvider) login(t *testing.T, authCodeURL string) (string, string) {
+	client := fake.server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	response, err := client.Get(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	callback, err := url.Parse(response.Header.Get("Location"))
+	if err != nil || response.StatusCode != http.StatusFound {
+		t.Fatal("Expected a redirect to the callback", response.Status)
+	}
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func TestProviderLogin(t *testing.T) {
+	fake := newFakeProvider(t)
+	provider := fake.provider()
+	ctx := context.Background()
+
+	codeVerifier := utils.GenerateCodeVerifier()
+	authCodeURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", utils.CodeChallengeS256(codeVerifier))
+	if err != nil {
+		t.Fatal("Failed to build the authorization url", err)
+	}
+	code, state := fake.login(t, authCodeURL)
+	if state != "state-1" {
+		t.Fatal("Expected the state to be returned", state)
+	}
+
+	tokens, err := provider.Exchange(ctx, code, codeVerifier)
+	if err != nil {
+		t.Fatal("Failed to exchange the code", err)
+	}
+	claims, err := provider.VerifyIDToken(ctx, tokens.IdToken, "nonce-1")
+	if err != nil {
+		t.Fatal("Failed to verify the ID token", err)
+	}
+	if claims.Subject != fake.subject || claims.Email != fake.email || !claims.EmailVerified || claims.GivenName != "Jane" {
+		t.Error("Unexpected claims", claims)
+	}
+}
+
+func TestProviderRejectsWrongCodeVerifier(t *testing.T) {
+	fake := newFakeProvider(t)
+	provider := fake.provider()
+	ctx := context.Background()
+
+	authCodeURL, _ := provider.AuthCodeURL(ctx, "state-2", "nonce-2", utils.CodeChallengeS256(utils.GenerateCodeVerifier()))
+	code, _ := fake.login(t, authCodeURL)
+	if _, err := provider.Exchange(ctx, code, utils.GenerateCodeVerifier()); !errors.Is(err, ErrTokenExchange) {
+		t.Error("Expected the exchange to fail with another code verifier", err)
+	}
+}
+
+func TestProviderVerifyIDToken(t *testing.T) {
+	fake := newFakeProvider(t)
+	provider := fake.provider()
+	ctx := context.Background()
+
+	if _, err := provider.VerifyIDToken(ctx, fake.idToken(t, fake.clientId, "nonce-3"), "other-nonce"); !errors.Is(err, ErrNonceMismatch) {
+		t.Error("Expected a nonce mismatch", err)
+	}
+	if _, err := provider.VerifyIDToken(ctx, fake.idToken(t, "another-client", "nonce-3"), "nonce-3"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Error("Expected a token for another client to be rejected", err)
+	}
+
+	// A token signed by a key the provider does not publish
+	fake.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	fake.keyId = "key-2"
+	forged := fake.idToken(t, fake.clientId, "nonce-3")
+	fake.keyId = "key-1"
+	if _, err := provider.VerifyIDToken(ctx, forged, "nonce-3"); err == nil {
+		t.Error("Expected a token signed with an unpublished key to be rejected")
+	}
+}
+
+func TestProviderRejectsIssuerMismatch(t *testing.T) {
+	fake := newFakeProvider(t)
+	provider := NewProvider(ProviderConfig{Issuer: fake.server.URL + "/other", ClientId: fake.clientId}, fake.server.Client())
+	if _, err := provider.AuthCodeURL(context.Background(), "s", "n", "c"); !errors.Is(err, ErrDiscovery) {
+		t.Error("Expected discovery to fail for another issuer", err)
+	}
+}
@@ -5,10 +5,23 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/bachdang2k/security-golang/internal/utils"
 )
 
+// TokenRevocationChecker reports whether an access token was revoked before it expired
+type TokenRevocationChecker interface {
+	IsRevoked(jti string, userId int, clientId string, issuedAt time.Time) bool
+}
+
+var revocationChecker TokenRevocationChecker
+
+// SetTokenRevocationChecker registers the store JwtAuth consults for revoked tokens
+func SetTokenRevocationChecker(checker TokenRevocationChecker) {
+	revocationChecker = checker
+}
+
 func JwtAuth(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	const ErrorMessageInvalidToken string = "Invalid Token"
 	const ErrorMessageProvideValidToken string = "Failed provide a valid token in request header as Token"
@@ -23,6 +36,17 @@ func JwtAuth(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerF
 				log.Println(ErrorMessageInvalidToken)
 				return
 			}
+			if revocationChecker != nil {
+				jti, _ := claims["jti"].(string)
+				userId, _ := claims["userId"].(int)
+				clientId, _ := claims["clientId"].(string)
+				issuedAt, _ := claims["iat"].(time.Time)
+				if revocationChecker.IsRevoked(jti, userId, clientId, issuedAt) {
+					utils.JSONError(w, ErrorMessageInvalidToken, http.StatusForbidden)
+					log.Println("Revoked token used")
+					return
+				}
+			}
 			ctx := context.WithValue(r.Context(), "claims", claims)
 			handler(w, r.WithContext(ctx))
 		} else {
@@ -33,6 +57,67 @@ func JwtAuth(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerF
 	})
 }
 
+// RequireRole only allows requests whose token claims contain the role, must be used after JwtAuth
+func RequireRole(role string) func(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := r.Context().Value("claims").(map[string]interface{})
+			if !ok {
+				utils.JSONError(w, "Failed provide a valid token in request header as Token", http.StatusForbidden)
+				return
+			}
+			roles, _ := claims["roles"].([]string)
+			for _, userRole := range roles {
+				if userRole == role {
+					handler(w, r)
+					return
+				}
+			}
+			utils.JSONError(w, "Insufficient Permissions", http.StatusForbidden)
+			log.Println("Insufficient Permissions")
+		})
+	}
+}
+
+// RequireUser rejects tokens a client obtained for itself with the client credentials grant, must be used after JwtAuth
+func RequireUser(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if utils.GetSubjectTypeFromHttpContext(r) != utils.SubjectTypeUser {
+			utils.JSONError(w, "A user token is required", http.StatusForbidden)
+			log.Println("A user token is required")
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// RequireFirstParty rejects tokens issued to OAuth clients, whatever scope they were granted, must be used after JwtAuth
+// Those tokens are only meant for the OAuth endpoints, not for managing the account
+func RequireFirstParty(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if utils.GetClientIdFromHttpContext(r) != "" {
+			utils.JSONError(w, "A first party token is required", http.StatusForbidden)
+			log.Println("A first party token is required")
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// RequireClientCert only allows requests presenting a verified TLS client certificate, the certificate subject is stored in the context
+func RequireClientCert(handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+			utils.JSONError(w, "A valid client certificate is required", http.StatusForbidden)
+			log.Println("A valid client certificate is required")
+			return
+		}
+		subject := r.TLS.VerifiedChains[0][0].Subject.String()
+		ctx := context.WithValue(r.Context(), "clientSubject", subject)
+		handler(w, r.WithContext(ctx))
+	})
+}
+
 func Method(method string, handler func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != method {
@@ -0,0 +1,38 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bachdang2k/security-golang/internal/utils"
+)
+
+func TestRequireFirstParty(t *testing.T) {
+	handler := RequireFirstParty(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	var tests = []struct {
+		name   string
+		claims map[string]interface{}
+		want   int
+	}{
+		{"first party", map[string]interface{}{"userId": 1, "subjectType": utils.SubjectTypeUser, "clientId": ""}, http.StatusOK},
+		{"authorization code grant", map[string]interface{}{"userId": 1, "subjectType": utils.SubjectTypeUser, "clientId": "web-app", "scope": "openid"}, http.StatusForbidden},
+		{"device grant", map[string]interface{}{"userId": 1, "subjectType": utils.SubjectTypeUser, "clientId": "cli", "roles": []string{"ADMIN"}}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/user", nil)
+			request = request.WithContext(context.WithValue(request.Context(), "claims", tt.claims))
+			recorder := httptest.NewRecorder()
+			handler(recorder, request)
+			if recorder.Code != tt.want {
+				t.Errorf("Expected %d got %d", tt.want, recorder.Code)
+			}
+		})
+	}
+}
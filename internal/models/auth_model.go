@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 type AuthenticationRequest struct {
 	Username string `json:"username" validate:"required"`
 	Password string `json:"password" validate:"required"`
@@ -8,6 +10,8 @@ type AuthenticationRequest struct {
 type PasswordLessAuthRequest struct {
 	Username   string `json:"username"`
 	SendMethod string `json:"sendMethod"`
+	// Mode is CODE for a six digit code, the default, or LINK for a sign in link sent by email
+	Mode string `json:"mode"`
 }
 
 type PasswordLessAuthResponse struct {
@@ -28,6 +32,7 @@ type AuthenticationResponse struct {
 	Token            string   `json:"token"`
 	RefreshToken     string   `json:"refreshToken,omitempty"`
 	Roles            []string `json:"roles,omitempty"`
+	Scope            string   `json:"scope,omitempty"`
 	Expires          int      `json:"expiresIn,omitempty"`
 	TwoFactorEnabled bool     `json:"twoFactorEnabled"`
 	TwoFactorMethod  string   `json:"twoFactorMethod,omitempty"`
@@ -57,3 +62,13 @@ type VerifyChangePasswordRequest struct {
 	Code     string `json:"code" validate:"required"`
 	Password string `json:"password" validate:"required"`
 }
+
+type SigningKeyResponse struct {
+	KeyId      string     `json:"kid"`
+	Algorithm  string     `json:"alg"`
+	Current    bool       `json:"current"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ActiveAt   *time.Time `json:"activeAt,omitempty"`
+	RetiredAt  *time.Time `json:"retiredAt,omitempty"`
+	ExpireTime *time.Time `json:"expireTime,omitempty"`
+}
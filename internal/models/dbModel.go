@@ -10,12 +10,13 @@ type User struct {
 	gorm.Model
 	//ID               int      `json:"-"`
 	UUID             string  `json:"id"`
-	Username         string  `json:"username"`
-	EmailAddress     string  `json:"emailAddress"`
+	Username         string  `json:"username" gorm:"index:idx_users_username,unique,where:deleted_at IS NULL"`
+	Password         string  `json:"-"`
+	EmailAddress     string  `json:"emailAddress" gorm:"index:idx_users_email_address,unique,where:deleted_at IS NULL AND email_address <> ''"`
 	FirstName        string  `json:"firstName"`
 	LastName         string  `json:"lastName"`
 	CellNumber       string  `json:"cellNumber"`
-	Roles            []*Role `json:"roles" gorm:"many2many:user_languages;"`
+	Roles            []*Role `json:"roles" gorm:"many2many:user_roles;"`
 	Active           bool    `json:"active"`
 	TwoFactorEnabled bool    `json:"twoFactorEnabled"`
 	TwoFactorMethod  string  `json:"twoFactorMethod"`
@@ -23,6 +24,12 @@ type User struct {
 	TOTPURL          string  `json:"-"`
 	TOTPCreated      sql.NullTime
 	Metadata         JSONB `json:"metadata"`
+	// Source is where the credentials are checked: local, ldap or federated
+	Source string `json:"source" gorm:"size:20;default:local"`
+	// TOTPLastCounter is the time step of the last accepted TOTP code, a code is never accepted twice
+	TOTPLastCounter int64 `json:"-" gorm:"not null;default:0"`
+	// CellNumberVerified is set once the user entered a code sent to CellNumber, only then it receives codes
+	CellNumberVerified bool `json:"cellNumberVerified"`
 }
 
 type TwoFactorRequest struct {
@@ -38,17 +45,26 @@ type TwoFactorRequest struct {
 
 type UserRefreshToken struct {
 	gorm.Model
-	UserId     uint
-	Token      string
-	IpAddress  string
-	UserAgent  string
+	UserId uint
+	// Token is the SHA-256 of the refresh token handed to the client
+	Token string `gorm:"size:64;uniqueIndex"`
+	// FamilyId groups every token rotated from the same login
+	FamilyId  string `gorm:"size:64;index"`
+	IpAddress string
+	UserAgent string
+	// ClientId and Scope are set when the token was issued to an OAuth client
+	ClientId string `gorm:"size:64"`
+	Scope    string
+	// RotatedAt is set once the token was exchanged, presenting it again revokes the family
+	RotatedAt  sql.NullTime
 	ExpireTime sql.NullTime
 }
 
 type ResetPasswordRequest struct {
 	gorm.Model
-	UserId     uint
-	Code       string
+	UserId uint
+	// Code is the SHA-256 of the code that was emailed
+	Code       string `gorm:"size:64;index"`
 	ExpireTime sql.NullTime
 }
 
@@ -67,4 +83,204 @@ type OTPRequest struct {
 	Code       string `gorm:"size:6"`
 	ExpireTime sql.NullTime
 	SendMethod string `gorm:"size:20"`
+	// BindingHash is the SHA-256 of the cookie a magic link must be opened with, empty when links are not bound
+	BindingHash string `gorm:"size:64"`
+}
+
+type EmailVerification struct {
+	gorm.Model
+	UserId     uint
+	TokenHash  string `gorm:"size:64;uniqueIndex"`
+	ExpireTime sql.NullTime
+	// EmailAddress is the address the link was sent to, a changed address replaces the current one once verified
+	EmailAddress string
+}
+
+// JwtSigningKey is the metadata of a key in the signing key ring, the private key itself lives in KeyFile
+type JwtSigningKey struct {
+	gorm.Model
+	KeyId     string `gorm:"size:64;uniqueIndex"`
+	Algorithm string `gorm:"size:10"`
+	KeyFile   string
+	// ActiveAt is when the key starts signing, until then it is only published so verifiers can cache it
+	ActiveAt sql.NullTime
+	// RetiredAt is when the key stops signing, it keeps verifying until ExpireTime
+	RetiredAt  sql.NullTime
+	ExpireTime sql.NullTime
+}
+
+// SecurityEvent records security relevant activity on an account
+type SecurityEvent struct {
+	gorm.Model
+	UserId    uint   `gorm:"index"`
+	Type      string `gorm:"size:50"`
+	IpAddress string `gorm:"size:40"`
+	UserAgent string `gorm:"size:200"`
+	Details   JSONB
+}
+
+// RevokedToken blocks an access token by jti, or when Jti is empty every access token issued before CreatedAt
+// to the client if ClientId is set and to the user otherwise
+type RevokedToken struct {
+	gorm.Model
+	Jti      string `gorm:"size:64;index"`
+	UserId   uint   `gorm:"index"`
+	ClientId string `gorm:"size:64"`
+	// ExpireTime is when the revoked tokens would have expired anyway, the entry is useless afterwards
+	ExpireTime sql.NullTime
+}
+
+// OAuthClient is an application allowed to call the OAuth endpoints
+type OAuthClient struct {
+	gorm.Model
+	ClientId string `gorm:"size:64;uniqueIndex"`
+	// SecretHash is the bcrypt hash of the client secret, public clients have none and must use PKCE
+	SecretHash string
+	Name       string
+	Public     bool
+	Active     bool
+	// RedirectUris are the only redirect uris accepted by the authorization endpoint, matched exactly
+	RedirectUris StringList `gorm:"type:jsonb"`
+	// Scopes are the scopes the client may request
+	Scopes StringList `gorm:"type:jsonb"`
+	// GrantTypes are the grants the client may use, empty means authorization_code and refresh_token
+	GrantTypes StringList `gorm:"type:jsonb"`
+}
+
+// AuthorizationCode is a code issued by the authorization endpoint, it is exchanged once at the token endpoint
+type AuthorizationCode struct {
+	gorm.Model
+	// CodeHash is the SHA-256 of the code sent to the client
+	CodeHash    string `gorm:"size:64;uniqueIndex"`
+	ClientId    string `gorm:"size:64"`
+	UserId      uint
+	RedirectUri string
+	Scope       string
+	// CodeChallenge is the S256 PKCE challenge the code verifier must match
+	CodeChallenge string
+	Nonce         string
+	ExpireTime    sql.NullTime
+	// RedirectUriSent is set when the authorization request included the redirect uri (RFC 6749 section 4.1.3)
+	RedirectUriSent bool
+}
+
+// DeviceAuthorization is a pending device authorization grant (RFC 8628), it is approved on the verification page
+type DeviceAuthorization struct {
+	gorm.Model
+	// DeviceCodeHash is the SHA-256 of the device code the client polls with
+	DeviceCodeHash string `gorm:"size:64;uniqueIndex"`
+	// UserCode is stored normalized, without the dash
+	UserCode string `gorm:"size:16;uniqueIndex"`
+	ClientId string `gorm:"size:64"`
+	Scope    string
+	// Status is pending until the user approves or denies the request
+	Status string `gorm:"size:20"`
+	UserId uint
+	// Interval is the minimum number of seconds between polls, it grows when the client polls too fast
+	Interval     int
+	LastPolledAt sql.NullTime
+	ExpireTime   sql.NullTime
+}
+
+// FederatedIdentity links the subject of an external OpenID Connect provider to a local user
+type FederatedIdentity struct {
+	gorm.Model
+	UserId   uint   `gorm:"index"`
+	Provider string `gorm:"size:50;uniqueIndex:idx_federated_subject"`
+	Subject  string `gorm:"size:255;uniqueIndex:idx_federated_subject"`
+	Email    string
+}
+
+// FederatedLoginRequest is a login redirected to an external provider, it is completed once by the callback
+type FederatedLoginRequest struct {
+	gorm.Model
+	// StateHash is the SHA-256 of the state sent to the provider
+	StateHash string `gorm:"size:64;uniqueIndex"`
+	Provider  string `gorm:"size:50"`
+	// CodeVerifier is the PKCE verifier of the code challenge sent to the provider
+	CodeVerifier string
+	Nonce        string
+	// BindingHash is the SHA-256 of the cookie that ties the callback to the browser that started the login
+	BindingHash string `gorm:"size:64"`
+	ExpireTime  sql.NullTime
+}
+
+// SAMLLoginRequest is an authentication request sent to a SAML identity provider, it is completed once by the ACS
+type SAMLLoginRequest struct {
+	gorm.Model
+	// RequestId is the ID of the AuthnRequest, the response must be InResponseTo it
+	RequestId string `gorm:"size:100;uniqueIndex"`
+	Provider  string `gorm:"size:50"`
+	// RelayStateHash is the SHA-256 of the relay state the identity provider posts back
+	RelayStateHash string `gorm:"size:64;index"`
+	// BindingHash is the SHA-256 of the cookie that ties the response to the browser that started the login
+	BindingHash string `gorm:"size:64"`
+	ExpireTime  sql.NullTime
+}
+
+// WebAuthnCredential is a passkey registered by a user
+type WebAuthnCredential struct {
+	gorm.Model
+	UserId       uint   `gorm:"index"`
+	CredentialId []byte `gorm:"uniqueIndex"`
+	Name         string `gorm:"size:100"`
+	// PublicKey is the COSE encoded public key of the credential
+	PublicKey       []byte
+	AttestationType string `gorm:"size:50"`
+	AAGUID          []byte
+	// SignCount is the last signature counter, a counter that does not increase means the key was cloned
+	SignCount      uint32
+	Transports     StringList `gorm:"type:jsonb"`
+	BackupEligible bool
+	BackupState    bool
+	LastUsedAt     sql.NullTime
+}
+
+// WebAuthnSession is the challenge of a registration or login ceremony, it is completed once
+type WebAuthnSession struct {
+	gorm.Model
+	// SessionHash is the SHA-256 of the session id handed to the client
+	SessionHash string `gorm:"size:64;uniqueIndex"`
+	// Purpose is the ceremony the challenge was issued for: registration, login or two_factor
+	Purpose string `gorm:"size:20"`
+	// UserId is unset for a passwordless login, the user is only known from the credential
+	UserId uint
+	// Data is the JSON encoded session data of the ceremony
+	Data       string
+	ExpireTime sql.NullTime
+}
+
+// RecoveryCode is a single use code that replaces the second factor when the user lost it
+type RecoveryCode struct {
+	gorm.Model
+	UserId uint `gorm:"index"`
+	// CodeHash is the SHA-256 of the normalized code shown to the user
+	CodeHash string `gorm:"size:64;index"`
+	UsedAt   sql.NullTime
+}
+
+// PhoneVerification is a code sent by SMS to prove the user owns the cell number
+type PhoneVerification struct {
+	gorm.Model
+	UserId     uint   `gorm:"index"`
+	CellNumber string `gorm:"size:20"`
+	// CodeHash is the SHA-256 of the code that was sent
+	CodeHash string `gorm:"size:64"`
+	// Attempts counts the wrong codes entered, the verification is dropped after a few
+	Attempts   int
+	ExpireTime sql.NullTime
+}
+
+// FailedAttempt counts the wrong passwords or codes entered for a user or for a single code request
+type FailedAttempt struct {
+	gorm.Model
+	// AttemptKey is user:<id> for the user, request:<request id> for a code request or device:<ip> for user codes
+	// entered on the device page
+	AttemptKey    string `gorm:"size:150;uniqueIndex"`
+	UserId        uint   `gorm:"index"`
+	Failures      int
+	LastFailureAt sql.NullTime
+	// LockedUntil is set once too many attempts failed, nothing is accepted until then
+	LockedUntil sql.NullTime
+	ExpireTime  sql.NullTime
 }
@@ -0,0 +1,116 @@
+package models
+
+import "time"
+
+// IntrospectionResponse is the RFC 7662 token introspection response
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientId  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	Aud       string   `json:"aud,omitempty"`
+	Jti       string   `json:"jti,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// OAuthErrorResponse is the RFC 6749 error response
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type CreateClientRequest struct {
+	Name         string   `json:"name" validate:"required"`
+	RedirectUris []string `json:"redirectUris" validate:"dive,url"`
+	Scopes       []string `json:"scopes" validate:"dive,required,excludesall= "`
+	// GrantTypes defaults to authorization_code and refresh_token, service accounts use client_credentials
+	GrantTypes []string `json:"grantTypes" validate:"dive,oneof=authorization_code refresh_token client_credentials urn:ietf:params:oauth:grant-type:device_code"`
+	// Public clients such as single page apps cannot keep a secret and rely on PKCE alone
+	Public bool `json:"public"`
+}
+
+type AdminClientRequest struct {
+	ClientId string `json:"clientId" validate:"required"`
+}
+
+// ClientResponse describes a client, the secret is only returned when it is created
+type ClientResponse struct {
+	ClientId     string    `json:"clientId"`
+	ClientSecret string    `json:"clientSecret,omitempty"`
+	Name         string    `json:"name"`
+	Public       bool      `json:"public"`
+	Active       bool      `json:"active"`
+	RedirectUris []string  `json:"redirectUris"`
+	Scopes       []string  `json:"scopes"`
+	GrantTypes   []string  `json:"grantTypes"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// AuthorizationRequest holds the parameters of an authorization code request (RFC 6749 section 4.1.1 and RFC 7636)
+type AuthorizationRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectUri         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	// Nonce is copied into the ID token so the client can bind it to its session
+	Nonce string
+	// RedirectUriSent is set when the client sent the redirect uri, the token request must then send the same one
+	RedirectUriSent bool
+}
+
+// TokenResponse is the RFC 6749 access token response
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+}
+
+// DeviceAuthorizationResponse is the RFC 8628 device authorization response
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// UserInfoResponse holds the standard OpenID Connect claims released for the granted scopes
+type UserInfoResponse struct {
+	Sub               string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	Email             string `json:"email,omitempty"`
+	PhoneNumber       string `json:"phone_number,omitempty"`
+}
+
+// OpenIDConfiguration is the OpenID Connect discovery document
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksUri                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
@@ -15,6 +15,10 @@ func (j JSONB) Value() (driver.Value, error) {
 
 // scan Unmarshal
 func (j *JSONB) Scan(value interface{}) error {
+	if value == nil {
+		*j = nil
+		return nil
+	}
 	source, ok := value.([]byte)
 	if !ok {
 		return errors.New("Type assertion .([]byte) failed.")
@@ -26,6 +30,10 @@ func (j *JSONB) Scan(value interface{}) error {
 		return err
 	}
 
+	if i == nil {
+		*j = nil
+		return nil
+	}
 	*j, ok = i.(map[string]interface{})
 	if !ok {
 		return errors.New("Type assertion .(map[string]interface{}) failed.")
@@ -33,3 +41,37 @@ func (j *JSONB) Scan(value interface{}) error {
 	return nil
 
 }
+
+// StringList is a list of strings stored as a JSON array
+type StringList []string
+
+// Value marshals the list to JSON
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return json.Marshal([]string{})
+	}
+	return json.Marshal([]string(l))
+}
+
+// Scan unmarshals a JSON array
+func (l *StringList) Scan(value interface{}) error {
+	if value == nil {
+		*l = nil
+		return nil
+	}
+	source, ok := value.([]byte)
+	if !ok {
+		return errors.New("Type assertion .([]byte) failed.")
+	}
+	return json.Unmarshal(source, (*[]string)(l))
+}
+
+// Contains reports whether value is in the list
+func (l StringList) Contains(value string) bool {
+	for _, item := range l {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,31 +1,69 @@
 package models
 
 type EnableTwoFactorRequest struct {
-	Type string `json:"type"`
+	Type     string `json:"type"`
+	Password string `json:"password" validate:"required"`
+	// Code is a current TOTP code, required when TOTP is the two factor method
+	Code string `json:"code"`
 }
 
 type EnableTOTPResponse struct {
 	URL string `json:"url"`
 }
 
-type VerifyPassCodeRequest struct {
+type ConfirmTOTPResponse struct {
+	Success bool `json:"success"`
+	// RecoveryCodes are only shown once, they log in when the authenticator is lost
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" validate:"required"`
+	// Code is a current TOTP code, required when TOTP is the two factor method
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	Remaining int64 `json:"remaining"`
+}
+
+type RegenerateRecoveryCodesRequest struct {
+	Password string `json:"password" validate:"required"`
+	// Code is a current TOTP code, required when TOTP is the two factor method
 	Code string `json:"code"`
 }
 
+type RegenerateRecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type VerifyPassCodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
 type UserRegistrationRequest struct {
 	Username     string `json:"username" validate:"required"`
 	Password     string `json:"password" validate:"required"`
-	EmailAddress string `json:"emailAddress" validate:"required"`
+	EmailAddress string `json:"emailAddress" validate:"required,email"`
 	FirstName    string `json:"firstName" validate:"required"`
 	LastName     string `json:"lastName" validate:"required"`
 	CellNumber   string `json:"cellNumber" validate:"required"`
 }
 
+type ResendVerificationRequest struct {
+	EmailAddress string `json:"emailAddress" validate:"required,email"`
+}
+
 type UserUpdateRequest struct {
-	EmailAddress                 string `json:"emailAddress"`
+	// EmailAddress only replaces the current address once the link sent to it was opened
+	EmailAddress                 string `json:"emailAddress" validate:"omitempty,email"`
 	FirstName                    string `json:"firstName"`
 	LastName                     string `json:"lastName"`
 	CellNumber                   string `json:"cellNumber"`
 	AllowTwoFactorAuthentication bool   `json:"allowTwoFactorAuthentication"`
 	Metadata                     JSONB  `json:"metadata"`
 }
+
+type AdminUserRequest struct {
+	UserId string `json:"userId" validate:"required"`
+}
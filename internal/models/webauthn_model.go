@@ -0,0 +1,68 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+)
+
+// PasskeyRegistrationResponse are the options to pass to navigator.credentials.create
+type PasskeyRegistrationResponse struct {
+	SessionId string                       `json:"sessionId"`
+	Options   *protocol.CredentialCreation `json:"options"`
+}
+
+// PasskeyAssertionResponse are the options to pass to navigator.credentials.get
+type PasskeyAssertionResponse struct {
+	SessionId string                        `json:"sessionId"`
+	Options   *protocol.CredentialAssertion `json:"options"`
+}
+
+type PasskeyRegistrationBeginRequest struct {
+	Password string `json:"password" validate:"required"`
+	// Code is a current TOTP code, required when TOTP is the two factor method
+	Code string `json:"code"`
+}
+
+type PasskeyRegistrationRequest struct {
+	SessionId string `json:"sessionId" validate:"required"`
+	Name      string `json:"name" validate:"max=100"`
+	// Credential is the PublicKeyCredential returned by the browser, as JSON
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+type PasskeyLoginRequest struct {
+	SessionId  string          `json:"sessionId" validate:"required"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+type PasskeyTwoFactorBeginRequest struct {
+	// Token is the short lived token returned by the password step
+	Token string `json:"token" validate:"required"`
+}
+
+type PasskeyTwoFactorRequest struct {
+	Token      string          `json:"token" validate:"required"`
+	SessionId  string          `json:"sessionId" validate:"required"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
+}
+
+type PasskeyRenameRequest struct {
+	Id   string `json:"id" validate:"required"`
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+type PasskeyDeleteRequest struct {
+	Id string `json:"id" validate:"required"`
+}
+
+type PasskeyResponse struct {
+	// Id is the base64url encoded credential id
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Transports []string   `json:"transports"`
+	Synced     bool       `json:"synced"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
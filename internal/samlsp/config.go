@@ -0,0 +1,85 @@
+package samlsp
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"strings"
+)
+
+// SPConfigFromEnv loads our key pair from SAML_SP_KEY_FILE and SAML_SP_CERT_FILE, it returns false when they are not set
+func SPConfigFromEnv(baseURL string) (SPConfig, bool, error) {
+	keyFile, certFile := os.Getenv("SAML_SP_KEY_FILE"), os.Getenv("SAML_SP_CERT_FILE")
+	if keyFile == "" || certFile == "" {
+		return SPConfig{}, false, nil
+	}
+	keyPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return SPConfig{}, false, err
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return SPConfig{}, false, errors.New("the SAML service provider key must be an RSA key")
+	}
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return SPConfig{}, false, err
+	}
+	return SPConfig{BaseURL: baseURL, Key: key, Certificate: certificate}, true, nil
+}
+
+// ProvidersFromEnv builds the identity providers listed in SAML_PROVIDERS, a comma separated list of names
+// Each provider is configured with SAML_<NAME>_METADATA_URL or _METADATA_FILE, the _EMAIL_ATTRIBUTE, _FIRST_NAME_ATTRIBUTE,
+// _LAST_NAME_ATTRIBUTE, _USERNAME_ATTRIBUTE and _GROUP_ATTRIBUTE names, _GROUP_ROLES as ROLE=group entries separated
+// by semicolons, _AUTO_PROVISION and _LINK_BY_EMAIL
+func ProvidersFromEnv(sp SPConfig) map[string]*Provider {
+	providers := make(map[string]*Provider)
+	for _, name := range strings.Split(os.Getenv("SAML_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "SAML_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		config := IdPConfig{
+			Name:               name,
+			MetadataURL:        os.Getenv(prefix + "METADATA_URL"),
+			EmailAttribute:     os.Getenv(prefix + "EMAIL_ATTRIBUTE"),
+			FirstNameAttribute: os.Getenv(prefix + "FIRST_NAME_ATTRIBUTE"),
+			LastNameAttribute:  os.Getenv(prefix + "LAST_NAME_ATTRIBUTE"),
+			UsernameAttribute:  os.Getenv(prefix + "USERNAME_ATTRIBUTE"),
+			GroupAttribute:     os.Getenv(prefix + "GROUP_ATTRIBUTE"),
+			GroupRoles:         make(map[string]string),
+			AutoProvision:      os.Getenv(prefix+"AUTO_PROVISION") == "true",
+			LinkByEmail:        os.Getenv(prefix+"LINK_BY_EMAIL") == "true",
+		}
+		if metadataFile := os.Getenv(prefix + "METADATA_FILE"); metadataFile != "" {
+			metadataXML, err := os.ReadFile(metadataFile)
+			if err != nil {
+				log.Println("Skipping SAML provider "+name+", failed to read its metadata ", err)
+				continue
+			}
+			config.MetadataXML = metadataXML
+		}
+		if config.MetadataURL == "" && len(config.MetadataXML) == 0 {
+			log.Println("Skipping SAML provider " + name + ", a metadata url or file is required")
+			continue
+		}
+
+		for _, mapping := range strings.Split(os.Getenv(prefix+"GROUP_ROLES"), ";") {
+			if strings.TrimSpace(mapping) == "" {
+				continue
+			}
+			role, group, ok := strings.Cut(mapping, "=")
+			if !ok || strings.TrimSpace(role) == "" || strings.TrimSpace(group) == "" {
+				log.Println("Skipping invalid SAML group mapping " + mapping)
+				continue
+			}
+			config.GroupRoles[strings.TrimSpace(group)] = strings.ToUpper(strings.TrimSpace(role))
+		}
+		providers[name] = NewProvider(sp, config, nil)
+	}
+	return providers
+}
@@ -0,0 +1,295 @@
+package samlsp
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var (
+	ErrMetadata        = errors.New("failed to load the identity provider metadata")
+	ErrInvalidResponse = errors.New("the SAML response is invalid")
+	ErrMissingNameID   = errors.New("the SAML assertion has no subject")
+)
+
+// SPConfig is our side of the SAML trust, shared by every identity provider
+type SPConfig struct {
+	// BaseURL is where the SAML endpoints are served, for example https://auth.example.com/api/v1/auth/saml
+	BaseURL string
+	// Key signs authentication requests and decrypts encrypted assertions, Certificate is published in our metadata
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// IdPConfig configures an identity provider
+type IdPConfig struct {
+	// Name identifies the provider in our URLs and in linked identities, for example okta
+	Name string
+	// MetadataURL is fetched on first use unless the MetadataXML is given
+	MetadataURL string
+	MetadataXML []byte
+	// Attributes read from the assertion, matched against the attribute Name or FriendlyName
+	EmailAttribute     string
+	FirstNameAttribute string
+	LastNameAttribute  string
+	UsernameAttribute  string
+	GroupAttribute     string
+	// GroupRoles maps group names to the role names given to their members
+	GroupRoles map[string]string
+	// AutoProvision creates a local user on the first login of an unknown identity
+	AutoProvision bool
+	// LinkByEmail links an unknown identity to the local user with the same email address
+	LinkByEmail bool
+}
+
+// Identity is the subject and attributes of a validated assertion
+type Identity struct {
+	NameID    string
+	Email     string
+	FirstName string
+	LastName  string
+	Username  string
+	Groups    []string
+}
+
+// Provider is a SAML 2.0 service provider for one identity provider
+type Provider struct {
+	sp         SPConfig
+	config     IdPConfig
+	httpClient *http.Client
+
+	mu              sync.Mutex
+	serviceProvider *saml.ServiceProvider
+}
+
+func NewProvider(sp SPConfig, config IdPConfig, httpClient *http.Client) *Provider {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	sp.BaseURL = strings.TrimSuffix(sp.BaseURL, "/")
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "email"
+	}
+	if config.FirstNameAttribute == "" {
+		config.FirstNameAttribute = "givenName"
+	}
+	if config.LastNameAttribute == "" {
+		config.LastNameAttribute = "sn"
+	}
+	if config.UsernameAttribute == "" {
+		config.UsernameAttribute = "uid"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "groups"
+	}
+	return &Provider{sp: sp, config: config, httpClient: httpClient}
+}
+
+// Config returns the identity provider configuration
+func (provider *Provider) Config() IdPConfig {
+	return provider.config
+}
+
+// EntityId is our entity id towards this identity provider, it is also the url of our metadata
+func (provider *Provider) EntityId() string {
+	return provider.sp.BaseURL + "/metadata?idp=" + url.QueryEscape(provider.config.Name)
+}
+
+// AcsURL is the assertion consumer service the identity provider posts its response to
+func (provider *Provider) AcsURL() string {
+	return provider.sp.BaseURL + "/acs?idp=" + url.QueryEscape(provider.config.Name)
+}
+
+// Metadata returns our service provider metadata to register at the identity provider
+func (provider *Provider) Metadata() ([]byte, error) {
+	serviceProvider := provider.newServiceProvider(nil)
+	return xml.MarshalIndent(serviceProvider.Metadata(), "", "  ")
+}
+
+// AuthnRequestURL returns the url that sends the user to the identity provider with the redirect binding
+// The returned request id must be presented when the response is parsed
+func (provider *Provider) AuthnRequestURL(ctx context.Context, relayState string) (string, string, error) {
+	serviceProvider, err := provider.loadServiceProvider(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	ssoLocation := serviceProvider.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if ssoLocation == "" {
+		return "", "", fmt.Errorf("%w: no redirect binding single sign on service", ErrMetadata)
+	}
+	request, err := serviceProvider.MakeAuthenticationRequest(ssoLocation, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+	redirectUrl, err := request.Redirect(url.QueryEscape(relayState), serviceProvider)
+	if err != nil {
+		return "", "", err
+	}
+	return redirectUrl.String(), request.ID, nil
+}
+
+// ParseResponse validates the base64 encoded response of the POST binding
+// The response or its assertion must be signed by the identity provider and answer one of the request ids
+func (provider *Provider) ParseResponse(ctx context.Context, samlResponse string, requestIds []string) (*Identity, error) {
+	serviceProvider, err := provider.loadServiceProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+
+	assertion, err := serviceProvider.ParseXMLResponse(decoded, requestIds)
+	if err != nil {
+		// The public message of the library is deliberately vague, the private one says what failed
+		var invalidResponse *saml.InvalidResponseError
+		if errors.As(err, &invalidResponse) {
+			err = invalidResponse.PrivateErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, ErrMissingNameID
+	}
+
+	identity := &Identity{NameID: assertion.Subject.NameID.Value}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			switch {
+			case provider.isAttribute(attribute, provider.config.EmailAttribute):
+				identity.Email = firstValue(attribute)
+			case provider.isAttribute(attribute, provider.config.FirstNameAttribute):
+				identity.FirstName = firstValue(attribute)
+			case provider.isAttribute(attribute, provider.config.LastNameAttribute):
+				identity.LastName = firstValue(attribute)
+			case provider.isAttribute(attribute, provider.config.UsernameAttribute):
+				identity.Username = firstValue(attribute)
+			case provider.isAttribute(attribute, provider.config.GroupAttribute):
+				for _, value := range attribute.Values {
+					identity.Groups = append(identity.Groups, value.Value)
+				}
+			}
+		}
+	}
+	return identity, nil
+}
+
+// Roles returns the roles mapped to the groups of the identity, group names are compared case insensitively
+func (provider *Provider) Roles(identity Identity) []string {
+	roles := []string{}
+	for _, group := range identity.Groups {
+		for groupName, role := range provider.config.GroupRoles {
+			if strings.EqualFold(group, groupName) && !contains(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	return roles
+}
+
+func (provider *Provider) isAttribute(attribute saml.Attribute, name string) bool {
+	return strings.EqualFold(attribute.Name, name) || strings.EqualFold(attribute.FriendlyName, name)
+}
+
+func firstValue(attribute saml.Attribute) string {
+	if len(attribute.Values) == 0 {
+		return ""
+	}
+	return attribute.Values[0].Value
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (provider *Provider) newServiceProvider(idpMetadata *saml.EntityDescriptor) *saml.ServiceProvider {
+	entityId, _ := url.Parse(provider.EntityId())
+	acsURL, _ := url.Parse(provider.AcsURL())
+	return &saml.ServiceProvider{
+		EntityID:          entityId.String(),
+		Key:               provider.sp.Key,
+		Certificate:       provider.sp.Certificate,
+		MetadataURL:       *entityId,
+		AcsURL:            *acsURL,
+		IDPMetadata:       idpMetadata,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+		SignatureMethod:   dsig.RSASHA256SignatureMethod,
+	}
+}
+
+// loadServiceProvider loads the identity provider metadata once, a failed load is retried on the next login
+func (provider *Provider) loadServiceProvider(ctx context.Context) (*saml.ServiceProvider, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if provider.serviceProvider != nil {
+		return provider.serviceProvider, nil
+	}
+
+	metadataXML := provider.config.MetadataXML
+	if len(metadataXML) == 0 {
+		var err error
+		if metadataXML, err = provider.fetchMetadata(ctx); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrMetadata, err)
+		}
+	}
+	idpMetadata, err := parseMetadata(metadataXML)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMetadata, err)
+	}
+	provider.serviceProvider = provider.newServiceProvider(idpMetadata)
+	return provider.serviceProvider, nil
+}
+
+func (provider *Provider) fetchMetadata(ctx context.Context) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, provider.config.MetadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := provider.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned status %d", provider.config.MetadataURL, response.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, 1<<20))
+}
+
+// parseMetadata accepts an EntityDescriptor or an EntitiesDescriptor holding one identity provider
+func parseMetadata(metadataXML []byte) (*saml.EntityDescriptor, error) {
+	var entity saml.EntityDescriptor
+	if err := xml.Unmarshal(metadataXML, &entity); err == nil && len(entity.IDPSSODescriptors) > 0 {
+		return &entity, nil
+	}
+
+	var entities saml.EntitiesDescriptor
+	if err := xml.Unmarshal(metadataXML, &entities); err != nil {
+		return nil, err
+	}
+	for i := range entities.EntityDescriptors {
+		if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+			return &entities.EntityDescriptors[i], nil
+		}
+	}
+	return nil, errors.New("no identity provider descriptor")
+}
@@ -0,0 +1,203 @@
+package samlsp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/xml"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+func newKeyPair(t *testing.T, commonName string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, certificate
+}
+
+// testIdP is a local identity provider that signs an assertion for every authentication request of our service provider
+type testIdP struct {
+	idp        *saml.IdentityProvider
+	spMetadata *saml.EntityDescriptor
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, certificate := newKeyPair(t, "idp.example.com")
+	metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+	ssoURL, _ := url.Parse("https://idp.example.com/sso")
+	test := &testIdP{}
+	test.idp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             certificate,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: test,
+	}
+	return test
+}
+
+func (test *testIdP) GetServiceProvider(_ *http.Request, serviceProviderId string) (*saml.EntityDescriptor, error) {
+	if test.spMetadata == nil || test.spMetadata.EntityID != serviceProviderId {
+		return nil, os.ErrNotExist
+	}
+	return test.spMetadata, nil
+}
+
+func (test *testIdP) metadataXML(t *testing.T) []byte {
+	metadataXML, err := xml.Marshal(test.idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadataXML
+}
+
+// respond follows the redirect to the identity provider and returns the form it posts back to our ACS
+func (test *testIdP) respond(t *testing.T, authnRequestURL string, session *saml.Session) saml.IdpAuthnRequestForm {
+	request, err := saml.NewIdpAuthnRequest(test.idp, httptest.NewRequest(http.MethodGet, authnRequestURL, nil))
+	if err != nil {
+		t.Fatal("Failed to read the authentication request", err)
+	}
+	if err := request.Validate(); err != nil {
+		t.Fatal("The identity provider rejected the authentication request", err)
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(request, session); err != nil {
+		t.Fatal(err)
+	}
+	form, err := request.PostBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form
+}
+
+func newTestProvider(t *testing.T, test *testIdP) *Provider {
+	key, certificate := newKeyPair(t, "auth.example.com")
+	provider := NewProvider(SPConfig{BaseURL: "https://auth.example.com/api/v1/auth/saml", Key: key, Certificate: certificate},
+		IdPConfig{
+			Name:           "corp",
+			MetadataXML:    test.metadataXML(t),
+			GroupAttribute: "eduPersonAffiliation",
+			GroupRoles:     map[string]string{"admins": "ADMIN"},
+		}, nil)
+
+	var spMetadata saml.EntityDescriptor
+	metadataXML, err := provider.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal(metadataXML, &spMetadata); err != nil {
+		t.Fatal(err)
+	}
+	test.spMetadata = &spMetadata
+	return provider
+}
+
+func testSession() *saml.Session {
+	return &saml.Session{
+		NameID:        "jane-42",
+		UserName:      "jane",
+		UserGivenName: "Jane",
+		UserSurname:   "Doe",
+		Groups:        []string{"Admins", "staff"},
+		CustomAttributes: []saml.Attribute{{
+			Name: "email", Values: []saml.AttributeValue{{Type: "xs:string", Value: "jane@example.com"}},
+		}},
+	}
+}
+
+func TestProviderLogin(t *testing.T) {
+	test := newTestIdP(t)
+	provider := newTestProvider(t, test)
+	ctx := context.Background()
+
+	authnRequestURL, requestId, err := provider.AuthnRequestURL(ctx, "relay+state/1")
+	if err != nil {
+		t.Fatal("Failed to create the authentication request", err)
+	}
+	if !strings.HasPrefix(authnRequestURL, "https://idp.example.com/sso?") || requestId == "" {
+		t.Fatal("Unexpected authentication request", authnRequestURL, requestId)
+	}
+
+	form := test.respond(t, authnRequestURL, testSession())
+	if form.URL != provider.AcsURL() || form.RelayState != "relay+state/1" {
+		t.Error("Expected the response to be posted to our ACS with the relay state", form.URL, form.RelayState)
+	}
+
+	identity, err := provider.ParseResponse(ctx, form.SAMLResponse, []string{requestId})
+	if err != nil {
+		t.Fatal("Failed to validate the response", err)
+	}
+	if identity.NameID != "jane-42" || identity.Username != "jane" || identity.Email != "jane@example.com" ||
+		identity.FirstName != "Jane" || identity.LastName != "Doe" || len(identity.Groups) != 2 {
+		t.Error("Unexpected identity", identity)
+	}
+	if roles := provider.Roles(*identity); len(roles) != 1 || roles[0] != "ADMIN" {
+		t.Error("Expected the admins group to map to ADMIN", roles)
+	}
+}
+
+func TestProviderRejectsUnsolicitedResponse(t *testing.T) {
+	test := newTestIdP(t)
+	provider := newTestProvider(t, test)
+	ctx := context.Background()
+
+	authnRequestURL, _, _ := provider.AuthnRequestURL(ctx, "")
+	form := test.respond(t, authnRequestURL, testSession())
+	if _, err := provider.ParseResponse(ctx, form.SAMLResponse, []string{"id-another-request"}); !errors.Is(err, ErrInvalidResponse) {
+		t.Error("Expected a response to another request to be rejected", err)
+	}
+}
+
+func TestProviderRejectsUntrustedSignature(t *testing.T) {
+	test := newTestIdP(t)
+	provider := newTestProvider(t, test)
+	ctx := context.Background()
+
+	// Same identity provider urls, but signed with a key that is not in the trusted metadata
+	test.idp.Key, test.idp.Certificate = newKeyPair(t, "idp.example.com")
+	authnRequestURL, requestId, _ := provider.AuthnRequestURL(ctx, "")
+	form := test.respond(t, authnRequestURL, testSession())
+	if _, err := provider.ParseResponse(ctx, form.SAMLResponse, []string{requestId}); !errors.Is(err, ErrInvalidResponse) {
+		t.Error("Expected a response signed with an untrusted key to be rejected", err)
+	}
+}
+
+func TestProviderMetadata(t *testing.T) {
+	test := newTestIdP(t)
+	provider := newTestProvider(t, test)
+
+	if test.spMetadata.EntityID != "https://auth.example.com/api/v1/auth/saml/metadata?idp=corp" {
+		t.Error("Unexpected entity id", test.spMetadata.EntityID)
+	}
+	acs := test.spMetadata.SPSSODescriptors[0].AssertionConsumerServices
+	if len(acs) == 0 || acs[0].Location != provider.AcsURL() || acs[0].Binding != saml.HTTPPostBinding {
+		t.Error("Expected the POST binding ACS in the metadata", acs)
+	}
+}
@@ -1,111 +1,183 @@
 package services
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/bachdang2k/security-golang/internal/models"
 	"github.com/bachdang2k/security-golang/internal/utils"
-	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 type AuthService struct {
-	db           *gorm.DB
-	userService  *UserService
-	emailService *EmailService
-	tokenTime    time.Duration
+	db                   *gorm.DB
+	userService          *UserService
+	emailService         *EmailService
+	smsService           *SMSService
+	securityEventService *SecurityEventService
+	revocationService    *RevocationService
+	credentialVerifier   CredentialVerifier
+	recoveryCodeService  *RecoveryCodeService
+	lockoutService       *LockoutService
+	tokenTime            time.Duration
+	refreshTime          time.Duration
+	resetTime            time.Duration
+	// totpSkew is how many 30 second steps a TOTP code may be early or late
+	totpSkew uint
+	// totpEnrollmentTime is how long a new TOTP secret waits for its first code
+	totpEnrollmentTime time.Duration
 }
 
 func NewAuthService(db *gorm.DB) *AuthService {
 	tokenTime, _ := time.ParseDuration(os.Getenv("TOKEN_EXPIRY_TIME"))
+	refreshTime, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_EXPIRY_TIME"))
+	if err != nil {
+		refreshTime = 30 * 24 * time.Hour
+	}
+	resetTime, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_EXPIRY_TIME"))
+	if err != nil {
+		resetTime = 15 * time.Minute
+	}
+	totpSkew, err := strconv.ParseUint(os.Getenv("TOTP_SKEW"), 10, 8)
+	if err != nil {
+		totpSkew = 1
+	}
+	totpEnrollmentTime, err := time.ParseDuration(os.Getenv("TOTP_ENROLLMENT_EXPIRY_TIME"))
+	if err != nil {
+		totpEnrollmentTime = 15 * time.Minute
+	}
 	return &AuthService{
-		db:           db,
-		userService:  NewUserService(db),
-		emailService: NewEmailService(true),
-		tokenTime:    tokenTime,
+		db:                   db,
+		userService:          NewUserService(db),
+		emailService:         NewEmailService(true),
+		smsService:           NewSMSService(),
+		securityEventService: NewSecurityEventService(db),
+		revocationService:    NewRevocationService(db),
+		credentialVerifier:   NewCredentialVerifier(db),
+		recoveryCodeService:  NewRecoveryCodeService(db),
+		lockoutService:       NewLockoutService(db),
+		tokenTime:            tokenTime,
+		refreshTime:          refreshTime,
+		resetTime:            resetTime,
+		totpSkew:             uint(totpSkew),
+		totpEnrollmentTime:   totpEnrollmentTime,
 	}
 }
 
 // LoginByUsernamePassword Login function to authenticate user by username and password
 func (service *AuthService) LoginByUsernamePassword(username, password, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
-	var (
-		userId       int
-		passwordHash string
-		err          error
-	)
-
-	row := service.db.Model(&models.User{}).Select("id", "password").Where("username = ?", username).Row()
-	//row := authSrv.db.QueryRow("SELECT id, password FROM users WHERE username = $1  LIMIT 1 ", username)
-	row.Scan(&userId, &passwordHash)
-	if userId == 0 {
-		return nil, ErrInvalidUsername
+	userDetails, err := service.VerifyCredentials(username, password)
+	if err != nil {
+		return nil, err
 	}
-	userDetails := service.userService.Get(userId)
-	if !userDetails.Active {
-		return nil, ErrAccountNotActive
+	return service.generateAuthResponse(*userDetails, ipAddress, userAgent)
+}
+
+// VerifyCredentials checks the username and password of an active account without starting a session
+// The credentials are checked by the backends configured in AUTH_BACKENDS
+// Wrong passwords of known users count towards their lockout
+func (service *AuthService) VerifyCredentials(username, password string) (*models.User, error) {
+	var userId uint
+	if err := service.db.Model(&models.User{}).Select("id").Where("username = ?", username).Scan(&userId).Error; err != nil {
+		log.Println(err)
+	}
+	if userId != 0 {
+		if err := service.lockoutService.Check(userId, ""); err != nil {
+			return nil, err
+		}
 	}
 
-	// Validates password
-	if err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
-		return nil, ErrInvalidPassword
+	userDetails, err := service.credentialVerifier.VerifyCredentials(username, password)
+	if err != nil {
+		if errors.Is(err, ErrInvalidPassword) && userId != 0 {
+			if failed := service.userService.Get(int(userId)); failed != nil {
+				service.lockoutService.Fail(*failed, "", "", "")
+			}
+		}
+		return nil, err
 	}
-	return service.generateAuthResponse(*userDetails, ipAddress, userAgent)
+	// With two factor authentication the failures are only forgotten once the second step succeeds
+	if !userDetails.TwoFactorEnabled {
+		service.lockoutService.Succeed(userDetails.ID, "")
+	}
+	return userDetails, nil
 }
 
 // GenerateRefreshToken Refresh Token generates a new refresh token that will be used to get a new access token and a refresh token
+// Presenting a token that was already rotated revokes every token of its family
 func (service *AuthService) GenerateRefreshToken(oldRefreshToken, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
-	var token models.UserRefreshToken
+	return service.rotateRefreshToken(oldRefreshToken, "", ipAddress, userAgent)
+}
 
-	service.db.Model(&models.UserRefreshToken{}).Select("user_id").Where("token = ? AND expired_time > NOW()", oldRefreshToken).First(&token)
-	userId := token.UserId
-	if userId == 0 {
+// GenerateClientRefreshToken is GenerateRefreshToken for a refresh token issued to the OAuth client, the scope is kept
+func (service *AuthService) GenerateClientRefreshToken(oldRefreshToken, clientId, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	return service.rotateRefreshToken(oldRefreshToken, clientId, ipAddress, userAgent)
+}
+
+func (service *AuthService) rotateRefreshToken(oldRefreshToken, clientId, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	var token models.UserRefreshToken
+	if err := service.db.Where("token = ?", utils.HashToken(oldRefreshToken)).First(&token).Error; err != nil {
 		log.Println("Refresh Token is not there")
 		return nil, ErrInvalidToken
 	}
+	// Tokens can only be refreshed by the client they were issued to
+	if token.ClientId != clientId {
+		return nil, ErrInvalidToken
+	}
+
+	if token.RotatedAt.Valid {
+		service.revokeTokenFamily(token, ipAddress, userAgent)
+		return nil, ErrTokenReuse
+	}
+	if !token.ExpireTime.Valid || token.ExpireTime.Time.Before(time.Now()) {
+		return nil, ErrInvalidToken
+	}
 
 	// Check if account is active before refreshing token
+	userId := token.UserId
 	userDetails := service.userService.Get(int(userId))
-	if !userDetails.Active {
+	if userDetails == nil || !userDetails.Active {
 		return nil, ErrAccountNotActive
 	}
 	roles, _ := service.userService.GetRoles(int(userId))
-	tokenExpire := time.Duration(service.tokenTime)
+	tokenExpire := service.tokenTime
 
-	jwtToken, err := utils.GenerateJwtToken(int(userId), roles, time.Duration(tokenExpire))
+	jwtToken, err := utils.GenerateClientJwtToken(int(userId), roles, token.Scope, token.ClientId, tokenExpire)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
 
-	// Delete the old token and generate new access token and refresh token
-	refreshToken := utils.GenerateOpaqueToken(45)
+	// Mark the old token rotated and issue the next token of the family
+	var refreshToken string
 	err = utils.Transaction(service.db, func(db *gorm.DB) error {
-		if err := service.db.Model(&models.UserRefreshToken{}).Delete(&token).Error; err != nil {
-			log.Println("log khi xoa user refresh token", err)
-			return err
+		// The rotated_at condition makes concurrent refreshes with the same token fail instead of forking the family
+		result := db.Model(&models.UserRefreshToken{}).Where("id = ? AND rotated_at IS NULL", token.ID).
+			Update("rotated_at", sql.NullTime{Time: time.Now(), Valid: true})
+		if result.Error != nil {
+			log.Println("Failed to rotate refresh token", result.Error)
+			return result.Error
 		}
-
-		token.UserId = userId
-		token.Token = refreshToken
-		token.IpAddress = ipAddress
-		token.UserAgent = userAgent
-		token.ExpireTime = sql.NullTime{Time: time.Now().Add(tokenExpire), Valid: true}
-
-		if err := service.db.Model(&models.UserRefreshToken{}).Create(&tokenExpire).Error; err != nil {
-			log.Println("log khi them moi user refresh token", err)
-			return err
+		if result.RowsAffected == 0 {
+			return ErrTokenReuse
 		}
 
-		return nil
+		refreshToken, err = service.issueRefreshToken(db, userId, token.FamilyId, token.ClientId, token.Scope, ipAddress, userAgent)
+		return err
 	})
 
+	if errors.Is(err, ErrTokenReuse) {
+		service.revokeTokenFamily(token, ipAddress, userAgent)
+		return nil, ErrTokenReuse
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -114,6 +186,7 @@ func (service *AuthService) GenerateRefreshToken(oldRefreshToken, ipAddress, use
 		RefreshToken: refreshToken,
 		Token:        jwtToken,
 		Roles:        roles,
+		Scope:        token.Scope,
 		Expires:      int(tokenExpire.Seconds()),
 	}
 
@@ -121,25 +194,41 @@ func (service *AuthService) GenerateRefreshToken(oldRefreshToken, ipAddress, use
 
 }
 
+// issueRefreshToken stores the hash of a new refresh token in the family and returns the plain token
+func (service *AuthService) issueRefreshToken(db *gorm.DB, userId uint, familyId, clientId, scope, ipAddress, userAgent string) (string, error) {
+	refreshToken := utils.GenerateOpaqueToken(45)
+	var entity = models.UserRefreshToken{
+		UserId:     userId,
+		Token:      utils.HashToken(refreshToken),
+		FamilyId:   familyId,
+		ClientId:   clientId,
+		Scope:      scope,
+		IpAddress:  ipAddress,
+		UserAgent:  userAgent,
+		ExpireTime: sql.NullTime{Time: time.Now().Add(service.refreshTime), Valid: true},
+	}
+	if err := db.Create(&entity).Error; err != nil {
+		log.Println(err)
+		return "", ErrTokenGeneration
+	}
+	return refreshToken, nil
+}
+
+// revokeTokenFamily deletes every token issued from the same login as token and records the reuse
+func (service *AuthService) revokeTokenFamily(token models.UserRefreshToken, ipAddress, userAgent string) {
+	result := service.db.Unscoped().Where("family_id = ?", token.FamilyId).Delete(&models.UserRefreshToken{})
+	if result.Error != nil {
+		log.Println("Failed to revoke refresh token family ", result.Error)
+	}
+	service.securityEventService.Record(token.UserId, EventRefreshTokenReuse, ipAddress, userAgent, models.JSONB{
+		"familyId":      token.FamilyId,
+		"revokedTokens": result.RowsAffected,
+	})
+}
+
 func (service *AuthService) generateAuthResponse(userDetails models.User, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
 	if userDetails.TwoFactorEnabled {
-		if userDetails.TwoFactorMethod != "TOTP" {
-			return service.twoFactorRequest(userDetails, ipAddress, userAgent)
-		}
-
-		// Otherwise its TOTP then
-		authResult := &models.AuthenticationResponse{}
-		// Generate a short token which expires after 5minutes
-		var roles []string
-		for _, role := range userDetails.Roles {
-			roles = append(roles, role.Type)
-		}
-		roles = append(roles)
-		shortToken, _ := utils.GenerateJwtToken(int(userDetails.Model.ID), roles, 5*time.Minute)
-		authResult.TwoFactorEnabled = true
-		authResult.Token = shortToken
-		authResult.TwoFactorMethod = userDetails.TwoFactorMethod
-		return authResult, nil
+		return service.BeginTwoFactor(userDetails, ipAddress, userAgent)
 	}
 
 	// Get user roles
@@ -152,11 +241,36 @@ func (service *AuthService) generateAuthResponse(userDetails models.User, ipAddr
 	return service.generateTokenDetails(userDetails, ipAddress, userAgent)
 }
 
+// BeginTwoFactor starts the second step of a login, the returned token identifies it when the code is submitted
+func (service *AuthService) BeginTwoFactor(userDetails models.User, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	if userDetails.TwoFactorMethod != "TOTP" && userDetails.TwoFactorMethod != "WEBAUTHN" {
+		return service.twoFactorRequest(userDetails, ipAddress, userAgent)
+	}
+
+	// Otherwise its TOTP or a passkey, both are completed with the short token
+	authResult := &models.AuthenticationResponse{}
+	// Generate a short token which expires after 5minutes, it is only accepted by the two factor endpoint
+	shortToken, err := utils.GenerateTwoFactorJwtToken(int(userDetails.Model.ID), 5*time.Minute)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrAccessToken
+	}
+	authResult.TwoFactorEnabled = true
+	authResult.Token = shortToken
+	authResult.TwoFactorMethod = userDetails.TwoFactorMethod
+	return authResult, nil
+}
+
 func (service *AuthService) twoFactorRequest(userDetails models.User, ipAddress string, userAgent string) (*models.AuthenticationResponse, error) {
 
 	// Expire after 5minutes
 	expires := time.Duration(300 * time.Second)
 	requestId := utils.GenerateOpaqueToken(60)
+	// Codes only go to a verified cell number, otherwise they are emailed
+	sendType := "EMAIL"
+	if userDetails.TwoFactorMethod == "SMS" && userDetails.CellNumberVerified {
+		sendType = "SMS"
+	}
 
 	var entity = models.TwoFactorRequest{
 		UserId:     userDetails.ID,
@@ -164,7 +278,7 @@ func (service *AuthService) twoFactorRequest(userDetails models.User, ipAddress
 		IpAddress:  ipAddress,
 		Code:       utils.GenerateRandomDigits(6),
 		UserAgent:  userAgent,
-		SendType:   "EMAIL",
+		SendType:   sendType,
 		ExpireTime: sql.NullTime{Time: time.Now().Add(expires), Valid: true},
 	}
 
@@ -175,7 +289,7 @@ func (service *AuthService) twoFactorRequest(userDetails models.User, ipAddress
 	authResult := &models.AuthenticationResponse{}
 	authResult.TwoFactorEnabled = true
 	authResult.Token = requestId
-	authResult.TwoFactorMethod = userDetails.TwoFactorMethod
+	authResult.TwoFactorMethod = sendType
 	return authResult, nil
 }
 
@@ -187,6 +301,9 @@ func (service *AuthService) insert2FactorRequest(entity models.TwoFactorRequest,
 			return ErrTwoFactorRequest
 		}
 
+		if entity.SendType == "SMS" {
+			return service.smsService.SendTwoFactorRequest(entity.Code, userDetail)
+		}
 		if err := service.emailService.SendTwoFactorRequest(entity.Code, userDetail); err != nil {
 			log.Println("Sending Email error", err)
 			return ErrSendingMail
@@ -197,37 +314,77 @@ func (service *AuthService) insert2FactorRequest(entity models.TwoFactorRequest,
 }
 
 func (service *AuthService) generateTokenDetails(userDetails models.User, ipAddress string, userAgent string) (*models.AuthenticationResponse, error) {
+	return service.GenerateClientTokens(userDetails, "", "", ipAddress, userAgent)
+}
+
+// GenerateClientTokens issues an access and refresh token to the OAuth client, an empty client id means the API itself
+func (service *AuthService) GenerateClientTokens(userDetails models.User, clientId, scope, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
 
 	authResult := &models.AuthenticationResponse{}
 	tokenExpiry := service.tokenTime
 
-	token, err := utils.GenerateJwtToken(int(userDetails.ID), getRoles(userDetails), tokenExpiry)
+	token, err := utils.GenerateClientJwtToken(int(userDetails.ID), getRoles(userDetails), scope, clientId, tokenExpiry)
 	if err != nil {
 		log.Println(err)
 		return nil, ErrAccessToken
 	}
-	refreshToken := utils.GenerateOpaqueToken(45)
-	var entity = models.UserRefreshToken{
-		UserId:     userDetails.ID,
-		Token:      token,
-		IpAddress:  ipAddress,
-		UserAgent:  userAgent,
-		ExpireTime: sql.NullTime{Time: time.Now().Add(tokenExpiry), Valid: true},
-	}
-
-	if err := service.db.Create(&entity).Error; err != nil {
-		log.Println(err)
-		return nil, ErrTokenGeneration
+	// Every login starts a new token family
+	refreshToken, err := service.issueRefreshToken(service.db, userDetails.ID, utils.GenerateOpaqueToken(45), clientId, scope, ipAddress, userAgent)
+	if err != nil {
+		return nil, err
 	}
 
 	authResult.RefreshToken = refreshToken
 	authResult.Token = token
 	authResult.Roles = getRoles(userDetails)
+	authResult.Scope = scope
 	authResult.Expires = int(tokenExpiry.Seconds())
 	authResult.TwoFactorEnabled = userDetails.TwoFactorEnabled
 	return authResult, nil
 }
 
+// RequestPasswordReset emails a single use reset code, unknown usernames are ignored so the caller cannot tell whether an account exists
+func (service *AuthService) RequestPasswordReset(username string) error {
+	userDetails := service.userService.GetByUsername(username)
+	if userDetails == nil {
+		log.Println("Password reset requested for unknown username")
+		return nil
+	}
+	// The password of a directory or federated user is not ours to reset
+	if userDetails.Source != "" && userDetails.Source != UserSourceLocal {
+		log.Println("Password reset requested for a " + userDetails.Source + " user")
+		return nil
+	}
+
+	code := utils.GenerateOpaqueToken(45)
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		// Only the latest code is valid
+		if err := db.Unscoped().Where("user_id = ?", userDetails.ID).Delete(&models.ResetPasswordRequest{}).Error; err != nil {
+			return err
+		}
+
+		entity := models.ResetPasswordRequest{
+			UserId:     userDetails.ID,
+			Code:       utils.HashToken(code),
+			ExpireTime: sql.NullTime{Time: time.Now().Add(service.resetTime), Valid: true},
+		}
+		if err := db.Create(&entity).Error; err != nil {
+			return err
+		}
+
+		if err := service.emailService.SendPasswordResetRequest(code, *userDetails); err != nil {
+			log.Println("Sending Email error", err)
+			return ErrSendingMail
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to create password reset request ", err)
+		return err
+	}
+	return nil
+}
+
 // VerifyAndSetNewPassWord Verify And Set New-Password functions to verify and reset password
 func (service *AuthService) VerifyAndSetNewPassWord(code string, password string) (bool, error) {
 
@@ -235,73 +392,205 @@ func (service *AuthService) VerifyAndSetNewPassWord(code string, password string
 		return false, ErrStrongPassword
 	}
 
-	//var userId uint
-	//err := utils.Transaction(service.db, func(db *gorm.DB) error {
-	//	var
-	//})
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println(err)
+		return false, ErrPasswordUpdate
+	}
+
+	err = utils.Transaction(service.db, func(db *gorm.DB) error {
+		var request models.ResetPasswordRequest
+		if err := db.Where("code = ? AND expire_time > NOW()", utils.HashToken(code)).First(&request).Error; err != nil {
+			log.Println("Invalid password reset code ", err)
+			return ErrInvalidCode
+		}
+
+		// Delete before updating so the code can only be used once
+		if err := db.Unscoped().Delete(&request).Error; err != nil {
+			log.Println(err)
+			return ErrPasswordUpdate
+		}
+
+		if err := db.Model(&models.User{}).Where("id = ?", request.UserId).Update("password", string(passwordHash)).Error; err != nil {
+			log.Println(err)
+			return ErrPasswordUpdate
+		}
+
+		// Sign out every session that was started with the old password
+		if err := db.Unscoped().Where("user_id = ?", request.UserId).Delete(&models.UserRefreshToken{}).Error; err != nil {
+			log.Println(err)
+			return ErrPasswordUpdate
+		}
+		if err := service.revocationService.RevokeUserTokensTx(db, request.UserId); err != nil {
+			return ErrPasswordUpdate
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
 
 	return true, nil
 }
 
 // ValidateTwoFactor Validate the two factors authentication request and complete the authentication request
 func (service *AuthService) ValidateTwoFactor(code, requestId, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	userDetail, err := service.consumeTwoFactorRequest(code, requestId, ipAddress, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	return service.generateTokenDetails(*userDetail, ipAddress, userAgent)
+}
 
-	var userId uint
-	err := service.db.Model(&models.TwoFactorRequest{}).Select("id").Where("code = ? AND request_id = ? AND Expire_Time > NOW()", code, requestId).First(&userId).Error
+// CompleteTwoFactor verifies the code of a login started by BeginTwoFactor and returns the user without starting a session
+func (service *AuthService) CompleteTwoFactor(method, token, code string) (*models.User, error) {
+	switch strings.ToUpper(method) {
+	case "TOTP":
+		userId, err := utils.ValidateTwoFactorJwtAndGetUserId(token)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		userDetails := service.userService.Get(userId)
+		if userDetails == nil || !userDetails.Active || userDetails.TwoFactorMethod != "TOTP" {
+			return nil, ErrPassCode
+		}
+		if err := service.VerifyPassCode(uint(userId), code); err != nil {
+			return nil, err
+		}
+		return userDetails, nil
+	case "EMAIL", "SMS":
+		return service.consumeTwoFactorRequest(code, token, "", "")
+	case "RECOVERY":
+		return service.consumeRecoveryCode(token, code, "", "")
+	case "WEBAUTHN":
+		// The login pages do not run the passkey ceremony, a recovery code completes the login instead
+		return nil, ErrPasskeyPage
+	}
+	return nil, ErrTwoFactorCode
+}
+
+// ValidateRecoveryCode completes the second step of a login with a recovery code instead of the second factor
+func (service *AuthService) ValidateRecoveryCode(token, code, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	userDetails, err := service.consumeRecoveryCode(token, code, ipAddress, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	return service.generateTokenDetails(*userDetails, ipAddress, userAgent)
+}
+
+// consumeRecoveryCode resolves the user of the token returned by BeginTwoFactor and uses up one of their recovery codes
+// The token is the short JWT for TOTP and passkeys, or the request id of an emailed code which is deleted with it
+func (service *AuthService) consumeRecoveryCode(token, code, ipAddress, userAgent string) (*models.User, error) {
+	userId, err := utils.ValidateTwoFactorJwtAndGetUserId(token)
+	var request models.TwoFactorRequest
+	if err != nil {
+		if err := service.db.Where("request_id = ? AND expire_time > NOW()", token).First(&request).Error; err != nil {
+			return nil, ErrInvalidToken
+		}
+		userId = int(request.UserId)
+	}
+
+	userDetails := service.userService.Get(userId)
+	if userDetails == nil || !userDetails.Active {
+		return nil, ErrRecoveryCode
+	}
+	if err := service.lockoutService.Check(userDetails.ID, ""); err != nil {
+		return nil, err
+	}
+	if err := service.recoveryCodeService.Consume(*userDetails, code, ipAddress, userAgent); err != nil {
+		if errors.Is(err, ErrRecoveryCode) {
+			service.lockoutService.Fail(*userDetails, "", ipAddress, userAgent)
+		}
+		return nil, err
+	}
+	service.lockoutService.Succeed(userDetails.ID, "")
+	if request.ID != 0 {
+		if err := service.db.Unscoped().Delete(&request).Error; err != nil {
+			log.Println(err)
+		}
+	}
+	return userDetails, nil
+}
 
-	if userId == 0 || err != nil {
+// consumeTwoFactorRequest deletes the emailed two factor request matching the code and returns its user
+// Wrong codes count towards the lockout of the user and of the request
+func (service *AuthService) consumeTwoFactorRequest(code, requestId, ipAddress, userAgent string) (*models.User, error) {
+	var request models.TwoFactorRequest
+	err := service.db.Where("request_id = ? AND expire_time > NOW()", requestId).First(&request).Error
+	if request.UserId == 0 || err != nil {
 		log.Println("Invalid Code ", err)
 		return nil, ErrTwoFactorCode
 	}
 
-	if err := service.db.Model(&models.TwoFactorRequest{}).Exec("DELETE FROM two_factor_requests WHERE code = ? AND request_id = ?", code, requestId).Error; err != nil {
-		log.Println(err)
+	userDetail := service.userService.Get(int(request.UserId))
+	if userDetail == nil {
+		return nil, ErrTwoFactorCode
+	}
+	if err := service.lockoutService.Check(userDetail.ID, requestId); err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(request.Code)) != 1 {
+		service.lockoutService.Fail(*userDetail, requestId, ipAddress, userAgent)
 		return nil, ErrTwoFactorCode
 	}
 
-	userDetail := service.userService.Get(int(userId))
-	return service.generateTokenDetails(*userDetail, ipAddress, userAgent)
-
+	// Only the request that deletes the code may use it
+	result := service.db.Unscoped().Delete(&request)
+	if result.Error != nil {
+		log.Println(result.Error)
+		return nil, ErrTwoFactorCode
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrTwoFactorCode
+	}
+	service.lockoutService.Succeed(userDetail.ID, requestId)
+	return userDetail, nil
 }
 
 // DeleteExpiredTokens Delete expired tokens
 func (service *AuthService) DeleteExpiredTokens(days int) error {
 
-	ch := make(chan error, 3)
+	tables := []string{
+		// Deletes User Refresh tokens
+		"user_refresh_tokens",
+		// Deletes Two factor requests
+		"two_factor_requests",
+		// Delete Reset Password Requests
+		"reset_password_requests",
+		// Deletes Email Verifications
+		"email_verifications",
+		// Deletes revocations of tokens that have expired anyway
+		"revoked_tokens",
+		// Deletes OAuth authorization codes
+		"authorization_codes",
+		// Deletes device authorization requests that were never redeemed
+		"device_authorizations",
+		// Deletes federated logins that never came back from the provider
+		"federated_login_requests",
+		"saml_login_requests",
+		// Deletes passkey ceremonies that were never completed
+		"web_authn_sessions",
+		"phone_verifications",
+		// Deletes failed attempts that no longer delay or lock anything
+		"failed_attempts",
+	}
+
+	ch := make(chan error, len(tables))
 	var errArr []string
 
 	var wg sync.WaitGroup
-
-	go func() {
-		err := service.db.Exec("DELETE FROM user_refresh_tokens WHERE (DATE_PART('day', AGE(NOW()::date ,expiry_time::date))) >= ?", days).Error
+	for _, table := range tables {
 		wg.Add(1)
-		if err != nil {
-			ch <- err
-		}
-	}()
-
-	go func() {
-		// Deletes Two factor requests
-		err := service.db.Exec("DELETE FROM two_factor_requests WHERE (DATE_PART('day', AGE(NOW()::date ,expiry_time::date))) >= ?", days).Error
-		wg.Add(1)
-		if err != nil {
-			ch <- err
-		}
-	}()
-
-	go func() {
-		// Delete Reset Password Requests
-		err := service.db.Exec("DELETE FROM reset_password_requests WHERE (DATE_PART('day', AGE(NOW()::date ,expiry_time::date))) >= ?", days).Error
-		wg.Add(1)
-		if err != nil {
-			ch <- err
-		}
-	}()
+		go func(table string) {
+			defer wg.Done()
+			ch <- service.db.Exec("DELETE FROM "+table+" WHERE expire_time < NOW() - make_interval(days => ?)", days).Error
+		}(table)
+	}
 
-	wg.Done()
-	// Deletes User Refresh tokens
-	for i := 0; i < 3; i++ {
-		if receive := <-ch; receive != nil {
+	wg.Wait()
+	close(ch)
+	for receive := range ch {
+		if receive != nil {
 			errArr = append(errArr, receive.Error())
 		}
 	}
@@ -313,21 +602,156 @@ func (service *AuthService) DeleteExpiredTokens(days int) error {
 	return nil
 }
 
-// VerifyPassCode Verify the passcode
-func (service *AuthService) VerifyPassCode(userId uint, passCode string) bool {
+// VerifyPassCode Verify the passcode, a code is only accepted once
+// It returns ErrPassCode for a wrong code, wrong codes count towards the lockout of the user
+func (service *AuthService) VerifyPassCode(userId uint, passCode string) error {
 	userDetail := service.userService.Get(int(userId))
-	if totp.Validate(passCode, userDetail.TOTPSecret) {
-		return true
+	if userDetail == nil || userDetail.TOTPSecret == "" {
+		return ErrPassCode
+	}
+	if err := service.lockoutService.Check(userId, ""); err != nil {
+		return err
+	}
+	counter, ok := utils.ValidateTOTP(passCode, userDetail.TOTPSecret, time.Now(), service.totpSkew)
+	if !ok {
+		service.lockoutService.Fail(*userDetail, "", "", "")
+		return ErrPassCode
+	}
+	// The counter only moves forward, so a replayed code fails even when both requests arrive at once
+	result := service.db.Model(&models.User{}).Where("id = ? AND totp_last_counter < ?", userId, counter).Update("totp_last_counter", counter)
+	if result.Error != nil {
+		log.Println(result.Error)
+		return ErrServer
+	}
+	if result.RowsAffected == 0 {
+		return ErrPassCode
 	}
-	return false
+	service.lockoutService.Succeed(userId, "")
+	return nil
+}
+
+// ConfirmTOTP enables the TOTP secret created by Enable2FactorTOTP once the user proves it works with a code
+// It returns the recovery codes of the user, they are only shown once
+func (service *AuthService) ConfirmTOTP(userId uint, code, ipAddress, userAgent string) ([]string, error) {
+	var user models.User
+	if err := service.db.Where("id = ?", userId).First(&user).Error; err != nil {
+		return nil, ErrUserNotFound
+	}
+	if user.TwoFactorEnabled && user.TwoFactorMethod == "TOTP" {
+		return nil, ErrTOTPExists
+	}
+	if user.TOTPSecret == "" || !user.TOTPCreated.Valid || time.Since(user.TOTPCreated.Time) > service.totpEnrollmentTime {
+		return nil, ErrTOTPEnrollment
+	}
+	if err := service.VerifyPassCode(userId, code); err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		err := db.Model(&models.User{}).Where("id = ?", userId).
+			Updates(map[string]interface{}{"two_factor_enabled": true, "two_factor_method": "TOTP"}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = service.recoveryCodeService.generate(db, userId)
+		return err
+	})
+	if err != nil {
+		log.Println("Failed to enable TOTP ", err)
+		return nil, ErrServer
+	}
+	service.securityEventService.Record(userId, EventTwoFactorEnabled, ipAddress, userAgent, models.JSONB{"method": "TOTP"})
+	return codes, nil
+}
+
+// DisableTwoFactor turns two factor authentication off after the user entered their password again,
+// and a current code when the method is TOTP. The TOTP secret and the recovery codes are deleted
+func (service *AuthService) DisableTwoFactor(userId uint, password, code, ipAddress, userAgent string) error {
+	userDetails := service.userService.Get(int(userId))
+	if userDetails == nil {
+		return ErrUserNotFound
+	}
+	if !userDetails.TwoFactorEnabled {
+		return ErrTwoFactorDisabled
+	}
+	if err := service.reauthenticate(*userDetails, password, code); err != nil {
+		return err
+	}
+
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		err := db.Model(&models.User{}).Where("id = ?", userId).Updates(map[string]interface{}{
+			"two_factor_enabled": false,
+			"two_factor_method":  "",
+			"totp_secret":        "",
+			"totp_url":           "",
+			"totp_created":       sql.NullTime{},
+			"totp_last_counter":  0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return db.Unscoped().Where("user_id = ?", userId).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		log.Println("Failed to disable two factor authentication ", err)
+		return ErrServer
+	}
+	service.securityEventService.Record(userId, EventTwoFactorDisabled, ipAddress, userAgent, models.JSONB{"method": userDetails.TwoFactorMethod})
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after the user entered their password again,
+// and a current code when the method is TOTP. The codes bypass the second factor, an access token alone is not enough
+func (service *AuthService) RegenerateRecoveryCodes(userId uint, password, code, ipAddress, userAgent string) ([]string, error) {
+	userDetails := service.userService.Get(int(userId))
+	if userDetails == nil {
+		return nil, ErrUserNotFound
+	}
+	if !userDetails.TwoFactorEnabled {
+		return nil, ErrTwoFactorDisabled
+	}
+	if err := service.reauthenticate(*userDetails, password, code); err != nil {
+		return nil, err
+	}
+	return service.recoveryCodeService.Regenerate(*userDetails, ipAddress, userAgent)
+}
+
+// Reauthenticate checks the password of the signed in user, and a current code when the method is TOTP
+// It guards changes an access token alone must not be enough for
+func (service *AuthService) Reauthenticate(userId uint, password, code string) error {
+	userDetails := service.userService.Get(int(userId))
+	if userDetails == nil {
+		return ErrUserNotFound
+	}
+	return service.reauthenticate(*userDetails, password, code)
+}
+
+// reauthenticate checks the password of a signed in user, and a current code when the method is TOTP
+// Failures count towards the lockout like a login
+func (service *AuthService) reauthenticate(userDetails models.User, password, code string) error {
+	verified, err := service.VerifyCredentials(userDetails.Username, password)
+	if errors.Is(err, ErrAccountLocked) || errors.Is(err, ErrTooManyAttempts) {
+		return err
+	}
+	if err != nil || verified.ID != userDetails.ID {
+		return ErrInvalidPassword
+	}
+	if userDetails.TwoFactorEnabled && userDetails.TwoFactorMethod == "TOTP" {
+		return service.VerifyPassCode(userDetails.ID, code)
+	}
+	return nil
 }
 
 // VerifyOTP Validates the TOTP before the user finally logs in
 func (service *AuthService) VerifyOTP(userId uint, passCode, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
 	userDetails := service.userService.Get(int(userId))
-	if !service.VerifyPassCode(userId, passCode) {
+	if userDetails == nil || !userDetails.Active || userDetails.TwoFactorMethod != "TOTP" {
 		return nil, ErrPassCode
 	}
+	if err := service.VerifyPassCode(userId, passCode); err != nil {
+		return nil, err
+	}
 	return service.generateTokenDetails(*userDetails, ipAddress, userAgent)
 }
 
@@ -340,6 +764,17 @@ func (service *AuthService) PasswordLessLogin(username, sendMethod, ipAddress, u
 	if userDetails.Active == false {
 		return nil, ErrAccountNotActive
 	}
+	sendMethod = strings.ToUpper(sendMethod)
+	switch sendMethod {
+	case "", "EMAIL":
+		sendMethod = "EMAIL"
+	case "SMS":
+		if !userDetails.CellNumberVerified {
+			return nil, ErrPhoneNotVerified
+		}
+	default:
+		return nil, ErrSendMethod
+	}
 
 	// Generates request ID
 	requestId := utils.GenerateOpaqueToken(45)
@@ -352,7 +787,7 @@ func (service *AuthService) PasswordLessLogin(username, sendMethod, ipAddress, u
 			UserId:     userDetails.ID,
 			RequestId:  requestId,
 			Code:       randomCodes,
-			SendMethod: "EMAIL",
+			SendMethod: sendMethod,
 			ExpireTime: sql.NullTime{Time: time.Now().Add(1 * time.Minute), Valid: true},
 			IpAddress:  ipAddress,
 			UserAgent:  userAgent,
@@ -362,6 +797,9 @@ func (service *AuthService) PasswordLessLogin(username, sendMethod, ipAddress, u
 			return err
 		}
 
+		if sendMethod == "SMS" {
+			return service.smsService.SendLoginCode(randomCodes, *userDetails)
+		}
 		if err := service.emailService.SendEmailLoginRequest(randomCodes, *userDetails); err != nil {
 			return err
 		}
@@ -373,18 +811,30 @@ func (service *AuthService) PasswordLessLogin(username, sendMethod, ipAddress, u
 		return nil, err
 	}
 
-	var response = models.PasswordLessAuthResponse{RequestId: requestId, SendMethod: "EMAIL"}
+	var response = models.PasswordLessAuthResponse{RequestId: requestId, SendMethod: sendMethod}
 
 	return &response, nil
 }
 
 // CompletePasswordLessLogin Func completePasswordLessLogin
 func (service *AuthService) CompletePasswordLessLogin(code, requestId string) (*models.AuthenticationResponse, error) {
+	return service.completePasswordLessLogin(code, requestId, false)
+}
 
-	println(code, requestId)
+// completePasswordLessLogin deletes the request so it is accepted only once, magic link requests are only accepted from the link
+func (service *AuthService) completePasswordLessLogin(code, requestId string, link bool) (*models.AuthenticationResponse, error) {
+	query := service.db.Where("request_id = ? AND expire_time >= NOW()", requestId)
+	if link {
+		query = query.Where("send_method = ?", "LINK")
+	} else {
+		query = query.Where("send_method <> ?", "LINK")
+	}
 
 	var otpRequest models.OTPRequest
-	if err := service.db.Model(&models.OTPRequest{}).Where("code = ? AND request_id = ? AND expire_time >= NOW()", code, requestId).First(&otpRequest).Error; err != nil {
+	if err := query.First(&otpRequest).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidCode
+		}
 		log.Println(err)
 		return nil, err
 	}
@@ -397,20 +847,30 @@ func (service *AuthService) CompletePasswordLessLogin(code, requestId string) (*
 		log.Println(err)
 		return nil, err
 	}
-
-	err := utils.Transaction(service.db, func(db *gorm.DB) error {
-
-		if err := service.db.Model(&models.OTPRequest{}).Delete(&otpRequest).Error; err != nil {
-			log.Println(err)
-			return err
-		}
-
-		return nil
-	})
-
-	if err != nil {
+	if !userDetails.Active {
+		return nil, ErrAccountNotActive
+	}
+	if err := service.lockoutService.Check(userDetails.ID, requestId); err != nil {
 		return nil, err
 	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(otpRequest.Code)) != 1 {
+		service.lockoutService.Fail(userDetails, requestId, ipAddress, userAgent)
+		return nil, ErrInvalidCode
+	}
+
+	// Two requests racing with the same code can both find it, only the one that deletes it goes on
+	result := service.db.Delete(&otpRequest)
+	if result.Error != nil {
+		log.Println(result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidCode
+	}
+	// With two factor authentication the failures are only forgotten once the second step succeeds
+	if !userDetails.TwoFactorEnabled {
+		service.lockoutService.Succeed(userDetails.ID, requestId)
+	}
 
 	return service.generateAuthResponse(userDetails, ipAddress, userAgent)
 }
@@ -1,10 +1,12 @@
 package services
 
 import (
+	"errors"
 	"log"
 	"os"
 	"testing"
 
+	"github.com/bachdang2k/security-golang/internal/models"
 	"github.com/bachdang2k/security-golang/internal/utils"
 	_ "github.com/lib/pq"
 	"gorm.io/gorm"
@@ -25,15 +27,20 @@ func setUp() {
 		log.Fatal("Failed to connect to database")
 		return
 	}
-	// userService := NewUserService(db)
-	// _, err = userService.Register(models.UserRegistrationRequest{
-	// 	Username:     "john.doe",
-	// 	Password:     "password_2030333",
-	// 	EmailAddress: "johndoe@localhost",
-	// 	FirstName:    "john",
-	// 	LastName:     "doe",
-	// 	CellNumber:   "0731482947",
-	// })
+	userService := NewUserService(db)
+	_, err = userService.Register(models.UserRegistrationRequest{
+		Username:     "john.doe",
+		Password:     "Password_2030333",
+		EmailAddress: "johndoe@localhost",
+		FirstName:    "john",
+		LastName:     "doe",
+		CellNumber:   "+27731482947",
+	})
+	if err != nil && !errors.Is(err, ErrUserNameExists) {
+		log.Fatal("Failed to register test user ", err)
+	}
+	// Registered users are inactive until their email address is verified
+	db.Model(&models.User{}).Where("username = ?", "john.doe").Update("active", true)
 
 }
 func TestMain(m *testing.M) {
@@ -43,8 +50,63 @@ func TestMain(m *testing.M) {
 }
 func TestLoginByUsernamePassword(t *testing.T) {
 	authService := NewAuthService(db)
-	_, err := authService.LoginByUsernamePassword("john.doe", "password", "", "")
+	_, err := authService.LoginByUsernamePassword("john.doe", "Password_2030333", "", "")
 	if err != nil {
 		t.Error("Failed to authenticate")
 	}
 }
+
+func loginTestUser(t *testing.T, authService *AuthService) string {
+	response, err := authService.LoginByUsernamePassword("john.doe", "Password_2030333", "", "")
+	if err != nil || response.RefreshToken == "" {
+		t.Fatal("Failed to authenticate ", err)
+	}
+	return response.RefreshToken
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	authService := NewAuthService(db)
+	refreshToken := loginTestUser(t, authService)
+
+	response, err := authService.GenerateRefreshToken(refreshToken, "", "")
+	if err != nil {
+		t.Fatal("Failed to refresh ", err)
+	}
+	if response.RefreshToken == "" || response.RefreshToken == refreshToken {
+		t.Fatal("A refresh must return a new refresh token")
+	}
+
+	var rotated, next models.UserRefreshToken
+	db.Where("token = ?", utils.HashToken(refreshToken)).First(&rotated)
+	db.Where("token = ?", utils.HashToken(response.RefreshToken)).First(&next)
+	if !rotated.RotatedAt.Valid {
+		t.Error("The old refresh token must be marked rotated")
+	}
+	if next.FamilyId == "" || next.FamilyId != rotated.FamilyId || next.RotatedAt.Valid {
+		t.Error("The new refresh token must continue the family of the old one")
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	authService := NewAuthService(db)
+	refreshToken := loginTestUser(t, authService)
+
+	var first models.UserRefreshToken
+	db.Where("token = ?", utils.HashToken(refreshToken)).First(&first)
+	response, err := authService.GenerateRefreshToken(refreshToken, "", "")
+	if err != nil {
+		t.Fatal("Failed to refresh ", err)
+	}
+
+	if _, err := authService.GenerateRefreshToken(refreshToken, "", ""); !errors.Is(err, ErrTokenReuse) {
+		t.Fatal("Replaying a rotated refresh token must be detected, got ", err)
+	}
+	var count int64
+	db.Model(&models.UserRefreshToken{}).Where("family_id = ?", first.FamilyId).Count(&count)
+	if count != 0 {
+		t.Errorf("Every token of the family must be revoked, %d left", count)
+	}
+	if _, err := authService.GenerateRefreshToken(response.RefreshToken, "", ""); !errors.Is(err, ErrInvalidToken) {
+		t.Error("The latest token of a revoked family must not refresh, got ", err)
+	}
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"log"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Grant types a client can be allowed to use
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+type ClientService struct {
+	db                *gorm.DB
+	revocationService *RevocationService
+}
+
+func NewClientService(db *gorm.DB) *ClientService {
+	return &ClientService{
+		db:                db,
+		revocationService: NewRevocationService(db),
+	}
+}
+
+// Create registers a client, the plain secret is only available in the returned response
+func (service *ClientService) Create(request models.CreateClientRequest) (*models.ClientResponse, error) {
+	client := models.OAuthClient{
+		ClientId:     utils.GenerateUUID(),
+		Name:         request.Name,
+		Public:       request.Public,
+		Active:       true,
+		RedirectUris: request.RedirectUris,
+		Scopes:       request.Scopes,
+		GrantTypes:   request.GrantTypes,
+	}
+	if client.Public && allowsGrant(client, GrantTypeClientCredentials) {
+		return nil, ErrPublicClient
+	}
+
+	var clientSecret string
+	if !client.Public {
+		var err error
+		if clientSecret, client.SecretHash, err = generateClientSecret(); err != nil {
+			return nil, ErrClientRegistration
+		}
+	}
+	if err := service.db.Create(&client).Error; err != nil {
+		log.Println(err)
+		return nil, ErrClientRegistration
+	}
+
+	response := clientResponse(client)
+	response.ClientSecret = clientSecret
+	return &response, nil
+}
+
+// RotateSecret replaces the client secret, the old secret stops working immediately
+func (service *ClientService) RotateSecret(clientId string) (*models.ClientResponse, error) {
+	var client models.OAuthClient
+	if err := service.db.Where("client_id = ?", clientId).First(&client).Error; err != nil {
+		return nil, ErrClientNotFound
+	}
+	if client.Public {
+		return nil, ErrPublicClient
+	}
+
+	clientSecret, secretHash, err := generateClientSecret()
+	if err != nil {
+		return nil, ErrServer
+	}
+	if err := service.db.Model(&client).Update("secret_hash", secretHash).Error; err != nil {
+		log.Println(err)
+		return nil, ErrServer
+	}
+
+	response := clientResponse(client)
+	response.ClientSecret = clientSecret
+	return &response, nil
+}
+
+// SetActive enables or disables the client, disabling it revokes every token issued to it
+func (service *ClientService) SetActive(clientId string, active bool) error {
+	return utils.Transaction(service.db, func(db *gorm.DB) error {
+		var client models.OAuthClient
+		if err := db.Where("client_id = ?", clientId).First(&client).Error; err != nil {
+			log.Println(err)
+			return ErrClientNotFound
+		}
+
+		if err := db.Model(&client).Update("active", active).Error; err != nil {
+			return err
+		}
+		if active {
+			return nil
+		}
+
+		if err := db.Unscoped().Where("client_id = ?", client.ClientId).Delete(&models.UserRefreshToken{}).Error; err != nil {
+			return err
+		}
+		return service.revocationService.RevokeClientTokensTx(db, client.ClientId)
+	})
+}
+
+// List returns every registered client
+func (service *ClientService) List() ([]models.ClientResponse, error) {
+	var clients []models.OAuthClient
+	if err := service.db.Order("created_at").Find(&clients).Error; err != nil {
+		return nil, err
+	}
+	response := make([]models.ClientResponse, 0, len(clients))
+	for _, client := range clients {
+		response = append(response, clientResponse(client))
+	}
+	return response, nil
+}
+
+// Get returns the active client with the client id
+func (service *ClientService) Get(clientId string) (*models.OAuthClient, error) {
+	var client models.OAuthClient
+	if err := service.db.Where("client_id = ? AND active = ?", clientId, true).First(&client).Error; err != nil {
+		return nil, ErrInvalidClient
+	}
+	return &client, nil
+}
+
+// Authenticate checks the client credentials and returns the active client, public clients have no credentials to check
+func (service *ClientService) Authenticate(clientId, clientSecret string) (*models.OAuthClient, error) {
+	var client models.OAuthClient
+	err := service.db.Where("client_id = ?", clientId).First(&client).Error
+	if err != nil {
+		// Compare against a dummy hash so unknown client ids take as long as wrong secrets
+		_ = bcrypt.CompareHashAndPassword(dummySecretHash, []byte(clientSecret))
+		return nil, ErrInvalidClient
+	}
+	if client.Public || bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(clientSecret)) != nil || !client.Active {
+		return nil, ErrInvalidClient
+	}
+	return &client, nil
+}
+
+var dummySecretHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-client-secret"), bcrypt.DefaultCost)
+
+func clientResponse(client models.OAuthClient) models.ClientResponse {
+	return models.ClientResponse{
+		ClientId:     client.ClientId,
+		Name:         client.Name,
+		Public:       client.Public,
+		Active:       client.Active,
+		RedirectUris: client.RedirectUris,
+		Scopes:       client.Scopes,
+		GrantTypes:   grantTypes(client),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// generateClientSecret returns a new secret and its bcrypt hash
+func generateClientSecret() (string, string, error) {
+	clientSecret := utils.GenerateOpaqueToken(45)
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(clientSecret), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println(err)
+		return "", "", err
+	}
+	return clientSecret, string(secretHash), nil
+}
+
+// grantTypes returns the grants the client may use, applying the default for clients registered without any
+func grantTypes(client models.OAuthClient) []string {
+	if len(client.GrantTypes) == 0 {
+		return []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken}
+	}
+	return client.GrantTypes
+}
+
+func allowsGrant(client models.OAuthClient, grantType string) bool {
+	return models.StringList(grantTypes(client)).Contains(grantType)
+}
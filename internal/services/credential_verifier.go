@@ -0,0 +1,169 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/bachdang2k/security-golang/internal/directory"
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Where the credentials of a user are checked
+const (
+	UserSourceLocal     = "local"
+	UserSourceLDAP      = "ldap"
+	UserSourceFederated = "federated"
+)
+
+// CredentialVerifier checks a username and password and returns the local user they belong to
+// ErrInvalidUsername means the verifier does not know the user, so the next verifier of a chain is tried
+type CredentialVerifier interface {
+	VerifyCredentials(username, password string) (*models.User, error)
+}
+
+// NewCredentialVerifier returns the verifiers listed in AUTH_BACKENDS in order, local only by default
+func NewCredentialVerifier(db *gorm.DB) CredentialVerifier {
+	chain := credentialVerifierChain{}
+	for _, backend := range strings.Split(os.Getenv("AUTH_BACKENDS"), ",") {
+		switch strings.ToLower(strings.TrimSpace(backend)) {
+		case UserSourceLocal:
+			chain = append(chain, NewLocalCredentialVerifier(db))
+		case UserSourceLDAP:
+			config, ok := directory.LDAPConfigFromEnv()
+			if !ok {
+				log.Println("Skipping the ldap authentication backend, LDAP_URL is not set")
+				continue
+			}
+			chain = append(chain, NewLDAPCredentialVerifier(db, directory.NewLDAPDirectory(config)))
+		}
+	}
+	if len(chain) == 0 {
+		return NewLocalCredentialVerifier(db)
+	}
+	return chain
+}
+
+// credentialVerifierChain tries its verifiers until one knows the user
+type credentialVerifierChain []CredentialVerifier
+
+func (chain credentialVerifierChain) VerifyCredentials(username, password string) (*models.User, error) {
+	for _, verifier := range chain {
+		userDetails, err := verifier.VerifyCredentials(username, password)
+		if !errors.Is(err, ErrInvalidUsername) {
+			return userDetails, err
+		}
+	}
+	return nil, ErrInvalidUsername
+}
+
+// LocalCredentialVerifier checks the password against the bcrypt hash in the users table
+type LocalCredentialVerifier struct {
+	db          *gorm.DB
+	userService *UserService
+}
+
+func NewLocalCredentialVerifier(db *gorm.DB) *LocalCredentialVerifier {
+	return &LocalCredentialVerifier{db: db, userService: NewUserService(db)}
+}
+
+func (verifier *LocalCredentialVerifier) VerifyCredentials(username, password string) (*models.User, error) {
+	var (
+		userId       int
+		passwordHash string
+		source       string
+		err          error
+	)
+
+	row := verifier.db.Model(&models.User{}).Select("id", "password", "source").Where("username = ?", username).Row()
+	row.Scan(&userId, &passwordHash, &source)
+	// Users of a directory or an identity provider have no local password
+	if userId == 0 || (source != "" && source != UserSourceLocal) {
+		return nil, ErrInvalidUsername
+	}
+	userDetails := verifier.userService.Get(userId)
+	if userDetails == nil || !userDetails.Active {
+		return nil, ErrAccountNotActive
+	}
+
+	// Validates password
+	if err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidPassword
+	}
+	return userDetails, nil
+}
+
+// LDAPCredentialVerifier binds against the directory and provisions the local user on the first login
+// The user's names, email address and roles are updated from the directory on every login
+type LDAPCredentialVerifier struct {
+	db          *gorm.DB
+	userService *UserService
+	directory   *directory.LDAPDirectory
+}
+
+func NewLDAPCredentialVerifier(db *gorm.DB, ldapDirectory *directory.LDAPDirectory) *LDAPCredentialVerifier {
+	return &LDAPCredentialVerifier{db: db, userService: NewUserService(db), directory: ldapDirectory}
+}
+
+func (verifier *LDAPCredentialVerifier) VerifyCredentials(username, password string) (*models.User, error) {
+	entry, err := verifier.directory.Authenticate(username, password)
+	if err != nil {
+		switch {
+		case errors.Is(err, directory.ErrUserNotFound):
+			return nil, ErrInvalidUsername
+		case errors.Is(err, directory.ErrInvalidCredentials):
+			return nil, ErrInvalidPassword
+		}
+		log.Println("LDAP authentication failed ", err)
+		return nil, ErrDirectoryUnavailable
+	}
+	if entry.Username != "" {
+		username = entry.Username
+	}
+
+	var user models.User
+	err = verifier.db.Where("username = ?", username).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	// A local account with the same name is never taken over by the directory
+	if user.ID != 0 && user.Source != UserSourceLDAP {
+		log.Println("Refusing LDAP login of " + username + ", the username belongs to a " + user.Source + " user")
+		return nil, ErrInvalidUsername
+	}
+	if user.ID != 0 && !user.Active {
+		return nil, ErrAccountNotActive
+	}
+
+	roles := verifier.directory.Roles(*entry)
+	if len(roles) == 0 {
+		roles = []string{defaultRole}
+	}
+	err = utils.Transaction(verifier.db, func(db *gorm.DB) error {
+		if user.ID == 0 {
+			user = models.User{
+				UUID:     utils.GenerateUUID(),
+				Username: username,
+				Source:   UserSourceLDAP,
+				Active:   true,
+				Metadata: models.JSONB{},
+			}
+		}
+		user.EmailAddress = entry.Email
+		user.FirstName = entry.FirstName
+		user.LastName = entry.LastName
+		if err := db.Omit("Roles").Save(&user).Error; err != nil {
+			return err
+		}
+		return replaceRoles(db, &user, roles)
+	})
+	if err != nil {
+		log.Println("Failed to provision LDAP user ", err)
+		return nil, ErrServer
+	}
+	return verifier.userService.Get(int(user.ID)), nil
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// Status of a device authorization
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+)
+
+// DeviceService implements the OAuth device authorization grant (RFC 8628)
+type DeviceService struct {
+	db          *gorm.DB
+	userService *UserService
+	authService *AuthService
+	oidcService *OIDCService
+	// lockoutService limits wrong user codes per client address
+	lockoutService *LockoutService
+	// verificationUri is the page where the user enters the user code
+	verificationUri string
+	codeTime        time.Duration
+	interval        time.Duration
+}
+
+func NewDeviceService(db *gorm.DB) *DeviceService {
+	codeTime, err := time.ParseDuration(os.Getenv("DEVICE_CODE_EXPIRY_TIME"))
+	if err != nil {
+		codeTime = 10 * time.Minute
+	}
+	interval, err := time.ParseDuration(os.Getenv("DEVICE_CODE_POLL_INTERVAL"))
+	if err != nil || interval < time.Second {
+		interval = 5 * time.Second
+	}
+	return &DeviceService{
+		db:              db,
+		userService:     NewUserService(db),
+		authService:     NewAuthService(db),
+		oidcService:     NewOIDCService(db),
+		lockoutService:  NewLockoutService(db),
+		verificationUri: strings.TrimSuffix(os.Getenv("APP_URL"), "/") + "/oauth/device",
+		codeTime:        codeTime,
+		interval:        interval,
+	}
+}
+
+// StartAuthorization issues the device code the client polls with and the user code the user enters on the verification page
+func (service *DeviceService) StartAuthorization(client models.OAuthClient, scope string) (*models.DeviceAuthorizationResponse, error) {
+	if !allowsGrant(client, GrantTypeDeviceCode) {
+		return nil, ErrUnauthorizedClient
+	}
+	grantedScope, err := grantedScope(client, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceCode := utils.GenerateOpaqueToken(45)
+	userCode := utils.GenerateUserCode()
+	entity := models.DeviceAuthorization{
+		DeviceCodeHash: utils.HashToken(deviceCode),
+		UserCode:       utils.NormalizeUserCode(userCode),
+		ClientId:       client.ClientId,
+		Scope:          grantedScope,
+		Status:         DeviceStatusPending,
+		Interval:       int(service.interval.Seconds()),
+		ExpireTime:     sql.NullTime{Time: time.Now().Add(service.codeTime), Valid: true},
+	}
+	if err := service.db.Create(&entity).Error; err != nil {
+		log.Println("Failed to create device authorization ", err)
+		return nil, ErrTokenGeneration
+	}
+
+	return &models.DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationUri:         service.verificationUri,
+		VerificationUriComplete: service.verificationUri + "?user_code=" + userCode,
+		ExpiresIn:               int(service.codeTime.Seconds()),
+		Interval:                entity.Interval,
+	}, nil
+}
+
+// PendingAuthorization returns the pending authorization with the user code and the client that requested it
+func (service *DeviceService) PendingAuthorization(userCode, ipAddress string) (*models.DeviceAuthorization, *models.OAuthClient, error) {
+	// User codes are short enough to guess, wrong codes slow down and then stop the client address
+	if err := service.lockoutService.CheckUserCode(ipAddress); err != nil {
+		return nil, nil, err
+	}
+	var entity models.DeviceAuthorization
+	err := service.db.Where("user_code = ? AND status = ? AND expire_time > NOW()", utils.NormalizeUserCode(userCode), DeviceStatusPending).
+		First(&entity).Error
+	if err != nil {
+		service.lockoutService.FailUserCode(ipAddress)
+		return nil, nil, ErrInvalidUserCode
+	}
+
+	var client models.OAuthClient
+	if err := service.db.Where("client_id = ? AND active = ?", entity.ClientId, true).First(&client).Error; err != nil {
+		return nil, nil, ErrInvalidUserCode
+	}
+	return &entity, &client, nil
+}
+
+// Approve completes the authorization for the user, the client receives tokens on its next poll
+func (service *DeviceService) Approve(userCode string, userId uint) error {
+	return service.complete(userCode, map[string]interface{}{"status": DeviceStatusApproved, "user_id": userId})
+}
+
+// Deny rejects the authorization, the client receives access_denied on its next poll
+func (service *DeviceService) Deny(userCode string) error {
+	return service.complete(userCode, map[string]interface{}{"status": DeviceStatusDenied})
+}
+
+func (service *DeviceService) complete(userCode string, updates map[string]interface{}) error {
+	result := service.db.Model(&models.DeviceAuthorization{}).
+		Where("user_code = ? AND status = ? AND expire_time > NOW()", utils.NormalizeUserCode(userCode), DeviceStatusPending).
+		Updates(updates)
+	if result.Error != nil {
+		log.Println("Failed to complete device authorization ", result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidUserCode
+	}
+	return nil
+}
+
+// PollToken is the device_code grant of the token endpoint, it returns ErrAuthorizationPending until the user acts
+func (service *DeviceService) PollToken(client models.OAuthClient, deviceCode, ipAddress, userAgent string) (*models.TokenResponse, error) {
+	var entity models.DeviceAuthorization
+	if err := service.db.Where("device_code_hash = ? AND client_id = ?", utils.HashToken(deviceCode), client.ClientId).First(&entity).Error; err != nil {
+		return nil, ErrInvalidGrant
+	}
+	if !entity.ExpireTime.Valid || entity.ExpireTime.Time.Before(time.Now()) {
+		return nil, ErrExpiredToken
+	}
+
+	switch entity.Status {
+	case DeviceStatusDenied:
+		return nil, ErrAccessDenied
+	case DeviceStatusPending:
+		return nil, service.recordPoll(entity)
+	}
+
+	// Deleting first makes the device code single use even when it is polled concurrently
+	result := service.db.Unscoped().Where("id = ? AND status = ?", entity.ID, DeviceStatusApproved).Delete(&models.DeviceAuthorization{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidGrant
+	}
+
+	userDetails := service.userService.Get(int(entity.UserId))
+	if userDetails == nil || !userDetails.Active {
+		return nil, ErrInvalidGrant
+	}
+	response, err := service.authService.GenerateClientTokens(*userDetails, client.ClientId, entity.Scope, ipAddress, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	tokenResponse := newTokenResponse(*response)
+
+	if models.StringList(strings.Fields(entity.Scope)).Contains(ScopeOpenId) {
+		// The user authenticated when approving the request
+		tokenResponse.IdToken, err = service.oidcService.GenerateIDToken(*userDetails, client.ClientId, entity.Scope, "", entity.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tokenResponse, nil
+}
+
+// recordPoll stores the poll time, polling before the interval has passed adds 5 seconds to it as RFC 8628 requires
+func (service *DeviceService) recordPoll(entity models.DeviceAuthorization) error {
+	now := time.Now()
+	updates := map[string]interface{}{"last_polled_at": sql.NullTime{Time: now, Valid: true}}
+	pollErr := ErrAuthorizationPending
+	if entity.LastPolledAt.Valid && now.Sub(entity.LastPolledAt.Time) < time.Duration(entity.Interval)*time.Second {
+		updates["interval"] = entity.Interval + 5
+		pollErr = ErrSlowDown
+	}
+	if err := service.db.Model(&entity).Updates(updates).Error; err != nil {
+		log.Println("Failed to record device poll ", err)
+		return err
+	}
+	return pollErr
+}
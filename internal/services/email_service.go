@@ -7,11 +7,15 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/bachdang2k/security-golang/internal/models"
 	"gopkg.in/gomail.v2"
 )
 
+// emailTemplateDir is the directory holding the html email templates
+const emailTemplateDir = "static/email_template/"
+
 type EmailService struct {
 	smtpHost         string
 	smtpUsername     string
@@ -25,8 +29,8 @@ func NewEmailService(secure bool) *EmailService {
 	return &EmailService{
 		smtpHost:         os.Getenv("SMTP_HOST"),
 		smtpUsername:     os.Getenv("SMTP_USERNAME"),
-		smtpPassword:     os.Getenv("SMTP_PORT"),
-		smtpPort:         os.Getenv("SMTP_PASSWORD"),
+		smtpPassword:     os.Getenv("SMTP_PASSWORD"),
+		smtpPort:         os.Getenv("SMTP_PORT"),
 		fromEmailAddress: os.Getenv("FROM_EMAIL_ADDRESS"),
 		secure:           secure,
 	}
@@ -40,7 +44,7 @@ func (service *EmailService) sendMail(to []string, subject, message string) erro
 	// Compose the message to be sent
 	m := gomail.NewMessage()
 	m.SetHeader("From", service.fromEmailAddress)
-	m.SetHeader("To ", to[:]...)
+	m.SetHeader("To", to[:]...)
 	m.SetHeader("Subject", subject)
 	m.SetBody("text/html", message)
 
@@ -55,7 +59,7 @@ func (service *EmailService) SendTwoFactorRequest(randomCodes string, userDetail
 
 	var twoFactorRequestTemplateBuffer bytes.Buffer
 	// Get email template from directory and assign random code to it
-	emailTemplateFile, err := template.ParseFiles("static/email_templates/TwoFactorLogin.html")
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "TowFactorLogin.html")
 	if err != nil {
 		return err
 	}
@@ -80,7 +84,7 @@ func (service *EmailService) SendTwoFactorRequest(randomCodes string, userDetail
 func (service *EmailService) SendEmailLoginRequest(randomCodes string, userDetails models.User) error {
 	var twoFactorRequestTemplateBuffer bytes.Buffer
 	// Get email template from directory and assign random code to it
-	emailTemplateFile, err := template.ParseFiles("static/email_templates/EmailLogin.html")
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "EmailLogin.html")
 	if err != nil {
 		return err
 	}
@@ -105,7 +109,7 @@ func (service *EmailService) SendEmailLoginRequest(randomCodes string, userDetai
 func (service *EmailService) SendPasswordResetRequest(randomCodes string, userDetails models.User) error {
 	var passwordResetTemplateBuffer bytes.Buffer
 	// Get email template from directory and assign random code to it
-	emailTemplateFile, err := template.ParseFiles("static/email_templates/PasswordRequest.html")
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "PasswordRequest.html")
 	if err != nil {
 		log.Println("Template reading ", err)
 		return err
@@ -125,3 +129,131 @@ func (service *EmailService) SendPasswordResetRequest(randomCodes string, userDe
 	}
 	return nil
 }
+
+// SendEmailVerification sends the link the user follows to prove ownership of the mailbox
+func (service *EmailService) SendEmailVerification(link string, expiresIn time.Duration, userDetails models.User) error {
+	var verificationTemplateBuffer bytes.Buffer
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "VerifyEmail.html")
+	if err != nil {
+		log.Println("Template reading ", err)
+		return err
+	}
+	tmpl := template.Must(emailTemplateFile, err)
+	emailTemplateData := struct {
+		FullName  string
+		Link      string
+		ExpiresIn string
+	}{}
+	emailTemplateData.Link = link
+	emailTemplateData.ExpiresIn = expiresIn.String()
+	emailTemplateData.FullName = userDetails.FirstName + " " + userDetails.LastName
+	_ = tmpl.Execute(&verificationTemplateBuffer, emailTemplateData)
+	recipient := []string{userDetails.EmailAddress}
+	if err = service.sendMail(recipient, "Verify your email address", verificationTemplateBuffer.String()); err != nil {
+		log.Println("Sending Email Verification Error", err)
+		return err
+	}
+	return nil
+}
+
+// SendRecoveryCodeUsed tells the user a recovery code was used to log in and how many are left
+func (service *EmailService) SendRecoveryCodeUsed(remaining int64, ipAddress string, userDetails models.User) error {
+	var recoveryTemplateBuffer bytes.Buffer
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "RecoveryCodeUsed.html")
+	if err != nil {
+		log.Println("Template reading ", err)
+		return err
+	}
+	tmpl := template.Must(emailTemplateFile, err)
+	emailTemplateData := struct {
+		FullName  string
+		IpAddress string
+		Remaining int64
+	}{}
+	emailTemplateData.IpAddress = ipAddress
+	emailTemplateData.Remaining = remaining
+	emailTemplateData.FullName = userDetails.FirstName + " " + userDetails.LastName
+	_ = tmpl.Execute(&recoveryTemplateBuffer, emailTemplateData)
+	recipient := []string{userDetails.EmailAddress}
+	if err = service.sendMail(recipient, "A recovery code was used", recoveryTemplateBuffer.String()); err != nil {
+		log.Println("Sending Recovery Code Email Error", err)
+		return err
+	}
+	return nil
+}
+
+// SendRecoveryCodesGenerated tells the user new recovery codes were generated and the old ones stopped working
+func (service *EmailService) SendRecoveryCodesGenerated(ipAddress string, userDetails models.User) error {
+	var recoveryTemplateBuffer bytes.Buffer
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "RecoveryCodesGenerated.html")
+	if err != nil {
+		log.Println("Template reading ", err)
+		return err
+	}
+	tmpl := template.Must(emailTemplateFile, err)
+	emailTemplateData := struct {
+		FullName  string
+		IpAddress string
+	}{}
+	emailTemplateData.IpAddress = ipAddress
+	emailTemplateData.FullName = userDetails.FirstName + " " + userDetails.LastName
+	_ = tmpl.Execute(&recoveryTemplateBuffer, emailTemplateData)
+	recipient := []string{userDetails.EmailAddress}
+	if err = service.sendMail(recipient, "New recovery codes were generated", recoveryTemplateBuffer.String()); err != nil {
+		log.Println("Sending Recovery Codes Email Error", err)
+		return err
+	}
+	return nil
+}
+
+// SendMagicLink sends the single use link that logs the user in without a password
+func (service *EmailService) SendMagicLink(link string, expiresIn time.Duration, userDetails models.User) error {
+	var magicLinkTemplateBuffer bytes.Buffer
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "MagicLinkLogin.html")
+	if err != nil {
+		log.Println("Template reading ", err)
+		return err
+	}
+	tmpl := template.Must(emailTemplateFile, err)
+	emailTemplateData := struct {
+		FullName  string
+		Link      string
+		ExpiresIn string
+	}{}
+	emailTemplateData.Link = link
+	emailTemplateData.ExpiresIn = expiresIn.String()
+	emailTemplateData.FullName = userDetails.FirstName + " " + userDetails.LastName
+	_ = tmpl.Execute(&magicLinkTemplateBuffer, emailTemplateData)
+	recipient := []string{userDetails.EmailAddress}
+	if err = service.sendMail(recipient, "Your sign in link", magicLinkTemplateBuffer.String()); err != nil {
+		log.Println("Sending Magic Link Email Error", err)
+		return err
+	}
+	return nil
+}
+
+// SendAccountLocked tells the user their account was locked after too many failed attempts
+func (service *EmailService) SendAccountLocked(lockedUntil time.Time, ipAddress string, userDetails models.User) error {
+	var lockedTemplateBuffer bytes.Buffer
+	emailTemplateFile, err := template.ParseFiles(emailTemplateDir + "AccountLocked.html")
+	if err != nil {
+		log.Println("Template reading ", err)
+		return err
+	}
+	tmpl := template.Must(emailTemplateFile, err)
+	emailTemplateData := struct {
+		FullName    string
+		IpAddress   string
+		LockedUntil string
+	}{}
+	emailTemplateData.IpAddress = ipAddress
+	emailTemplateData.LockedUntil = lockedUntil.UTC().Format("2006-01-02 15:04 MST")
+	emailTemplateData.FullName = userDetails.FirstName + " " + userDetails.LastName
+	_ = tmpl.Execute(&lockedTemplateBuffer, emailTemplateData)
+	recipient := []string{userDetails.EmailAddress}
+	if err = service.sendMail(recipient, "Your account was locked", lockedTemplateBuffer.String()); err != nil {
+		log.Println("Sending Account Locked Email Error", err)
+		return err
+	}
+	return nil
+}
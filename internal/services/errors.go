@@ -20,4 +20,51 @@ var (
 	ErrPassCode         = errors.New("invalid Passcode")
 	ErrStrongPassword   = errors.New("password must be at least 8 characters and must contain special characters")
 	ErrTOTPExists       = errors.New("TOTP Already Enabled ")
+
+	ErrInvalidVerification  = errors.New("verification link is invalid or has expired")
+	ErrEmailAddressExists   = errors.New("the email address belongs to another account")
+	ErrInvalidClient        = errors.New("client authentication failed")
+	ErrClientRegistration   = errors.New("failed to register client")
+	ErrInvalidRedirectUri   = errors.New("redirect uri is not registered for the client")
+	ErrUnsupportedResponse  = errors.New("response type must be code")
+	ErrInvalidScope         = errors.New("requested scope is not allowed for the client")
+	ErrCodeChallenge        = errors.New("a S256 code challenge is required")
+	ErrInvalidGrant         = errors.New("authorization grant is invalid or has expired")
+	ErrUnsupportedGrantType = errors.New("grant type is not supported")
+	ErrUnauthorizedClient   = errors.New("client is not allowed to use this grant type")
+	ErrPublicClient         = errors.New("public clients have no secret and cannot use the client credentials grant")
+	ErrClientNotFound       = errors.New("client not found")
+	ErrInvalidUserCode      = errors.New("the code is invalid or has expired")
+	ErrAuthorizationPending = errors.New("the user has not yet completed the authorization")
+	ErrSlowDown             = errors.New("polling too frequently, increase the interval")
+	ErrExpiredToken         = errors.New("the device code has expired")
+	ErrAccessDenied         = errors.New("the user denied the authorization")
+	ErrOIDCSigningAlgorithm = errors.New("OpenID Connect needs an asymmetric JWT_ALGORITHM such as RS256, ES256 or EdDSA")
+	ErrUnknownProvider      = errors.New("identity provider is not configured")
+	ErrFederatedLogin       = errors.New("login with the identity provider failed or has expired")
+	ErrAccountNotLinked     = errors.New("no account is linked to this identity")
+	ErrDirectoryUnavailable = errors.New("the user directory is unavailable, please try again later")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrTokenReuse           = errors.New("refresh token was already used, all sessions of this login were revoked")
+	ErrSigningKey           = errors.New("failed to load or rotate the signing key")
+	ErrKeyRingDisabled      = errors.New("signing key rotation is not configured")
+	ErrPasskeyDisabled      = errors.New("passkeys are not configured")
+	ErrPasskey              = errors.New("passkey verification failed or has expired")
+	ErrPasskeyNotFound      = errors.New("passkey not found")
+	ErrPasskeyCloned        = errors.New("the passkey may have been cloned and was rejected")
+	ErrLastPasskey          = errors.New("the last passkey cannot be deleted while it is the two factor method")
+	ErrPasskeyPage          = errors.New("passkeys cannot be used on this page, sign in with one of your recovery codes")
+	ErrRecoveryCode         = errors.New("recovery code is invalid or was already used")
+	ErrTwoFactorDisabled    = errors.New("two factor authentication is not enabled")
+	ErrTOTPEnrollment       = errors.New("no TOTP enrollment is pending or it has expired, enable TOTP again")
+	ErrInvalidPhoneNumber   = errors.New("cell number must be in international format, for example +14155552671")
+	ErrPhoneNotVerified     = errors.New("the cell number has not been verified")
+	ErrSMSUnavailable       = errors.New("sending SMS is not configured")
+	ErrSendingSMS           = errors.New("failed sending SMS")
+	ErrSendMethod           = errors.New("send method must be EMAIL or SMS")
+	ErrSMSCooldown          = errors.New("a code was sent recently, try again later")
+	ErrInvalidMagicLink     = errors.New("sign in link is invalid, was already used or has expired")
+	ErrTOTPActive           = errors.New("TOTP is the second factor, disable two factor authentication before changing the method")
+	ErrTooManyAttempts      = errors.New("too many failed attempts, wait before trying again")
+	ErrAccountLocked        = errors.New("account is temporarily locked after too many failed attempts")
 )
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/federation"
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// FederationService logs users in with external OpenID Connect providers
+type FederationService struct {
+	db          *gorm.DB
+	userService *UserService
+	authService *AuthService
+	providers   map[string]*federation.Provider
+	// requestTime is how long the user has to come back from the provider
+	requestTime time.Duration
+}
+
+func NewFederationService(db *gorm.DB) *FederationService {
+	requestTime, err := time.ParseDuration(os.Getenv("FEDERATED_LOGIN_EXPIRY_TIME"))
+	if err != nil {
+		requestTime = 10 * time.Minute
+	}
+	callbackUrl := strings.TrimSuffix(os.Getenv("APP_URL"), "/") + "/api/v1/auth/federated/callback"
+	return &FederationService{
+		db:          db,
+		userService: NewUserService(db),
+		authService: NewAuthService(db),
+		providers:   federation.ProvidersFromEnv(callbackUrl),
+		requestTime: requestTime,
+	}
+}
+
+// RequestTime is how long a login started with StartLogin can be completed
+func (service *FederationService) RequestTime() time.Duration {
+	return service.requestTime
+}
+
+// Providers returns the names of the configured providers
+func (service *FederationService) Providers() []string {
+	names := make([]string, 0, len(service.providers))
+	for name := range service.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StartLogin returns the provider url to redirect the user to and the binding the browser must present on the callback
+func (service *FederationService) StartLogin(ctx context.Context, providerName string) (string, string, error) {
+	provider, ok := service.providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	state := utils.GenerateOpaqueToken(32)
+	nonce := utils.GenerateOpaqueToken(32)
+	binding := utils.GenerateOpaqueToken(32)
+	codeVerifier := utils.GenerateCodeVerifier()
+	redirectUrl, err := provider.AuthCodeURL(ctx, state, nonce, utils.CodeChallengeS256(codeVerifier))
+	if err != nil {
+		log.Println("Failed to start login with "+providerName+" ", err)
+		return "", "", ErrFederatedLogin
+	}
+
+	entity := models.FederatedLoginRequest{
+		StateHash:    utils.HashToken(state),
+		Provider:     providerName,
+		CodeVerifier: codeVerifier,
+		Nonce:        nonce,
+		BindingHash:  utils.HashToken(binding),
+		ExpireTime:   sql.NullTime{Time: time.Now().Add(service.requestTime), Valid: true},
+	}
+	if err := service.db.Create(&entity).Error; err != nil {
+		log.Println("Failed to create federated login request ", err)
+		return "", "", ErrFederatedLogin
+	}
+	return redirectUrl, binding, nil
+}
+
+// CompleteLogin handles the provider callback and logs in the linked user, two factor authentication still applies
+func (service *FederationService) CompleteLogin(ctx context.Context, state, code, binding, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	var entity models.FederatedLoginRequest
+	if err := service.db.Where("state_hash = ? AND expire_time > NOW()", utils.HashToken(state)).First(&entity).Error; err != nil {
+		return nil, ErrFederatedLogin
+	}
+	// Deleting first makes the state single use even when the callback is replayed concurrently
+	result := service.db.Unscoped().Delete(&models.FederatedLoginRequest{}, entity.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || entity.BindingHash != utils.HashToken(binding) {
+		return nil, ErrFederatedLogin
+	}
+
+	provider, ok := service.providers[entity.Provider]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	tokens, err := provider.Exchange(ctx, code, entity.CodeVerifier)
+	if err != nil {
+		log.Println("Failed to exchange code with "+entity.Provider+" ", err)
+		return nil, ErrFederatedLogin
+	}
+	claims, err := provider.VerifyIDToken(ctx, tokens.IdToken, entity.Nonce)
+	if err != nil {
+		log.Println("Rejected ID token from "+entity.Provider+" ", err)
+		return nil, ErrFederatedLogin
+	}
+
+	userDetails, err := service.linkedUser(provider.Config(), *claims)
+	if err != nil {
+		return nil, err
+	}
+	if !userDetails.Active {
+		return nil, ErrAccountNotActive
+	}
+	return service.authService.generateAuthResponse(*userDetails, ipAddress, userAgent)
+}
+
+// linkedUser finds the user linked to the external identity, linking or creating one when the provider allows it
+func (service *FederationService) linkedUser(config federation.ProviderConfig, claims federation.Claims) (*models.User, error) {
+	var identity models.FederatedIdentity
+	err := service.db.Where("provider = ? AND subject = ?", config.Name, claims.Subject).First(&identity).Error
+	if err == nil {
+		userDetails := service.userService.Get(int(identity.UserId))
+		if userDetails == nil {
+			return nil, ErrAccountNotLinked
+		}
+		return userDetails, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	// Only a verified email address proves the identity owns the local account
+	email := ""
+	if claims.EmailVerified {
+		email = claims.Email
+	}
+
+	var existing models.User
+	if email != "" {
+		err = service.db.Where("email_address = ?", email).First(&existing).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	switch {
+	case existing.ID != 0 && config.LinkByEmail:
+		if !existing.Active {
+			return nil, ErrAccountNotActive
+		}
+		if err := service.link(config.Name, claims, existing.ID); err != nil {
+			return nil, err
+		}
+		return service.userService.Get(int(existing.ID)), nil
+	case existing.ID == 0 && config.AutoProvision:
+		return service.provision(config.Name, claims, email)
+	}
+	return nil, ErrAccountNotLinked
+}
+
+func (service *FederationService) link(provider string, claims federation.Claims, userId uint) error {
+	identity := models.FederatedIdentity{UserId: userId, Provider: provider, Subject: claims.Subject, Email: claims.Email}
+	if err := service.db.Create(&identity).Error; err != nil {
+		log.Println("Failed to link federated identity ", err)
+		return ErrFederatedLogin
+	}
+	return nil
+}
+
+// provision creates an active user without a password for the external identity and links it
+func (service *FederationService) provision(provider string, claims federation.Claims, email string) (*models.User, error) {
+	username := email
+	if username == "" {
+		username = claims.PreferredUsername
+	}
+	var count int64
+	if username != "" {
+		if err := service.db.Model(&models.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+			return nil, err
+		}
+	}
+	if username == "" || count > 0 {
+		username = provider + ":" + claims.Subject
+	}
+
+	user := &models.User{
+		UUID:         utils.GenerateUUID(),
+		Username:     username,
+		EmailAddress: email,
+		FirstName:    claims.GivenName,
+		LastName:     claims.FamilyName,
+		Source:       UserSourceFederated,
+		Active:       true,
+		Metadata:     models.JSONB{},
+	}
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		if err := createWithDefaultRole(db, user); err != nil {
+			return err
+		}
+		return db.Create(&models.FederatedIdentity{UserId: user.ID, Provider: provider, Subject: claims.Subject, Email: claims.Email}).Error
+	})
+	if err != nil {
+		log.Println("Failed to provision federated user ", err)
+		return nil, ErrFederatedLogin
+	}
+	return service.userService.Get(int(user.ID)), nil
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// JWKSCacheTTL is how long verifiers may cache the published keys
+const JWKSCacheTTL = 5 * time.Minute
+
+// KeyService manages the JWT signing key ring, key material is kept in keyDir and metadata in jwt_signing_keys
+type KeyService struct {
+	db               *gorm.DB
+	keyDir           string
+	algorithm        string
+	rotationInterval time.Duration
+	maxTokenLifetime time.Duration
+	// publishDelay is how long a new key is published before it signs, so every cached key set and instance has it
+	publishDelay time.Duration
+}
+
+func NewKeyService(db *gorm.DB) *KeyService {
+	algorithm := os.Getenv("JWT_ALGORITHM")
+	if algorithm == "" {
+		algorithm = "ES256"
+	}
+	rotationInterval, err := time.ParseDuration(os.Getenv("JWT_KEY_ROTATION_INTERVAL"))
+	if err != nil {
+		rotationInterval = 30 * 24 * time.Hour
+	}
+	// Keys must verify for as long as the longest lived token they signed, access or ID token
+	maxTokenLifetime, err := time.ParseDuration(os.Getenv("TOKEN_EXPIRY_TIME"))
+	if err != nil || maxTokenLifetime < 5*time.Minute {
+		maxTokenLifetime = 5 * time.Minute
+	}
+	idTokenLifetime, err := time.ParseDuration(os.Getenv("ID_TOKEN_EXPIRY_TIME"))
+	if err != nil {
+		idTokenLifetime = time.Hour
+	}
+	if idTokenLifetime > maxTokenLifetime {
+		maxTokenLifetime = idTokenLifetime
+	}
+	// Every instance must have reloaded the ring before a new key signs
+	reloadInterval, err := time.ParseDuration(os.Getenv("JWT_KEY_REFRESH_INTERVAL"))
+	if err != nil || reloadInterval <= 0 {
+		reloadInterval = time.Minute
+	}
+	return &KeyService{
+		db:               db,
+		keyDir:           os.Getenv("JWT_KEY_DIR"),
+		algorithm:        algorithm,
+		rotationInterval: rotationInterval,
+		maxTokenLifetime: maxTokenLifetime,
+		publishDelay:     JWKSCacheTTL + reloadInterval,
+	}
+}
+
+// Enabled reports whether the key ring is configured, otherwise the static key from JWT_PRIVATE_KEY_FILE is used
+func (service *KeyService) Enabled() bool {
+	return service.keyDir != ""
+}
+
+// LoadKeyRing loads every key that has not expired into the signer, a first key is created when the ring is empty
+func (service *KeyService) LoadKeyRing() error {
+	keys, err := service.activeKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		_, err := service.Rotate()
+		return err
+	}
+
+	var (
+		signing      *utils.SigningKey
+		verification []*utils.SigningKey
+	)
+	for _, entity := range keys {
+		pemBytes, err := os.ReadFile(entity.KeyFile)
+		if err != nil {
+			log.Println("Failed to read signing key ", entity.KeyId, err)
+			continue
+		}
+		key, err := utils.ParseSigningKeyFromPEM(entity.KeyId, entity.Algorithm, pemBytes)
+		if err != nil {
+			log.Println("Failed to parse signing key ", entity.KeyId, err)
+			continue
+		}
+		// Keys are ordered newest first, the newest key that is active and not retired signs
+		if signing == nil && isSigningKey(entity, time.Now()) {
+			signing = key
+		}
+		verification = append(verification, key)
+	}
+	if signing == nil {
+		return ErrSigningKey
+	}
+
+	utils.SetJwtKeys(signing, verification)
+	return nil
+}
+
+// isSigningKey reports whether the key signs at the time, keys created before ActiveAt existed sign right away
+func isSigningKey(entity models.JwtSigningKey, at time.Time) bool {
+	active := !entity.ActiveAt.Valid || !entity.ActiveAt.Time.After(at)
+	retired := entity.RetiredAt.Valid && !entity.RetiredAt.Time.After(at)
+	return active && !retired
+}
+
+// Rotate creates a new signing key, it is published for publishDelay before it replaces the current key
+// The previous key keeps verifying until the longest lived token it signed has expired
+func (service *KeyService) Rotate() (*models.JwtSigningKey, error) {
+	key, err := utils.GenerateSigningKey(service.algorithm)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrSigningKey
+	}
+	pemBytes, err := key.PrivateKeyPEM()
+	if err != nil {
+		log.Println(err)
+		return nil, ErrSigningKey
+	}
+
+	if err := os.MkdirAll(service.keyDir, 0700); err != nil {
+		log.Println(err)
+		return nil, ErrSigningKey
+	}
+	keyFile := filepath.Join(service.keyDir, key.Id+".pem")
+	if err := os.WriteFile(keyFile, pemBytes, 0600); err != nil {
+		log.Println(err)
+		return nil, ErrSigningKey
+	}
+
+	entity := models.JwtSigningKey{KeyId: key.Id, Algorithm: key.Algorithm, KeyFile: keyFile}
+	err = utils.Transaction(service.db, func(db *gorm.DB) error {
+		var current int64
+		if err := db.Model(&models.JwtSigningKey{}).Where("retired_at IS NULL").Count(&current).Error; err != nil {
+			return err
+		}
+		// The first key signs right away, no token can depend on a cached key set yet
+		activeAt := time.Now()
+		if current > 0 {
+			activeAt = activeAt.Add(service.publishDelay)
+		}
+		entity.ActiveAt = sql.NullTime{Time: activeAt, Valid: true}
+
+		retire := map[string]interface{}{
+			"retired_at":  sql.NullTime{Time: activeAt, Valid: true},
+			"expire_time": sql.NullTime{Time: activeAt.Add(service.maxTokenLifetime), Valid: true},
+		}
+		if err := db.Model(&models.JwtSigningKey{}).Where("retired_at IS NULL").Updates(retire).Error; err != nil {
+			return err
+		}
+		return db.Create(&entity).Error
+	})
+	if err != nil {
+		log.Println("Failed to store signing key ", err)
+		_ = os.Remove(keyFile)
+		return nil, ErrSigningKey
+	}
+
+	log.Println("Rotated JWT signing key, new key id " + key.Id)
+	if err := service.LoadKeyRing(); err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+// RotateIfDue rotates when the current signing key is older than the rotation interval
+func (service *KeyService) RotateIfDue() error {
+	var current models.JwtSigningKey
+	err := service.db.Where("retired_at IS NULL").Order("created_at DESC").First(&current).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if err == nil && time.Since(current.CreatedAt) < service.rotationInterval {
+		return nil
+	}
+	_, err = service.Rotate()
+	return err
+}
+
+// DeleteExpiredKeys removes keys whose verification window has passed together with their key files
+func (service *KeyService) DeleteExpiredKeys() error {
+	var expired []models.JwtSigningKey
+	if err := service.db.Where("expire_time < NOW()").Find(&expired).Error; err != nil {
+		return err
+	}
+	for _, entity := range expired {
+		if err := service.db.Unscoped().Delete(&entity).Error; err != nil {
+			return err
+		}
+		if err := os.Remove(entity.KeyFile); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove key file ", err)
+		}
+	}
+	return nil
+}
+
+// List returns the keys that can still verify tokens, newest first
+func (service *KeyService) List() ([]models.SigningKeyResponse, error) {
+	keys, err := service.activeKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	response := make([]models.SigningKeyResponse, 0, len(keys))
+	for _, entity := range keys {
+		key := models.SigningKeyResponse{
+			KeyId:     entity.KeyId,
+			Algorithm: entity.Algorithm,
+			Current:   isSigningKey(entity, now),
+			CreatedAt: entity.CreatedAt,
+		}
+		if entity.ActiveAt.Valid {
+			key.ActiveAt = &entity.ActiveAt.Time
+		}
+		if entity.RetiredAt.Valid {
+			key.RetiredAt = &entity.RetiredAt.Time
+		}
+		if entity.ExpireTime.Valid {
+			key.ExpireTime = &entity.ExpireTime.Time
+		}
+		response = append(response, key)
+	}
+	return response, nil
+}
+
+func (service *KeyService) activeKeys() ([]models.JwtSigningKey, error) {
+	var keys []models.JwtSigningKey
+	err := service.db.Where("expire_time IS NULL OR expire_time > NOW()").Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
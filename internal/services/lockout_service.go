@@ -0,0 +1,216 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// Security event types of account lockouts
+const (
+	EventAccountLocked   = "ACCOUNT_LOCKED"
+	EventAccountUnlocked = "ACCOUNT_UNLOCKED"
+)
+
+// LockoutService slows down and then stops guessing of passwords and codes
+// Every failure doubles the wait before the next attempt, after maxAttempts failures the user is locked out for
+// lockoutTime and a code request stops accepting codes
+type LockoutService struct {
+	db                   *gorm.DB
+	emailService         *EmailService
+	securityEventService *SecurityEventService
+	// maxAttempts is how many failures lock the user out
+	maxAttempts int
+	// requestMaxAttempts is how many wrong codes a single code request accepts
+	requestMaxAttempts int
+	lockoutTime        time.Duration
+	baseDelay          time.Duration
+	maxDelay           time.Duration
+}
+
+func NewLockoutService(db *gorm.DB) *LockoutService {
+	maxAttempts, err := strconv.Atoi(os.Getenv("LOCKOUT_MAX_ATTEMPTS"))
+	if err != nil || maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+	requestMaxAttempts, err := strconv.Atoi(os.Getenv("LOCKOUT_REQUEST_MAX_ATTEMPTS"))
+	if err != nil || requestMaxAttempts <= 0 {
+		requestMaxAttempts = 5
+	}
+	lockoutTime, err := time.ParseDuration(os.Getenv("LOCKOUT_TIME"))
+	if err != nil {
+		lockoutTime = 15 * time.Minute
+	}
+	baseDelay, err := time.ParseDuration(os.Getenv("LOCKOUT_BASE_DELAY"))
+	if err != nil {
+		baseDelay = time.Second
+	}
+	maxDelay, err := time.ParseDuration(os.Getenv("LOCKOUT_MAX_DELAY"))
+	if err != nil {
+		maxDelay = 30 * time.Second
+	}
+	return &LockoutService{
+		db:                   db,
+		emailService:         NewEmailService(true),
+		securityEventService: NewSecurityEventService(db),
+		maxAttempts:          maxAttempts,
+		requestMaxAttempts:   requestMaxAttempts,
+		lockoutTime:          lockoutTime,
+		baseDelay:            baseDelay,
+		maxDelay:             maxDelay,
+	}
+}
+
+func userAttemptKey(userId uint) string {
+	return "user:" + strconv.FormatUint(uint64(userId), 10)
+}
+
+func requestAttemptKey(requestId string) string {
+	return "request:" + requestId
+}
+
+func deviceAttemptKey(ipAddress string) string {
+	return "device:" + ipAddress
+}
+
+// Check returns ErrAccountLocked while the user is locked out and ErrTooManyAttempts while the user or the
+// code request must wait after a failure or the request has no attempts left. The request id may be empty
+func (service *LockoutService) Check(userId uint, requestId string) error {
+	keys := []string{userAttemptKey(userId)}
+	if requestId != "" {
+		keys = append(keys, requestAttemptKey(requestId))
+	}
+	return service.check(keys)
+}
+
+// CheckUserCode returns ErrTooManyAttempts while the client address must wait after a wrong device user code or
+// has no attempts left
+func (service *LockoutService) CheckUserCode(ipAddress string) error {
+	return service.check([]string{deviceAttemptKey(ipAddress)})
+}
+
+// FailUserCode counts a wrong device user code for the client address, codes are not tied to a user
+// Successes do not reset the count, a code of the own device would otherwise allow guessing forever
+func (service *LockoutService) FailUserCode(ipAddress string) {
+	if attempt, ok := service.increment(deviceAttemptKey(ipAddress), 0); ok && attempt.Failures >= service.maxAttempts {
+		service.lock(attempt)
+	}
+}
+
+// check returns ErrAccountLocked when the first key is a user that is locked out and ErrTooManyAttempts when a key
+// must wait or is locked out
+func (service *LockoutService) check(keys []string) error {
+	var attempts []models.FailedAttempt
+	if err := service.db.Where("attempt_key IN ?", keys).Find(&attempts).Error; err != nil {
+		log.Println("Failed to load failed attempts ", err)
+		return ErrServer
+	}
+
+	now := time.Now()
+	for _, attempt := range attempts {
+		if attempt.LockedUntil.Valid {
+			if attempt.LockedUntil.Time.After(now) {
+				if strings.HasPrefix(attempt.AttemptKey, "user:") {
+					return ErrAccountLocked
+				}
+				return ErrTooManyAttempts
+			}
+			// The lockout is over, the next failure starts counting again
+			continue
+		}
+		delay := utils.BackoffDelay(attempt.Failures, service.baseDelay, service.maxDelay)
+		if attempt.LastFailureAt.Valid && attempt.LastFailureAt.Time.Add(delay).After(now) {
+			return ErrTooManyAttempts
+		}
+	}
+	return nil
+}
+
+// Fail counts a wrong password or code for the user and the code request, the request id may be empty
+// The user gets an email the moment they are locked out
+func (service *LockoutService) Fail(userDetails models.User, requestId, ipAddress, userAgent string) {
+	if attempt, ok := service.increment(userAttemptKey(userDetails.ID), userDetails.ID); ok && attempt.Failures >= service.maxAttempts {
+		if lockedUntil, locked := service.lock(attempt); locked {
+			service.securityEventService.Record(userDetails.ID, EventAccountLocked, ipAddress, userAgent,
+				models.JSONB{"failures": attempt.Failures, "lockedUntil": lockedUntil})
+			if err := service.emailService.SendAccountLocked(lockedUntil, ipAddress, userDetails); err != nil {
+				log.Println("Failed to send the account locked notification ", err)
+			}
+		}
+	}
+	if requestId == "" {
+		return
+	}
+	if attempt, ok := service.increment(requestAttemptKey(requestId), userDetails.ID); ok && attempt.Failures >= service.requestMaxAttempts {
+		service.lock(attempt)
+	}
+}
+
+// Succeed forgets the failures of the user and of the code request after a successful attempt
+func (service *LockoutService) Succeed(userId uint, requestId string) {
+	keys := []string{userAttemptKey(userId)}
+	if requestId != "" {
+		keys = append(keys, requestAttemptKey(requestId))
+	}
+	// A lockout that is still running is only lifted by Unlock
+	if err := service.db.Unscoped().Where("attempt_key IN ? AND (locked_until IS NULL OR locked_until <= NOW())", keys).Delete(&models.FailedAttempt{}).Error; err != nil {
+		log.Println("Failed to reset failed attempts ", err)
+	}
+}
+
+// Unlock lifts the lockout of the user with the UUID before it expires
+func (service *LockoutService) Unlock(userUUID, ipAddress, userAgent string) error {
+	var user models.User
+	if err := service.db.Select("id").Where("uuid = ?", userUUID).First(&user).Error; err != nil {
+		log.Println(err)
+		return ErrUserNotFound
+	}
+	if err := service.db.Unscoped().Where("attempt_key = ?", userAttemptKey(user.ID)).Delete(&models.FailedAttempt{}).Error; err != nil {
+		log.Println("Failed to unlock user ", err)
+		return ErrServer
+	}
+	service.securityEventService.Record(user.ID, EventAccountUnlocked, ipAddress, userAgent, nil)
+	return nil
+}
+
+// increment adds a failure to the key in one statement, so concurrent failures are all counted
+// Once a lockout has expired the count starts again at one
+func (service *LockoutService) increment(key string, userId uint) (models.FailedAttempt, bool) {
+	var attempt models.FailedAttempt
+	err := service.db.Raw(`INSERT INTO failed_attempts (created_at, updated_at, attempt_key, user_id, failures, last_failure_at, expire_time)
+		VALUES (NOW(), NOW(), ?, ?, 1, NOW(), NOW())
+		ON CONFLICT (attempt_key) DO UPDATE SET
+			failures = CASE WHEN failed_attempts.locked_until <= NOW() THEN 1 ELSE failed_attempts.failures + 1 END,
+			locked_until = CASE WHEN failed_attempts.locked_until <= NOW() THEN NULL ELSE failed_attempts.locked_until END,
+			last_failure_at = NOW(),
+			expire_time = GREATEST(failed_attempts.locked_until, NOW()),
+			updated_at = NOW()
+		RETURNING *`, key, userId).Scan(&attempt).Error
+	if err != nil {
+		log.Println("Failed to count failed attempt ", err)
+		return attempt, false
+	}
+	return attempt, true
+}
+
+// lock locks the key out, it reports false when another request already did
+func (service *LockoutService) lock(attempt models.FailedAttempt) (time.Time, bool) {
+	lockedUntil := time.Now().Add(service.lockoutTime)
+	result := service.db.Model(&models.FailedAttempt{}).Where("id = ? AND locked_until IS NULL", attempt.ID).
+		Updates(map[string]interface{}{
+			"locked_until": sql.NullTime{Time: lockedUntil, Valid: true},
+			"expire_time":  sql.NullTime{Time: lockedUntil, Valid: true},
+		})
+	if result.Error != nil {
+		log.Println("Failed to lock ", result.Error)
+		return lockedUntil, false
+	}
+	return lockedUntil, result.RowsAffected == 1
+}
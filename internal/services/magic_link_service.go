@@ -0,0 +1,163 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// MagicLinkService logs users in with a signed single use link sent by email
+type MagicLinkService struct {
+	db           *gorm.DB
+	authService  *AuthService
+	userService  *UserService
+	emailService *EmailService
+	secret       []byte
+	appURL       string
+	// redirectURL is where the landing endpoint sends the browser, with the tokens in the fragment
+	redirectURL string
+	expiry      time.Duration
+	// bindBrowser requires the link to be opened in the browser that asked for it
+	bindBrowser bool
+}
+
+func NewMagicLinkService(db *gorm.DB) *MagicLinkService {
+	expiry, err := time.ParseDuration(os.Getenv("MAGIC_LINK_EXPIRY_TIME"))
+	if err != nil {
+		expiry = 15 * time.Minute
+	}
+	appURL := strings.TrimSuffix(os.Getenv("APP_URL"), "/")
+	redirectURL := os.Getenv("MAGIC_LINK_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = appURL
+	}
+	return &MagicLinkService{
+		db:           db,
+		authService:  NewAuthService(db),
+		userService:  NewUserService(db),
+		emailService: NewEmailService(true),
+		secret:       []byte(os.Getenv("MAGIC_LINK_SECRET")),
+		appURL:       appURL,
+		redirectURL:  redirectURL,
+		expiry:       expiry,
+		bindBrowser:  os.Getenv("MAGIC_LINK_BIND_BROWSER") == "true",
+	}
+}
+
+// Expiry returns how long a link can be used
+func (service *MagicLinkService) Expiry() time.Duration {
+	return service.expiry
+}
+
+// Send emails a sign in link to the user, the binding is empty unless links must be opened in the same browser
+func (service *MagicLinkService) Send(username, ipAddress, userAgent string) (*models.PasswordLessAuthResponse, string, error) {
+	// CheckSecrets stops the server from starting without it, this guards against signing with an empty key anyway
+	if len(service.secret) == 0 {
+		return nil, "", ErrServer
+	}
+	userDetails := service.userService.GetByUsername(username)
+	if userDetails == nil {
+		return nil, "", ErrInvalidUsername
+	}
+	if !userDetails.Active {
+		return nil, "", ErrAccountNotActive
+	}
+
+	requestId := utils.GenerateOpaqueToken(45)
+	code := utils.GenerateRandomDigits(6)
+	expires := time.Now().Add(service.expiry)
+	token := utils.GenerateSignedToken(service.secret, requestId+":"+code, expires)
+
+	var binding, bindingHash string
+	if service.bindBrowser {
+		binding = utils.GenerateOpaqueToken(32)
+		bindingHash = utils.HashToken(binding)
+	}
+
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		otpRequest := models.OTPRequest{
+			UserId:      userDetails.ID,
+			RequestId:   requestId,
+			Code:        code,
+			SendMethod:  "LINK",
+			ExpireTime:  sql.NullTime{Time: expires, Valid: true},
+			IpAddress:   ipAddress,
+			UserAgent:   userAgent,
+			BindingHash: bindingHash,
+		}
+		if err := db.Create(&otpRequest).Error; err != nil {
+			return err
+		}
+
+		link := service.appURL + "/api/v1/auth/passwordless/link?token=" + url.QueryEscape(token)
+		if err := service.emailService.SendMagicLink(link, service.expiry, *userDetails); err != nil {
+			return ErrSendingMail
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to send magic link ", err)
+		return nil, "", err
+	}
+
+	return &models.PasswordLessAuthResponse{RequestId: requestId, SendMethod: "LINK"}, binding, nil
+}
+
+// CompleteLogin checks the link and the browser binding and logs the user in, a link is accepted only once
+func (service *MagicLinkService) CompleteLogin(token, binding string) (*models.AuthenticationResponse, error) {
+	if len(service.secret) == 0 {
+		return nil, ErrInvalidMagicLink
+	}
+	payload, err := utils.ParseSignedToken(service.secret, token)
+	if err != nil {
+		return nil, ErrInvalidMagicLink
+	}
+	requestId, code, found := strings.Cut(payload, ":")
+	if !found {
+		return nil, ErrInvalidMagicLink
+	}
+
+	var otpRequest models.OTPRequest
+	if err := service.db.Select("binding_hash").Where("request_id = ? AND send_method = ?", requestId, "LINK").First(&otpRequest).Error; err != nil {
+		return nil, ErrInvalidMagicLink
+	}
+	if otpRequest.BindingHash != "" && otpRequest.BindingHash != utils.HashToken(binding) {
+		return nil, ErrInvalidMagicLink
+	}
+
+	response, err := service.authService.completePasswordLessLogin(code, requestId, true)
+	if errors.Is(err, ErrInvalidCode) {
+		return nil, ErrInvalidMagicLink
+	}
+	return response, err
+}
+
+// RedirectURL returns where to send the browser after the link was opened
+// The tokens or the error go in the fragment so they are not sent to servers or written to their logs
+func (service *MagicLinkService) RedirectURL(response *models.AuthenticationResponse, err error) string {
+	values := url.Values{}
+	if err != nil {
+		values.Set("error", err.Error())
+	} else {
+		values.Set("token", response.Token)
+		if response.RefreshToken != "" {
+			values.Set("refresh_token", response.RefreshToken)
+		}
+		if response.Expires != 0 {
+			values.Set("expires_in", strconv.Itoa(response.Expires))
+		}
+		if response.TwoFactorEnabled {
+			values.Set("two_factor_method", response.TwoFactorMethod)
+		}
+	}
+	return service.redirectURL + "#" + values.Encode()
+}
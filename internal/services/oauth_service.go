@@ -0,0 +1,377 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// Token type hints defined by RFC 7009 and RFC 7662
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// CodeChallengeMethodS256 is the only PKCE method accepted, plain challenges are rejected
+const CodeChallengeMethodS256 = "S256"
+
+// OAuthService implements the OAuth 2.0 endpoints on top of the tokens issued by AuthService
+type OAuthService struct {
+	db                *gorm.DB
+	userService       *UserService
+	authService       *AuthService
+	clientService     *ClientService
+	oidcService       *OIDCService
+	revocationService *RevocationService
+	codeTime          time.Duration
+	tokenTime         time.Duration
+}
+
+func NewOAuthService(db *gorm.DB) *OAuthService {
+	codeTime, err := time.ParseDuration(os.Getenv("AUTHORIZATION_CODE_EXPIRY_TIME"))
+	if err != nil {
+		codeTime = time.Minute
+	}
+	tokenTime, _ := time.ParseDuration(os.Getenv("TOKEN_EXPIRY_TIME"))
+	return &OAuthService{
+		db:                db,
+		userService:       NewUserService(db),
+		authService:       NewAuthService(db),
+		clientService:     NewClientService(db),
+		oidcService:       NewOIDCService(db),
+		revocationService: NewRevocationService(db),
+		codeTime:          codeTime,
+		tokenTime:         tokenTime,
+	}
+}
+
+// ValidateAuthorizationRequest checks the request against the registered client and fills in the default redirect uri and scope
+// ErrInvalidClient and ErrInvalidRedirectUri must not be reported by redirecting, the redirect uri cannot be trusted
+func (service *OAuthService) ValidateAuthorizationRequest(request *models.AuthorizationRequest) (*models.OAuthClient, error) {
+	client, err := service.clientService.Get(request.ClientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.RedirectUri == "" && len(client.RedirectUris) == 1 {
+		request.RedirectUri = client.RedirectUris[0]
+	}
+	if !client.RedirectUris.Contains(request.RedirectUri) {
+		return nil, ErrInvalidRedirectUri
+	}
+
+	if !allowsGrant(*client, GrantTypeAuthorizationCode) {
+		return client, ErrUnauthorizedClient
+	}
+
+	if request.ResponseType != "code" {
+		return client, ErrUnsupportedResponse
+	}
+	// A S256 challenge is the base64url encoding of a SHA-256 hash
+	if request.CodeChallengeMethod != CodeChallengeMethodS256 || len(request.CodeChallenge) != 43 {
+		return client, ErrCodeChallenge
+	}
+
+	scope, err := grantedScope(*client, request.Scope)
+	if err != nil {
+		return client, err
+	}
+	request.Scope = scope
+	return client, nil
+}
+
+// grantedScope checks the requested scope against the client, an empty request grants every scope of the client
+// The openid scope is only granted when OpenID Connect is enabled
+func grantedScope(client models.OAuthClient, requested string) (string, error) {
+	if strings.TrimSpace(requested) == "" {
+		var scopes []string
+		for _, scope := range client.Scopes {
+			if scope != ScopeOpenId || oidcEnabled() {
+				scopes = append(scopes, scope)
+			}
+		}
+		return strings.Join(scopes, " "), nil
+	}
+
+	var scopes []string
+	for _, scope := range strings.Fields(requested) {
+		if !client.Scopes.Contains(scope) || (scope == ScopeOpenId && !oidcEnabled()) {
+			return "", ErrInvalidScope
+		}
+		if !models.StringList(scopes).Contains(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// CreateAuthorizationCode issues a single use code for a validated authorization request approved by the user
+func (service *OAuthService) CreateAuthorizationCode(request models.AuthorizationRequest, userId uint) (string, error) {
+	code := utils.GenerateOpaqueToken(45)
+	entity := models.AuthorizationCode{
+		CodeHash:        utils.HashToken(code),
+		ClientId:        request.ClientId,
+		UserId:          userId,
+		RedirectUri:     request.RedirectUri,
+		RedirectUriSent: request.RedirectUriSent,
+		Scope:           request.Scope,
+		CodeChallenge:   request.CodeChallenge,
+		Nonce:           request.Nonce,
+		ExpireTime:      sql.NullTime{Time: time.Now().Add(service.codeTime), Valid: true},
+	}
+	if err := service.db.Create(&entity).Error; err != nil {
+		log.Println("Failed to create authorization code ", err)
+		return "", ErrTokenGeneration
+	}
+	return code, nil
+}
+
+// ExchangeAuthorizationCode redeems the code for tokens, the code verifier must match the challenge it was issued for
+// An ID token is included when the openid scope was granted
+func (service *OAuthService) ExchangeAuthorizationCode(client models.OAuthClient, code, redirectUri, codeVerifier, ipAddress, userAgent string) (*models.TokenResponse, error) {
+	var entity models.AuthorizationCode
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		if err := db.Where("code_hash = ?", utils.HashToken(code)).First(&entity).Error; err != nil {
+			return ErrInvalidGrant
+		}
+		// Deleting first makes the code single use even when it is redeemed concurrently
+		result := db.Unscoped().Delete(&entity)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidGrant
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if entity.ClientId != client.ClientId || !entity.ExpireTime.Valid || entity.ExpireTime.Time.Before(time.Now()) {
+		return nil, ErrInvalidGrant
+	}
+	// The redirect uri is required once it was sent to the authorization endpoint and must match exactly
+	if (entity.RedirectUriSent || redirectUri != "") && redirectUri != entity.RedirectUri {
+		return nil, ErrInvalidGrant
+	}
+	if !utils.VerifyCodeChallenge(codeVerifier, entity.CodeChallenge) {
+		return nil, ErrInvalidGrant
+	}
+
+	userDetails := service.userService.Get(int(entity.UserId))
+	if userDetails == nil || !userDetails.Active {
+		return nil, ErrInvalidGrant
+	}
+	response, err := service.authService.GenerateClientTokens(*userDetails, client.ClientId, entity.Scope, ipAddress, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	tokenResponse := newTokenResponse(*response)
+
+	if models.StringList(strings.Fields(entity.Scope)).Contains(ScopeOpenId) {
+		// The user authenticated right before the code was issued
+		tokenResponse.IdToken, err = service.oidcService.GenerateIDToken(*userDetails, client.ClientId, entity.Scope, entity.Nonce, entity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tokenResponse, nil
+}
+
+// RefreshClientToken rotates a refresh token issued to the client, the new tokens keep the original scope
+func (service *OAuthService) RefreshClientToken(client models.OAuthClient, refreshToken, ipAddress, userAgent string) (*models.TokenResponse, error) {
+	if !allowsGrant(client, GrantTypeRefreshToken) {
+		return nil, ErrUnauthorizedClient
+	}
+	response, err := service.authService.GenerateClientRefreshToken(refreshToken, client.ClientId, ipAddress, userAgent)
+	if errors.Is(err, ErrInvalidToken) || errors.Is(err, ErrTokenReuse) || errors.Is(err, ErrAccountNotActive) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+	tokenResponse := newTokenResponse(*response)
+	return &tokenResponse, nil
+}
+
+// ClientCredentials issues an access token to the client itself (RFC 6749 section 4.4), no refresh token is issued
+func (service *OAuthService) ClientCredentials(client models.OAuthClient, scope string) (*models.TokenResponse, error) {
+	if client.Public || !allowsGrant(client, GrantTypeClientCredentials) {
+		return nil, ErrUnauthorizedClient
+	}
+	grantedScope, err := grantedScope(client, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := utils.GenerateClientCredentialsJwtToken(client.ClientId, grantedScope, service.tokenTime)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrAccessToken
+	}
+	return &models.TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(service.tokenTime.Seconds()),
+		Scope:       grantedScope,
+	}, nil
+}
+
+func newTokenResponse(response models.AuthenticationResponse) models.TokenResponse {
+	return models.TokenResponse{
+		AccessToken:  response.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    response.Expires,
+		RefreshToken: response.RefreshToken,
+		Scope:        response.Scope,
+	}
+}
+
+// Introspect describes the token per RFC 7662, tokens that are invalid for any reason are reported as inactive
+// A client only learns about tokens issued to itself, any other token is reported inactive
+func (service *OAuthService) Introspect(client models.OAuthClient, token, tokenTypeHint string) models.IntrospectionResponse {
+	response := service.introspect(token, tokenTypeHint)
+	if response.Active && response.ClientId != client.ClientId {
+		return models.IntrospectionResponse{Active: false}
+	}
+	return response
+}
+
+func (service *OAuthService) introspect(token, tokenTypeHint string) models.IntrospectionResponse {
+	// The hint only decides which lookup is tried first
+	if tokenTypeHint == TokenTypeHintRefreshToken {
+		if response, ok := service.introspectRefreshToken(token); ok {
+			return response
+		}
+		if response, ok := service.introspectAccessToken(token); ok {
+			return response
+		}
+	} else {
+		if response, ok := service.introspectAccessToken(token); ok {
+			return response
+		}
+		if response, ok := service.introspectRefreshToken(token); ok {
+			return response
+		}
+	}
+	return models.IntrospectionResponse{Active: false}
+}
+
+func (service *OAuthService) introspectAccessToken(token string) (models.IntrospectionResponse, bool) {
+	claims, err := utils.ValidateJwtAndGetClaims(token)
+	if err != nil {
+		return models.IntrospectionResponse{}, false
+	}
+	jti, _ := claims["jti"].(string)
+	userId, _ := claims["userId"].(int)
+	issuedAt, _ := claims["iat"].(time.Time)
+	expires, _ := claims["exp"].(time.Time)
+	roles, _ := claims["roles"].([]string)
+	scope, _ := claims["scope"].(string)
+	clientId, _ := claims["clientId"].(string)
+	if service.revocationService.IsRevoked(jti, userId, clientId, issuedAt) {
+		return models.IntrospectionResponse{Active: false}, true
+	}
+
+	if claims["subjectType"] == utils.SubjectTypeClient {
+		if _, err := service.clientService.Get(clientId); err != nil {
+			return models.IntrospectionResponse{Active: false}, true
+		}
+		return models.IntrospectionResponse{
+			Active:    true,
+			TokenType: TokenTypeHintAccessToken,
+			Sub:       clientId,
+			Aud:       utils.AccessTokenAudience,
+			Jti:       jti,
+			Scope:     scope,
+			ClientId:  clientId,
+			Iat:       issuedAt.Unix(),
+			Exp:       expires.Unix(),
+		}, true
+	}
+
+	userDetails := service.userService.Get(userId)
+	if userDetails == nil || !userDetails.Active {
+		return models.IntrospectionResponse{Active: false}, true
+	}
+
+	return models.IntrospectionResponse{
+		Active:    true,
+		TokenType: TokenTypeHintAccessToken,
+		Sub:       userDetails.UUID,
+		Username:  userDetails.Username,
+		Aud:       utils.AccessTokenAudience,
+		Jti:       jti,
+		Scope:     scope,
+		ClientId:  clientId,
+		Iat:       issuedAt.Unix(),
+		Exp:       expires.Unix(),
+		Roles:     roles,
+	}, true
+}
+
+func (service *OAuthService) introspectRefreshToken(token string) (models.IntrospectionResponse, bool) {
+	var refreshToken models.UserRefreshToken
+	if err := service.db.Where("token = ?", utils.HashToken(token)).First(&refreshToken).Error; err != nil {
+		return models.IntrospectionResponse{}, false
+	}
+	if refreshToken.RotatedAt.Valid || !refreshToken.ExpireTime.Valid || refreshToken.ExpireTime.Time.Before(time.Now()) {
+		return models.IntrospectionResponse{Active: false}, true
+	}
+
+	userDetails := service.userService.Get(int(refreshToken.UserId))
+	if userDetails == nil || !userDetails.Active {
+		return models.IntrospectionResponse{Active: false}, true
+	}
+
+	return models.IntrospectionResponse{
+		Active:    true,
+		TokenType: TokenTypeHintRefreshToken,
+		Sub:       userDetails.UUID,
+		Username:  userDetails.Username,
+		Scope:     refreshToken.Scope,
+		ClientId:  refreshToken.ClientId,
+		Iat:       refreshToken.CreatedAt.Unix(),
+		Exp:       refreshToken.ExpireTime.Time.Unix(),
+		Roles:     getRoles(*userDetails),
+	}, true
+}
+
+// Revoke revokes the token per RFC 7009, unknown or invalid tokens are not an error
+// Tokens issued to another client are left alone, the client cannot tell them from unknown tokens
+func (service *OAuthService) Revoke(client models.OAuthClient, token, tokenTypeHint string) error {
+	if tokenTypeHint != TokenTypeHintAccessToken {
+		var refreshToken models.UserRefreshToken
+		if err := service.db.Where("token = ?", utils.HashToken(token)).First(&refreshToken).Error; err == nil {
+			if refreshToken.ClientId != client.ClientId {
+				return nil
+			}
+			// Revoking a refresh token ends the whole login it belongs to
+			if err := service.db.Unscoped().Where("family_id = ?", refreshToken.FamilyId).Delete(&models.UserRefreshToken{}).Error; err != nil {
+				log.Println("Failed to revoke refresh token family ", err)
+				return err
+			}
+			return nil
+		}
+	}
+
+	claims, err := utils.ValidateJwtAndGetClaims(token)
+	if err != nil {
+		return nil
+	}
+	if clientId, _ := claims["clientId"].(string); clientId != client.ClientId {
+		return nil
+	}
+	jti, _ := claims["jti"].(string)
+	userId, _ := claims["userId"].(int)
+	expires, _ := claims["exp"].(time.Time)
+	return service.revocationService.RevokeToken(jti, uint(userId), expires)
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Scopes defined by OpenID Connect, profile, email and phone select the claims that are released
+const (
+	ScopeOpenId  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopePhone   = "phone"
+)
+
+// OIDCService implements the OpenID Connect layer on top of the OAuth endpoints
+type OIDCService struct {
+	db          *gorm.DB
+	userService *UserService
+	// issuer is the public base url of the service, it is the iss of every ID token
+	issuer      string
+	idTokenTime time.Duration
+	enabled     bool
+}
+
+// oidcEnabled reports whether OpenID Connect is switched on with OIDC_ENABLED, the openid scope is refused otherwise
+func oidcEnabled() bool {
+	return os.Getenv("OIDC_ENABLED") == "true"
+}
+
+func NewOIDCService(db *gorm.DB) *OIDCService {
+	idTokenTime, err := time.ParseDuration(os.Getenv("ID_TOKEN_EXPIRY_TIME"))
+	if err != nil {
+		idTokenTime = time.Hour
+	}
+	return &OIDCService{
+		db:          db,
+		userService: NewUserService(db),
+		issuer:      strings.TrimSuffix(os.Getenv("APP_URL"), "/"),
+		idTokenTime: idTokenTime,
+		enabled:     oidcEnabled(),
+	}
+}
+
+// Enabled reports whether the discovery document is served and ID tokens are issued
+func (service *OIDCService) Enabled() bool {
+	return service.enabled
+}
+
+// CheckSigningAlgorithm returns ErrOIDCSigningAlgorithm when OpenID Connect is enabled but tokens are MACed with the
+// server secret, clients could not verify such ID tokens with the JWKS. It is called before serving requests
+func (service *OIDCService) CheckSigningAlgorithm() error {
+	if !service.enabled {
+		return nil
+	}
+	if algorithm := utils.SigningAlgorithm(); algorithm == "" || strings.HasPrefix(algorithm, "HS") {
+		return ErrOIDCSigningAlgorithm
+	}
+	return nil
+}
+
+// Configuration returns the discovery document served at /.well-known/openid-configuration
+func (service *OIDCService) Configuration() models.OpenIDConfiguration {
+	return models.OpenIDConfiguration{
+		Issuer:                            service.issuer,
+		AuthorizationEndpoint:             service.issuer + "/oauth/authorize",
+		TokenEndpoint:                     service.issuer + "/oauth/token",
+		UserInfoEndpoint:                  service.issuer + "/oauth/userinfo",
+		JwksUri:                           service.issuer + "/.well-known/jwks.json",
+		IntrospectionEndpoint:             service.issuer + "/oauth/introspect",
+		RevocationEndpoint:                service.issuer + "/oauth/revoke",
+		DeviceAuthorizationEndpoint:       service.issuer + "/oauth/device_authorization",
+		ScopesSupported:                   []string{ScopeOpenId, ScopeProfile, ScopeEmail, ScopePhone},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials, GrantTypeDeviceCode},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  []string{utils.SigningAlgorithm()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{CodeChallengeMethodS256},
+		ClaimsSupported: []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce",
+			"preferred_username", "given_name", "family_name", "email", "phone_number"},
+	}
+}
+
+// GenerateIDToken issues the ID token of a login, claims beyond sub are released according to the scope
+func (service *OIDCService) GenerateIDToken(userDetails models.User, clientId, scope, nonce string, authTime time.Time) (string, error) {
+	info := userInfo(userDetails, scope)
+	claims := utils.IDTokenClaims{
+		Nonce:             nonce,
+		AuthTime:          jwt.NewNumericDate(authTime),
+		PreferredUsername: info.PreferredUsername,
+		GivenName:         info.GivenName,
+		FamilyName:        info.FamilyName,
+		Email:             info.Email,
+		PhoneNumber:       info.PhoneNumber,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   service.issuer,
+			Subject:  info.Sub,
+			Audience: jwt.ClaimStrings{clientId},
+		},
+	}
+	token, err := utils.GenerateIDToken(claims, service.idTokenTime)
+	if err != nil {
+		log.Println(err)
+		return "", ErrTokenGeneration
+	}
+	return token, nil
+}
+
+// UserInfo returns the claims of the user released for the scope of the access token
+func (service *OIDCService) UserInfo(userId int, scope string) (*models.UserInfoResponse, error) {
+	userDetails := service.userService.Get(userId)
+	if userDetails == nil || !userDetails.Active {
+		return nil, ErrUserNotFound
+	}
+	info := userInfo(*userDetails, scope)
+	return &info, nil
+}
+
+func userInfo(userDetails models.User, scope string) models.UserInfoResponse {
+	scopes := models.StringList(strings.Fields(scope))
+	info := models.UserInfoResponse{Sub: userDetails.UUID}
+	if scopes.Contains(ScopeProfile) {
+		info.PreferredUsername = userDetails.Username
+		info.GivenName = userDetails.FirstName
+		info.FamilyName = userDetails.LastName
+	}
+	if scopes.Contains(ScopeEmail) {
+		info.Email = userDetails.EmailAddress
+	}
+	if scopes.Contains(ScopePhone) {
+		info.PhoneNumber = userDetails.CellNumber
+	}
+	return info
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/sms"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// phoneVerificationAttempts is how many wrong codes are accepted before a new one must be requested
+const phoneVerificationAttempts = 5
+
+// PhoneVerificationService proves users own their cell number before it receives login codes
+type PhoneVerificationService struct {
+	db         *gorm.DB
+	smsService *SMSService
+	// verifyTime is how long the code sent by SMS is valid
+	verifyTime time.Duration
+	// resendCooldown is the minimum time between two codes sent to a user
+	resendCooldown time.Duration
+}
+
+func NewPhoneVerificationService(db *gorm.DB) *PhoneVerificationService {
+	verifyTime, err := time.ParseDuration(os.Getenv("PHONE_VERIFICATION_EXPIRY_TIME"))
+	if err != nil {
+		verifyTime = 10 * time.Minute
+	}
+	return &PhoneVerificationService{
+		db:             db,
+		smsService:     NewSMSService(),
+		verifyTime:     verifyTime,
+		resendCooldown: time.Minute,
+	}
+}
+
+// Start sends a verification code to the current cell number of the user, codes sent before stop working
+func (service *PhoneVerificationService) Start(userId uint) error {
+	var user models.User
+	if err := service.db.Where("id = ?", userId).First(&user).Error; err != nil {
+		return ErrUserNotFound
+	}
+	cellNumber, err := sms.NormalizeNumber(user.CellNumber)
+	if err != nil {
+		return ErrInvalidPhoneNumber
+	}
+	// Numbers saved before they were validated are stored normalized, so Confirm finds them
+	if cellNumber != user.CellNumber {
+		if err := service.db.Model(&models.User{}).Where("id = ?", userId).Update("cell_number", cellNumber).Error; err != nil {
+			return err
+		}
+	}
+
+	var last models.PhoneVerification
+	err = service.db.Where("user_id = ?", userId).Order("created_at DESC").First(&last).Error
+	if err == nil && time.Since(last.CreatedAt) < service.resendCooldown {
+		return ErrSMSCooldown
+	}
+
+	code := utils.GenerateRandomDigits(6)
+	return utils.Transaction(service.db, func(db *gorm.DB) error {
+		if err := db.Unscoped().Where("user_id = ?", userId).Delete(&models.PhoneVerification{}).Error; err != nil {
+			return err
+		}
+		entity := models.PhoneVerification{
+			UserId:     userId,
+			CellNumber: cellNumber,
+			CodeHash:   utils.HashToken(code),
+			ExpireTime: sql.NullTime{Time: time.Now().Add(service.verifyTime), Valid: true},
+		}
+		if err := db.Create(&entity).Error; err != nil {
+			return err
+		}
+		return service.smsService.SendPhoneVerification(code, cellNumber)
+	})
+}
+
+// Confirm marks the cell number as verified when the code matches, the number must not have changed since Start
+func (service *PhoneVerificationService) Confirm(userId uint, code string) error {
+	var verification models.PhoneVerification
+	err := service.db.Where("user_id = ? AND expire_time > NOW()", userId).Order("created_at DESC").First(&verification).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidCode
+		}
+		return err
+	}
+
+	if verification.CodeHash != utils.HashToken(code) {
+		verification.Attempts++
+		if verification.Attempts >= phoneVerificationAttempts {
+			err = service.db.Unscoped().Delete(&verification).Error
+		} else {
+			err = service.db.Model(&verification).Update("attempts", verification.Attempts).Error
+		}
+		if err != nil {
+			log.Println("Failed to count phone verification attempt ", err)
+		}
+		return ErrInvalidCode
+	}
+
+	return utils.Transaction(service.db, func(db *gorm.DB) error {
+		result := db.Model(&models.User{}).Where("id = ? AND cell_number = ?", userId, verification.CellNumber).Update("cell_number_verified", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+		return db.Unscoped().Where("user_id = ?", userId).Delete(&models.PhoneVerification{}).Error
+	})
+}
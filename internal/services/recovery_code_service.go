@@ -0,0 +1,111 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// Security event types of recovery codes
+const (
+	EventRecoveryCodesGenerated = "RECOVERY_CODES_GENERATED"
+	EventRecoveryCodeUsed       = "RECOVERY_CODE_USED"
+)
+
+// RecoveryCodeService manages the single use codes that replace the second factor of a user
+type RecoveryCodeService struct {
+	db                   *gorm.DB
+	emailService         *EmailService
+	securityEventService *SecurityEventService
+	// codeCount is how many codes a user gets at once
+	codeCount int
+}
+
+func NewRecoveryCodeService(db *gorm.DB) *RecoveryCodeService {
+	codeCount, err := strconv.Atoi(os.Getenv("RECOVERY_CODE_COUNT"))
+	if err != nil || codeCount <= 0 {
+		codeCount = 10
+	}
+	return &RecoveryCodeService{
+		db:                   db,
+		emailService:         NewEmailService(true),
+		securityEventService: NewSecurityEventService(db),
+		codeCount:            codeCount,
+	}
+}
+
+// Remaining returns how many unused recovery codes the user has
+func (service *RecoveryCodeService) Remaining(userId uint) (int64, error) {
+	var count int64
+	err := service.db.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userId).Count(&count).Error
+	return count, err
+}
+
+// Regenerate replaces all recovery codes of a user and emails them, the caller has re-authenticated the user
+// The codes are only returned here, they are stored hashed
+func (service *RecoveryCodeService) Regenerate(userDetails models.User, ipAddress, userAgent string) ([]string, error) {
+	var codes []string
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		var err error
+		codes, err = service.generate(db, userDetails.ID)
+		return err
+	})
+	if err != nil {
+		log.Println("Failed to generate recovery codes ", err)
+		return nil, ErrServer
+	}
+	service.securityEventService.Record(userDetails.ID, EventRecoveryCodesGenerated, ipAddress, userAgent, nil)
+	if err := service.emailService.SendRecoveryCodesGenerated(ipAddress, userDetails); err != nil {
+		log.Println("Failed to send the recovery codes notification ", err)
+	}
+	return codes, nil
+}
+
+// generate deletes the codes of the user and creates new ones within the transaction
+func (service *RecoveryCodeService) generate(db *gorm.DB, userId uint) ([]string, error) {
+	if err := db.Unscoped().Where("user_id = ?", userId).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, service.codeCount)
+	entities := make([]models.RecoveryCode, service.codeCount)
+	for i := range codes {
+		codes[i] = utils.GenerateRecoveryCode()
+		entities[i] = models.RecoveryCode{UserId: userId, CodeHash: utils.HashToken(utils.NormalizeRecoveryCode(codes[i]))}
+	}
+	if err := db.Create(&entities).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Consume marks the code as used and emails the user, a code is accepted only once
+func (service *RecoveryCodeService) Consume(userDetails models.User, code, ipAddress, userAgent string) error {
+	result := service.db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userDetails.ID, utils.HashToken(utils.NormalizeRecoveryCode(code))).
+		Update("used_at", sql.NullTime{Time: time.Now(), Valid: true})
+	if result.Error != nil {
+		log.Println("Failed to consume recovery code ", result.Error)
+		return ErrServer
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecoveryCode
+	}
+
+	remaining, err := service.Remaining(userDetails.ID)
+	if err != nil {
+		log.Println("Failed to count recovery codes ", err)
+	}
+	service.securityEventService.Record(userDetails.ID, EventRecoveryCodeUsed, ipAddress, userAgent, models.JSONB{"remaining": remaining})
+	// The login goes on even if the mail cannot be sent, the event is recorded either way
+	if err := service.emailService.SendRecoveryCodeUsed(remaining, ipAddress, userDetails); err != nil {
+		log.Println("Failed to send the recovery code notification ", err)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"gorm.io/gorm"
+)
+
+// revocationCache is shared by every RevocationService so revocations are visible to JwtAuth immediately
+type revocationCache struct {
+	mu sync.RWMutex
+	// tokens maps a revoked jti to the time the token expires
+	tokens map[string]time.Time
+	// users maps a user id to the time before which all of their tokens are revoked
+	users map[uint]time.Time
+	// clients maps a client id to the time before which all tokens issued to it are revoked
+	clients map[string]time.Time
+}
+
+var revokedTokens = &revocationCache{
+	tokens:  make(map[string]time.Time),
+	users:   make(map[uint]time.Time),
+	clients: make(map[string]time.Time),
+}
+
+type RevocationService struct {
+	db               *gorm.DB
+	maxTokenLifetime time.Duration
+}
+
+func NewRevocationService(db *gorm.DB) *RevocationService {
+	maxTokenLifetime, err := time.ParseDuration(os.Getenv("TOKEN_EXPIRY_TIME"))
+	if err != nil || maxTokenLifetime < 5*time.Minute {
+		maxTokenLifetime = 5 * time.Minute
+	}
+	return &RevocationService{
+		db:               db,
+		maxTokenLifetime: maxTokenLifetime,
+	}
+}
+
+// RevokeToken blocks a single access token until it expires
+func (service *RevocationService) RevokeToken(jti string, userId uint, expires time.Time) error {
+	if jti == "" {
+		return nil
+	}
+	entity := models.RevokedToken{
+		Jti:        jti,
+		UserId:     userId,
+		ExpireTime: sql.NullTime{Time: expires, Valid: true},
+	}
+	if err := service.db.Create(&entity).Error; err != nil {
+		log.Println("Failed to revoke token ", err)
+		return err
+	}
+
+	revokedTokens.mu.Lock()
+	revokedTokens.tokens[jti] = expires
+	revokedTokens.mu.Unlock()
+	return nil
+}
+
+// RevokeUserTokens blocks every access token issued to the user up to now
+func (service *RevocationService) RevokeUserTokens(userId uint) error {
+	return service.RevokeUserTokensTx(service.db, userId)
+}
+
+// RevokeUserTokensTx is RevokeUserTokens inside the caller's transaction
+func (service *RevocationService) RevokeUserTokensTx(db *gorm.DB, userId uint) error {
+	entity := models.RevokedToken{
+		UserId:     userId,
+		ExpireTime: sql.NullTime{Time: time.Now().Add(service.maxTokenLifetime), Valid: true},
+	}
+	if err := db.Create(&entity).Error; err != nil {
+		log.Println("Failed to revoke user tokens ", err)
+		return err
+	}
+
+	revokedTokens.mu.Lock()
+	if entity.CreatedAt.After(revokedTokens.users[userId]) {
+		revokedTokens.users[userId] = entity.CreatedAt
+	}
+	revokedTokens.mu.Unlock()
+	return nil
+}
+
+// RevokeClientTokensTx blocks every access token issued to the client up to now, inside the caller's transaction
+func (service *RevocationService) RevokeClientTokensTx(db *gorm.DB, clientId string) error {
+	entity := models.RevokedToken{
+		ClientId:   clientId,
+		ExpireTime: sql.NullTime{Time: time.Now().Add(service.maxTokenLifetime), Valid: true},
+	}
+	if err := db.Create(&entity).Error; err != nil {
+		log.Println("Failed to revoke client tokens ", err)
+		return err
+	}
+
+	revokedTokens.mu.Lock()
+	if entity.CreatedAt.After(revokedTokens.clients[clientId]) {
+		revokedTokens.clients[clientId] = entity.CreatedAt
+	}
+	revokedTokens.mu.Unlock()
+	return nil
+}
+
+// IsRevoked reports whether the access token was revoked, it only consults the in-process cache
+func (service *RevocationService) IsRevoked(jti string, userId int, clientId string, issuedAt time.Time) bool {
+	revokedTokens.mu.RLock()
+	defer revokedTokens.mu.RUnlock()
+
+	if _, ok := revokedTokens.tokens[jti]; ok {
+		return true
+	}
+	// Issued at only has second precision, tokens from the second of the revocation are revoked too
+	if revokedBefore, ok := revokedTokens.users[uint(userId)]; ok && userId != 0 && !issuedAt.After(revokedBefore.Truncate(time.Second)) {
+		return true
+	}
+	if revokedBefore, ok := revokedTokens.clients[clientId]; ok && clientId != "" && !issuedAt.After(revokedBefore.Truncate(time.Second)) {
+		return true
+	}
+	return false
+}
+
+// Refresh reloads the cache from the database so revocations made by other instances are enforced
+func (service *RevocationService) Refresh() error {
+	var entities []models.RevokedToken
+	if err := service.db.Where("expire_time > NOW()").Find(&entities).Error; err != nil {
+		return err
+	}
+
+	tokens := make(map[string]time.Time)
+	users := make(map[uint]time.Time)
+	clients := make(map[string]time.Time)
+	for _, entity := range entities {
+		switch {
+		case entity.Jti != "":
+			tokens[entity.Jti] = entity.ExpireTime.Time
+		case entity.ClientId != "":
+			if entity.CreatedAt.After(clients[entity.ClientId]) {
+				clients[entity.ClientId] = entity.CreatedAt
+			}
+		case entity.CreatedAt.After(users[entity.UserId]):
+			users[entity.UserId] = entity.CreatedAt
+		}
+	}
+
+	revokedTokens.mu.Lock()
+	revokedTokens.tokens = tokens
+	revokedTokens.users = users
+	revokedTokens.clients = clients
+	revokedTokens.mu.Unlock()
+	return nil
+}
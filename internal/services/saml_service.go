@@ -0,0 +1,205 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/federation"
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/samlsp"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+// samlIdentityPrefix prefixes the provider of identities linked through SAML, so they never clash with OIDC providers
+const samlIdentityPrefix = "saml:"
+
+// SAMLService logs users in with SAML 2.0 identity providers
+type SAMLService struct {
+	db                *gorm.DB
+	userService       *UserService
+	authService       *AuthService
+	federationService *FederationService
+	providers         map[string]*samlsp.Provider
+	// requestTime is how long the user has to come back from the identity provider
+	requestTime time.Duration
+}
+
+func NewSAMLService(db *gorm.DB) *SAMLService {
+	requestTime, err := time.ParseDuration(os.Getenv("FEDERATED_LOGIN_EXPIRY_TIME"))
+	if err != nil {
+		requestTime = 10 * time.Minute
+	}
+	providers := map[string]*samlsp.Provider{}
+	sp, ok, err := samlsp.SPConfigFromEnv(strings.TrimSuffix(os.Getenv("APP_URL"), "/") + "/api/v1/auth/saml")
+	if err != nil {
+		log.Println("SAML login is disabled, failed to load the service provider key pair ", err)
+	} else if ok {
+		providers = samlsp.ProvidersFromEnv(sp)
+	}
+	return &SAMLService{
+		db:                db,
+		userService:       NewUserService(db),
+		authService:       NewAuthService(db),
+		federationService: NewFederationService(db),
+		providers:         providers,
+		requestTime:       requestTime,
+	}
+}
+
+// RequestTime is how long a login started with StartLogin can be completed
+func (service *SAMLService) RequestTime() time.Duration {
+	return service.requestTime
+}
+
+// Providers returns the names of the configured identity providers
+func (service *SAMLService) Providers() []string {
+	names := make([]string, 0, len(service.providers))
+	for name := range service.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Metadata returns the service provider metadata to register at the identity provider
+func (service *SAMLService) Metadata(providerName string) ([]byte, error) {
+	provider, ok := service.providers[providerName]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+	return provider.Metadata()
+}
+
+// StartLogin returns the identity provider url to redirect the user to and the binding the browser must present on the ACS
+func (service *SAMLService) StartLogin(ctx context.Context, providerName string) (string, string, error) {
+	provider, ok := service.providers[providerName]
+	if !ok {
+		return "", "", ErrUnknownProvider
+	}
+
+	relayState := utils.GenerateOpaqueToken(32)
+	binding := utils.GenerateOpaqueToken(32)
+	redirectUrl, requestId, err := provider.AuthnRequestURL(ctx, relayState)
+	if err != nil {
+		log.Println("Failed to start SAML login with "+providerName+" ", err)
+		return "", "", ErrFederatedLogin
+	}
+
+	entity := models.SAMLLoginRequest{
+		RequestId:      requestId,
+		Provider:       providerName,
+		RelayStateHash: utils.HashToken(relayState),
+		BindingHash:    utils.HashToken(binding),
+		ExpireTime:     sql.NullTime{Time: time.Now().Add(service.requestTime), Valid: true},
+	}
+	if err := service.db.Create(&entity).Error; err != nil {
+		log.Println("Failed to create SAML login request ", err)
+		return "", "", ErrFederatedLogin
+	}
+	return redirectUrl, binding, nil
+}
+
+// CompleteLogin validates the response posted to the ACS and logs in the linked user, two factor authentication still applies
+func (service *SAMLService) CompleteLogin(ctx context.Context, providerName, samlResponse, relayState, binding, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	provider, ok := service.providers[providerName]
+	if !ok {
+		return nil, ErrUnknownProvider
+	}
+
+	var entity models.SAMLLoginRequest
+	err := service.db.Where("relay_state_hash = ? AND provider = ? AND expire_time > NOW()", utils.HashToken(relayState), providerName).
+		First(&entity).Error
+	if err != nil {
+		return nil, ErrFederatedLogin
+	}
+	// Deleting first makes the request single use, so a captured response cannot be replayed
+	result := service.db.Unscoped().Delete(&models.SAMLLoginRequest{}, entity.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || entity.BindingHash != utils.HashToken(binding) {
+		return nil, ErrFederatedLogin
+	}
+
+	identity, err := provider.ParseResponse(ctx, samlResponse, []string{entity.RequestId})
+	if err != nil {
+		log.Println("Rejected SAML response from "+providerName+" ", err)
+		return nil, ErrFederatedLogin
+	}
+
+	config := provider.Config()
+	// The identity provider is explicitly trusted, so the email address it asserts counts as verified
+	userDetails, err := service.federationService.linkedUser(federation.ProviderConfig{
+		Name:          samlIdentityPrefix + providerName,
+		AutoProvision: config.AutoProvision,
+		LinkByEmail:   config.LinkByEmail,
+	}, federation.Claims{
+		Subject:           identity.NameID,
+		Email:             identity.Email,
+		EmailVerified:     identity.Email != "",
+		GivenName:         identity.FirstName,
+		FamilyName:        identity.LastName,
+		PreferredUsername: identity.Username,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !userDetails.Active {
+		return nil, ErrAccountNotActive
+	}
+	if err := service.syncUser(provider, *identity, userDetails); err != nil {
+		return nil, err
+	}
+	// Read again so the tokens carry the synced roles
+	if userDetails = service.userService.Get(int(userDetails.ID)); userDetails == nil {
+		return nil, ErrAccountNotLinked
+	}
+	return service.authService.generateAuthResponse(*userDetails, ipAddress, userAgent)
+}
+
+// syncUser updates the names and roles of a user provisioned by an identity provider from the assertion
+// Users that were linked by email keep their own details and roles
+func (service *SAMLService) syncUser(provider *samlsp.Provider, identity samlsp.Identity, userDetails *models.User) error {
+	var source string
+	if err := service.db.Model(&models.User{}).Select("source").Where("id = ?", userDetails.ID).Row().Scan(&source); err != nil {
+		return err
+	}
+	if source != UserSourceFederated {
+		return nil
+	}
+
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		updates := map[string]interface{}{}
+		if identity.FirstName != "" {
+			updates["first_name"] = identity.FirstName
+		}
+		if identity.LastName != "" {
+			updates["last_name"] = identity.LastName
+		}
+		if len(updates) > 0 {
+			if err := db.Model(&models.User{}).Where("id = ?", userDetails.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		// Roles are only managed by the identity provider when it has group mappings
+		if len(provider.Config().GroupRoles) == 0 {
+			return nil
+		}
+		roles := provider.Roles(identity)
+		if len(roles) == 0 {
+			roles = []string{defaultRole}
+		}
+		return replaceRoles(db, userDetails, roles)
+	})
+	if err != nil {
+		log.Println("Failed to update SAML user ", err)
+		return ErrFederatedLogin
+	}
+	return nil
+}
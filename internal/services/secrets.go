@@ -0,0 +1,23 @@
+package services
+
+import (
+	"errors"
+	"os"
+)
+
+// requiredSecrets are the HMAC secrets that must be set, each signs its own kind of link
+// They are not shared with JWT_SECRET, which is empty when tokens are signed with an asymmetric key
+var requiredSecrets = []string{
+	"EMAIL_VERIFICATION_SECRET",
+	"MAGIC_LINK_SECRET",
+}
+
+// CheckSecrets returns an error naming the first required secret that is not set, it is called before serving requests
+func CheckSecrets() error {
+	for _, name := range requiredSecrets {
+		if os.Getenv(name) == "" {
+			return errors.New(name + " must be set")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package services
+
+import (
+	"log"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"gorm.io/gorm"
+)
+
+// Security event types
+const (
+	EventRefreshTokenReuse = "REFRESH_TOKEN_REUSE"
+	EventTwoFactorEnabled  = "TWO_FACTOR_ENABLED"
+	EventTwoFactorDisabled = "TWO_FACTOR_DISABLED"
+)
+
+type SecurityEventService struct {
+	db *gorm.DB
+}
+
+func NewSecurityEventService(db *gorm.DB) *SecurityEventService {
+	return &SecurityEventService{
+		db: db,
+	}
+}
+
+// Record stores the event and writes it to the log, failures are logged but never block the caller
+func (service *SecurityEventService) Record(userId uint, eventType, ipAddress, userAgent string, details models.JSONB) {
+	log.Printf("SECURITY EVENT %s user=%d ip=%s details=%v\n", eventType, userId, ipAddress, details)
+
+	if details == nil {
+		details = models.JSONB{}
+	}
+	event := models.SecurityEvent{
+		UserId:    userId,
+		Type:      eventType,
+		IpAddress: ipAddress,
+		UserAgent: userAgent,
+		Details:   details,
+	}
+	if err := service.db.Create(&event).Error; err != nil {
+		log.Println("Failed to record security event ", err)
+	}
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/sms"
+)
+
+// SMSService sends login and verification codes by text message
+type SMSService struct {
+	// sender is nil when SMS_PROVIDER is not configured
+	sender     sms.Sender
+	issuerName string
+}
+
+func NewSMSService() *SMSService {
+	sender, _ := sms.SenderFromEnv()
+	issuerName := os.Getenv("ISSUER_NAME")
+	if issuerName == "" {
+		issuerName = "SpeedyAuth"
+	}
+	return &SMSService{sender: sender, issuerName: issuerName}
+}
+
+// Enabled reports whether an SMS provider is configured
+func (service *SMSService) Enabled() bool {
+	return service.sender != nil
+}
+
+// SendTwoFactorRequest sends the code of the second login step to the verified cell number of the user
+func (service *SMSService) SendTwoFactorRequest(code string, userDetails models.User) error {
+	return service.send(userDetails.CellNumber, code+" is your "+service.issuerName+" login code. Do not share it with anyone.")
+}
+
+// SendLoginCode sends the code of a passwordless login to the verified cell number of the user
+func (service *SMSService) SendLoginCode(code string, userDetails models.User) error {
+	return service.send(userDetails.CellNumber, code+" is your "+service.issuerName+" sign in code. Do not share it with anyone.")
+}
+
+// SendPhoneVerification sends the code that proves the user owns the cell number
+func (service *SMSService) SendPhoneVerification(code, cellNumber string) error {
+	return service.send(cellNumber, code+" is your "+service.issuerName+" verification code.")
+}
+
+func (service *SMSService) send(to, message string) error {
+	if service.sender == nil {
+		return ErrSMSUnavailable
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := service.sender.Send(ctx, to, message); err != nil {
+		log.Println("Sending SMS error ", err)
+		return ErrSendingSMS
+	}
+	return nil
+}
@@ -1,25 +1,36 @@
 package services
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
+	"image/png"
 	"log"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/sms"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
+// defaultRole is assigned to every self registered user
+const defaultRole = "USER"
+
 type UserService struct {
-	db *gorm.DB
+	db                *gorm.DB
+	revocationService *RevocationService
 }
 
 func NewUserService(db *gorm.DB) *UserService {
 	return &UserService{
-		db: db,
+		db:                db,
+		revocationService: NewRevocationService(db),
 	}
 }
 
@@ -30,16 +41,20 @@ func (service *UserService) List(offset int, limit int) ([]models.User, error) {
 	queryString :=
 		`SELECT
 			users.id,
-			users.uu_id,
+			users.uuid,
 			users.username,
 			users.first_name,
 			users.last_name,
 			users.email_address,
-			users.phone_number,
+			users.cell_number,
 			users.active,
 			users.two_factor_enabled
 		FROM
 			users
+		WHERE
+			users.deleted_at IS NULL
+		ORDER BY
+			users.id
 		OFFSET ?
 		LIMIT ?
 	    `
@@ -49,11 +64,12 @@ func (service *UserService) List(offset int, limit int) ([]models.User, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		user := models.User{}
 		rows.Scan(&user.ID, &user.UUID, &user.Username, &user.FirstName,
-			&user.LastName, &user.CellNumber,
-			&user.EmailAddress, &user.Active, &user.TwoFactorEnabled)
+			&user.LastName, &user.EmailAddress,
+			&user.CellNumber, &user.Active, &user.TwoFactorEnabled)
 		//roles, _ := usrSrv.GetRoles(int(user.Model.ID))
 		//user.Roles = roles
 		users = append(users, user)
@@ -68,40 +84,116 @@ func (service *UserService) Get(userId int) *models.User {
 	queryString :=
 		`SELECT 
 			users.id,
-			users.uu_id,
+			users.uuid,
 			users.username,
 			users.first_name,
 			users.last_name,
 			users.email_address,
-			users.phone_number,
+			users.cell_number,
+			users.cell_number_verified,
 			users.active,
 			users.two_factor_enabled,
 			users.two_factor_method,
 			users.totp_secret ,
 			users.totp_url,
-			users.meta_data
+			users.metadata
 		FROM 
 			users 
 		WHERE 
-			users.id = ?      
+			users.id = ? AND users.deleted_at IS NULL
 		LIMIT 1
         `
 
 	row := service.db.Raw(queryString, userId).Row()
 	err := row.Scan(&userDetails.ID, &userDetails.UUID, &userDetails.Username, &userDetails.FirstName,
-		&userDetails.LastName, &userDetails.EmailAddress, &userDetails.CellNumber, &userDetails.Active, &userDetails.TwoFactorEnabled,
+		&userDetails.LastName, &userDetails.EmailAddress, &userDetails.CellNumber, &userDetails.CellNumberVerified, &userDetails.Active, &userDetails.TwoFactorEnabled,
 		&userDetails.TwoFactorMethod, &userDetails.TOTPSecret, &userDetails.TOTPURL, &userDetails.Metadata,
 	)
 
-	//role, _ := service.GetRoles(int(userDetails.Model.ID))
-	//userDetails.Roles = role
 	if err != nil {
 		log.Println(err)
 		return nil
 	}
+	if err := service.db.Model(userDetails).Association("Roles").Find(&userDetails.Roles); err != nil {
+		log.Println(err)
+	}
 	return userDetails
 }
 
+// Register creates an inactive user with the default role, the account is activated once the email address is verified
+func (service *UserService) Register(request models.UserRegistrationRequest) (*models.User, error) {
+	if !utils.IsStrongPassword(request.Password) {
+		return nil, ErrStrongPassword
+	}
+	cellNumber, err := sms.NormalizeNumber(request.CellNumber)
+	if err != nil {
+		return nil, ErrInvalidPhoneNumber
+	}
+
+	var count int64
+	if err := service.db.Model(&models.User{}).Where("username = ? OR email_address = ?", request.Username, request.EmailAddress).Count(&count).Error; err != nil {
+		log.Println(err)
+		return nil, ErrRegistration
+	}
+	if count > 0 {
+		return nil, ErrUserNameExists
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println(err)
+		return nil, ErrRegistration
+	}
+
+	user := &models.User{
+		UUID:         utils.GenerateUUID(),
+		Username:     request.Username,
+		Password:     string(passwordHash),
+		EmailAddress: request.EmailAddress,
+		FirstName:    request.FirstName,
+		LastName:     request.LastName,
+		CellNumber:   cellNumber,
+		Active:       false,
+		Metadata:     models.JSONB{},
+	}
+
+	err = utils.Transaction(service.db, func(db *gorm.DB) error {
+		return createWithDefaultRole(db, user)
+	})
+	// The unique indexes catch a concurrent registration of the same username or email address
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, ErrUserNameExists
+	}
+	if err != nil {
+		log.Println("Failed to register user ", err)
+		return nil, ErrRegistration
+	}
+	return user, nil
+}
+
+// replaceRoles sets the roles of the user to the role types, missing roles are created
+func replaceRoles(db *gorm.DB, user *models.User, roleTypes []string) error {
+	roles := make([]*models.Role, 0, len(roleTypes))
+	for _, roleType := range roleTypes {
+		role := models.Role{}
+		if err := db.Where(models.Role{Type: roleType}).FirstOrCreate(&role).Error; err != nil {
+			return err
+		}
+		roles = append(roles, &role)
+	}
+	return db.Model(user).Association("Roles").Replace(roles)
+}
+
+// createWithDefaultRole inserts the user with the default role
+func createWithDefaultRole(db *gorm.DB, user *models.User) error {
+	role := models.Role{}
+	if err := db.Where(models.Role{Type: defaultRole}).FirstOrCreate(&role).Error; err != nil {
+		return err
+	}
+	user.Roles = []*models.Role{&role}
+	return db.Create(user).Error
+}
+
 // GetByUsername GetUsername gets the usersDetails by username
 func (service *UserService) GetByUsername(username string) *models.User {
 	user := models.User{}
@@ -140,16 +232,14 @@ func (service *UserService) GetRoles(userId int) ([]string, error) {
 
 }
 
+// Update changes the profile of the user, a new email address is left to VerificationService.ChangeEmailAddress
 func (service *UserService) Update(userId uint, request models.UserUpdateRequest) error {
 
-	var user *models.User
+	user := models.User{}
 
-	err := service.db.Model(&models.User{}).Where("id = ?", userId).First(user).Error
+	err := service.db.Model(&models.User{}).Where("id = ?", userId).First(&user).Error
 	if err != nil {
 		log.Println("loi xay ra ", err)
-		return err
-	}
-	if user == nil {
 		return errors.New("user Not Found")
 	}
 
@@ -161,61 +251,119 @@ func (service *UserService) Update(userId uint, request models.UserUpdateRequest
 	if strings.Trim(request.LastName, "") != "" {
 		user.LastName = request.LastName
 	}
-	// Update email Address
-	if strings.Trim(request.EmailAddress, "") != "" {
-		user.EmailAddress = request.EmailAddress
-	}
-	// Update cell number
+	// Update cell number, a new number has to be verified again before it receives codes
 	if strings.Trim(request.CellNumber, "") != "" {
-		user.CellNumber = request.CellNumber
+		cellNumber, err := sms.NormalizeNumber(request.CellNumber)
+		if err != nil {
+			return ErrInvalidPhoneNumber
+		}
+		if cellNumber != user.CellNumber {
+			user.CellNumber = cellNumber
+			user.CellNumberVerified = false
+		}
 	}
 
-	service.db.Model(&models.User{}).Save(user)
-
-	return nil
+	return service.db.Model(&models.User{}).Omit("Roles").Save(&user).Error
 }
 
+// DeleteToken revokes the refresh token and every token rotated from the same login
 func (service *UserService) DeleteToken(userId uint, refreshToken string) (bool, error) {
 
-	var userRefreshToken *models.UserRefreshToken
-	if err := service.db.Model(&models.TokenRefreshRequest{}).Where("user_id = ? AND token = ?", userId, refreshToken).First(userRefreshToken).Error; err != nil {
+	var userRefreshToken models.UserRefreshToken
+	if err := service.db.Where("user_id = ? AND token = ?", userId, utils.HashToken(refreshToken)).First(&userRefreshToken).Error; err != nil {
 		log.Println("loi xay ra ", err)
 		return false, err
 	}
 
-	if rowsAff := service.db.Model(&models.UserRefreshToken{}).Delete(userRefreshToken).RowsAffected; rowsAff == 0 {
+	if rowsAff := service.db.Unscoped().Where("family_id = ?", userRefreshToken.FamilyId).Delete(&models.UserRefreshToken{}).RowsAffected; rowsAff == 0 {
 		return false, nil
 	}
 
 	return true, nil
 }
 
+// SetActive enables or disables an account by UUID, disabling signs the user out everywhere immediately
+func (service *UserService) SetActive(userUUID string, active bool) error {
+	return utils.Transaction(service.db, func(db *gorm.DB) error {
+		var user models.User
+		if err := db.Where("uuid = ?", userUUID).First(&user).Error; err != nil {
+			log.Println(err)
+			return ErrUserNotFound
+		}
+
+		if err := db.Model(&user).Update("active", active).Error; err != nil {
+			return err
+		}
+		if active {
+			return nil
+		}
+
+		if err := db.Unscoped().Where("user_id = ?", user.ID).Delete(&models.UserRefreshToken{}).Error; err != nil {
+			return err
+		}
+		return service.revocationService.RevokeUserTokensTx(db, user.ID)
+	})
+}
+
+// Enable2Factor makes codes sent by EMAIL or SMS the second factor, SMS needs a verified cell number
+// The caller re-authenticates the user first, see AuthService.Reauthenticate
 func (service *UserService) Enable2Factor(userId uint, methodCode string) error {
 
-	var user *models.User
-	if rowsAff := service.db.Model(&models.User{}).Where("user_id = ?", userId).First(user).RowsAffected; rowsAff == 0 {
+	user := models.User{}
+	if rowsAff := service.db.Where("id = ?", userId).Find(&user).RowsAffected; rowsAff == 0 {
 		return errors.New("user Not Found")
 	}
 
-	user.TwoFactorEnabled = true
-	user.TwoFactorMethod = methodCode
-
-	if err := service.db.Model(&models.User{}).Updates(user).Error; err != nil {
-		log.Println("loi xay ra ", err)
-		return err
+	methodCode = strings.ToUpper(methodCode)
+	switch methodCode {
+	case "EMAIL":
+	case "SMS":
+		if !user.CellNumberVerified {
+			return ErrPhoneNotVerified
+		}
+	default:
+		return ErrSendMethod
 	}
 
+	return service.setTwoFactorMethod(userId, methodCode)
+}
+
+// setTwoFactorMethod makes the method the second factor and drops a pending TOTP enrollment
+// A confirmed TOTP is only replaced after DisableTwoFactor, which asks for the password and a code
+func (service *UserService) setTwoFactorMethod(userId uint, method string) error {
+	result := service.db.Model(&models.User{}).
+		Where("id = ? AND NOT (two_factor_enabled AND COALESCE(two_factor_method, '') = ?)", userId, "TOTP").
+		Updates(map[string]interface{}{
+			"two_factor_enabled": true,
+			"two_factor_method":  method,
+			"totp_secret":        "",
+			"totp_url":           "",
+			"totp_created":       sql.NullTime{},
+			"totp_last_counter":  0,
+		})
+	if result.Error != nil {
+		log.Println("Failed to change the two factor method ", result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTOTPActive
+	}
 	return nil
 }
 
+// Enable2FactorTOTP creates a TOTP secret for the user to scan, it only becomes the second factor once ConfirmTOTP
+// accepted a code from it, so a user who never scanned it is not locked out
 func (service *UserService) Enable2FactorTOTP(userId uint) (*models.EnableTOTPResponse, error) {
 
-	var userDetail *models.User
+	userDetail := models.User{}
 	response := &models.EnableTOTPResponse{}
 
-	if rowsAff := service.db.Model(&models.User{}).Where("id = ?", userId).Find(userDetail).RowsAffected; rowsAff == 0 {
+	if rowsAff := service.db.Where("id = ?", userId).Find(&userDetail).RowsAffected; rowsAff == 0 {
 		return response, errors.New("user Not Found")
 	}
+	if userDetail.TwoFactorEnabled && userDetail.TwoFactorMethod == "TOTP" {
+		return nil, ErrTOTPExists
+	}
 
 	key, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      os.Getenv("ISSUER_NAME"),
@@ -229,15 +377,41 @@ func (service *UserService) Enable2FactorTOTP(userId uint) (*models.EnableTOTPRe
 
 	response.URL = key.URL()
 
-	userDetail.TwoFactorEnabled = true
-	userDetail.TwoFactorMethod = "TOTP"
-	userDetail.TOTPSecret = key.Secret()
-	userDetail.TOTPURL = key.URL()
-	userDetail.TOTPCreated = sql.NullTime{Time: time.Now(), Valid: true}
-
-	if err := service.db.Model(&models.User{}).Updates(userDetail).Error; err != nil {
+	err = service.db.Model(&models.User{}).Where("id = ?", userId).Updates(map[string]interface{}{
+		"totp_secret":       key.Secret(),
+		"totp_url":          key.URL(),
+		"totp_created":      sql.NullTime{Time: time.Now(), Valid: true},
+		"totp_last_counter": 0,
+	}).Error
+	if err != nil {
 		return nil, err
 	}
 
 	return response, nil
 }
+
+// TOTPQRCode renders the pending TOTP secret as a PNG QR code for authenticator apps
+// The secret of a confirmed enrollment is never shown again
+func (service *UserService) TOTPQRCode(userId uint) ([]byte, error) {
+	userDetail := service.Get(int(userId))
+	if userDetail == nil {
+		return nil, ErrUserNotFound
+	}
+	if userDetail.TOTPURL == "" || (userDetail.TwoFactorEnabled && userDetail.TwoFactorMethod == "TOTP") {
+		return nil, ErrTOTPEnrollment
+	}
+
+	key, err := otp.NewKeyFromURL(userDetail.TOTPURL)
+	if err != nil {
+		return nil, err
+	}
+	qrCode, err := key.Image(256, 256)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, qrCode); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"gorm.io/gorm"
+)
+
+type VerificationService struct {
+	db           *gorm.DB
+	userService  *UserService
+	emailService *EmailService
+	secret       []byte
+	appURL       string
+	expiry       time.Duration
+	cooldown     time.Duration
+}
+
+func NewVerificationService(db *gorm.DB) *VerificationService {
+	expiry, err := time.ParseDuration(os.Getenv("EMAIL_VERIFICATION_EXPIRY"))
+	if err != nil {
+		expiry = 24 * time.Hour
+	}
+	cooldown, err := time.ParseDuration(os.Getenv("EMAIL_VERIFICATION_COOLDOWN"))
+	if err != nil {
+		cooldown = time.Minute
+	}
+	return &VerificationService{
+		db:           db,
+		userService:  NewUserService(db),
+		emailService: NewEmailService(true),
+		secret:       []byte(os.Getenv("EMAIL_VERIFICATION_SECRET")),
+		appURL:       strings.TrimSuffix(os.Getenv("APP_URL"), "/"),
+		expiry:       expiry,
+		cooldown:     cooldown,
+	}
+}
+
+// SendVerification creates a signed verification link for the email address of the user and emails it there,
+// older links stop working
+func (service *VerificationService) SendVerification(userDetails models.User) error {
+	// CheckSecrets stops the server from starting without it, this guards against signing with an empty key anyway
+	if len(service.secret) == 0 {
+		return ErrServer
+	}
+	expires := time.Now().Add(service.expiry)
+	// The nonce makes every link unique so it can be looked up and used only once
+	token := utils.GenerateSignedToken(service.secret, userDetails.UUID+":"+utils.GenerateOpaqueToken(32), expires)
+
+	err := utils.Transaction(service.db, func(db *gorm.DB) error {
+		if err := db.Where("user_id = ?", userDetails.ID).Delete(&models.EmailVerification{}).Error; err != nil {
+			return err
+		}
+
+		verification := models.EmailVerification{
+			UserId:       userDetails.ID,
+			TokenHash:    utils.HashToken(token),
+			ExpireTime:   sql.NullTime{Time: expires, Valid: true},
+			EmailAddress: userDetails.EmailAddress,
+		}
+		if err := db.Create(&verification).Error; err != nil {
+			return err
+		}
+
+		link := service.appURL + "/api/v1/auth/verify-email?token=" + url.QueryEscape(token)
+		if err := service.emailService.SendEmailVerification(link, service.expiry, userDetails); err != nil {
+			log.Println("Sending Email error", err)
+			return ErrSendingMail
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Failed to send email verification ", err)
+		return err
+	}
+	return nil
+}
+
+// ChangeEmailAddress sends a verification link to the new address, the user keeps the current address until it is
+// opened. An address that is the email address or username of another user is refused, both log in
+func (service *VerificationService) ChangeEmailAddress(userId uint, emailAddress string) error {
+	userDetails := service.userService.Get(int(userId))
+	if userDetails == nil {
+		return ErrUserNotFound
+	}
+	if emailAddress == userDetails.EmailAddress {
+		return nil
+	}
+
+	var count int64
+	err := service.db.Model(&models.User{}).Where("id <> ? AND (email_address = ? OR username = ?)", userId, emailAddress, emailAddress).
+		Count(&count).Error
+	if err != nil {
+		log.Println(err)
+		return ErrServer
+	}
+	if count > 0 {
+		return ErrEmailAddressExists
+	}
+
+	userDetails.EmailAddress = emailAddress
+	return service.SendVerification(*userDetails)
+}
+
+// VerifyEmail checks the signed token and activates the account it was issued for, the account takes over the
+// address the link was sent to
+func (service *VerificationService) VerifyEmail(token string) error {
+	if len(service.secret) == 0 {
+		return ErrInvalidVerification
+	}
+	payload, err := utils.ParseSignedToken(service.secret, token)
+	if err != nil {
+		return ErrInvalidVerification
+	}
+	userUUID, _, _ := strings.Cut(payload, ":")
+
+	return utils.Transaction(service.db, func(db *gorm.DB) error {
+		var verification models.EmailVerification
+		if err := db.Where("token_hash = ? AND expire_time > NOW()", utils.HashToken(token)).First(&verification).Error; err != nil {
+			log.Println("Email verification not found ", err)
+			return ErrInvalidVerification
+		}
+
+		updates := map[string]interface{}{"active": true}
+		if verification.EmailAddress != "" {
+			updates["email_address"] = verification.EmailAddress
+		}
+		result := db.Model(&models.User{}).Where("id = ? AND uuid = ?", verification.UserId, userUUID).Updates(updates)
+		// Another account registered the address after the link was sent
+		if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+			return ErrEmailAddressExists
+		}
+		if result.Error != nil {
+			log.Println(result.Error)
+			return ErrServer
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidVerification
+		}
+
+		if err := db.Where("user_id = ?", verification.UserId).Delete(&models.EmailVerification{}).Error; err != nil {
+			log.Println(err)
+			return ErrServer
+		}
+		return nil
+	})
+}
+
+// ResendVerification sends a new link unless one was sent within the cooldown
+// Unknown and active accounts and the cooldown are silently ignored, so the result does not reveal the account
+func (service *VerificationService) ResendVerification(emailAddress string) error {
+	var userDetails models.User
+	if err := service.db.Model(&models.User{}).Where("email_address = ?", emailAddress).First(&userDetails).Error; err != nil {
+		log.Println("Resend verification for unknown email address")
+		return nil
+	}
+	if userDetails.Active {
+		return nil
+	}
+
+	var latest models.EmailVerification
+	err := service.db.Where("user_id = ?", userDetails.ID).Order("created_at DESC").First(&latest).Error
+	if err == nil && time.Since(latest.CreatedAt) < service.cooldown {
+		log.Println("Resend verification within the cooldown")
+		return nil
+	}
+
+	return service.SendVerification(userDetails)
+}
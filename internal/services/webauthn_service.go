@@ -0,0 +1,540 @@
+package services
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+// Ceremonies a WebAuthn session is issued for
+const (
+	webAuthnRegistration = "registration"
+	webAuthnLogin        = "login"
+	webAuthnTwoFactor    = "two_factor"
+)
+
+// Security event types of passkeys
+const (
+	EventPasskeyAdded   = "PASSKEY_ADDED"
+	EventPasskeyDeleted = "PASSKEY_DELETED"
+	EventPasskeyCloned  = "PASSKEY_CLONE_DETECTED"
+)
+
+// WebAuthnService registers passkeys and logs users in with them, passwordless or as a second factor
+type WebAuthnService struct {
+	db                   *gorm.DB
+	userService          *UserService
+	authService          *AuthService
+	securityEventService *SecurityEventService
+	// webAuthn is nil when the relying party is not configured
+	webAuthn *webauthn.WebAuthn
+	// ceremonyTime is how long the user has to answer a challenge
+	ceremonyTime time.Duration
+}
+
+func NewWebAuthnService(db *gorm.DB) *WebAuthnService {
+	ceremonyTime, err := time.ParseDuration(os.Getenv("WEBAUTHN_CEREMONY_EXPIRY_TIME"))
+	if err != nil {
+		ceremonyTime = 5 * time.Minute
+	}
+
+	appUrl := strings.TrimSuffix(os.Getenv("APP_URL"), "/")
+	rpId := os.Getenv("WEBAUTHN_RP_ID")
+	if rpId == "" {
+		if parsed, err := url.Parse(appUrl); err == nil {
+			rpId = parsed.Hostname()
+		}
+	}
+	rpName := os.Getenv("WEBAUTHN_RP_NAME")
+	if rpName == "" {
+		rpName = "SpeedyAuth"
+	}
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WEBAUTHN_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 && appUrl != "" {
+		origins = []string{appUrl}
+	}
+
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTime, TimeoutUVD: ceremonyTime}
+	webAuthn, err := webauthn.New(&webauthn.Config{
+		RPID:          rpId,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		log.Println("Passkeys are disabled, set APP_URL or WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS ", err)
+		webAuthn = nil
+	}
+
+	return &WebAuthnService{
+		db:                   db,
+		userService:          NewUserService(db),
+		authService:          NewAuthService(db),
+		securityEventService: NewSecurityEventService(db),
+		webAuthn:             webAuthn,
+		ceremonyTime:         ceremonyTime,
+	}
+}
+
+// webAuthnUser is a user with its passkeys as seen by the WebAuthn library
+type webAuthnUser struct {
+	user        models.User
+	credentials []webauthn.Credential
+}
+
+// WebAuthnID is the user handle stored in the passkey, it is the UUID so the database id is never exposed
+func (user *webAuthnUser) WebAuthnID() []byte {
+	return []byte(user.user.UUID)
+}
+
+func (user *webAuthnUser) WebAuthnName() string {
+	return user.user.Username
+}
+
+func (user *webAuthnUser) WebAuthnDisplayName() string {
+	if name := strings.TrimSpace(user.user.FirstName + " " + user.user.LastName); name != "" {
+		return name
+	}
+	return user.user.Username
+}
+
+func (user *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (user *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return user.credentials
+}
+
+// BeginRegistration creates the options for a new passkey of the user, passkeys already registered are excluded
+// A passkey also logs in without a password, so the user enters their password again and a current code when
+// the method is TOTP. The single use session carries this check to FinishRegistration
+func (service *WebAuthnService) BeginRegistration(userId uint, password, code string) (*models.PasskeyRegistrationResponse, error) {
+	if service.webAuthn == nil {
+		return nil, ErrPasskeyDisabled
+	}
+	user, err := service.loadUser(int(userId))
+	if err != nil {
+		return nil, err
+	}
+	if err := service.authService.reauthenticate(user.user, password, code); err != nil {
+		return nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(user.credentials))
+	for _, credential := range user.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	options, session, err := service.webAuthn.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		// A discoverable credential can also log in without a username
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		log.Println("Failed to begin passkey registration ", err)
+		return nil, ErrServer
+	}
+
+	sessionId, err := service.saveSession(webAuthnRegistration, userId, session)
+	if err != nil {
+		return nil, err
+	}
+	return &models.PasskeyRegistrationResponse{SessionId: sessionId, Options: options}, nil
+}
+
+// FinishRegistration verifies the attestation returned by the browser and stores the passkey
+func (service *WebAuthnService) FinishRegistration(userId uint, request models.PasskeyRegistrationRequest, ipAddress, userAgent string) (*models.PasskeyResponse, error) {
+	if service.webAuthn == nil {
+		return nil, ErrPasskeyDisabled
+	}
+	session, err := service.consumeSession(webAuthnRegistration, request.SessionId, userId)
+	if err != nil {
+		return nil, err
+	}
+	user, err := service.loadUser(int(userId))
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(request.Credential))
+	if err != nil {
+		log.Println("Invalid passkey registration response ", err)
+		return nil, ErrPasskey
+	}
+	credential, err := service.webAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		log.Println("Rejected passkey registration ", err)
+		return nil, ErrPasskey
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	transports := make(models.StringList, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+	entity := models.WebAuthnCredential{
+		UserId:          userId,
+		CredentialId:    credential.ID,
+		Name:            name,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Transports:      transports,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := service.db.Create(&entity).Error; err != nil {
+		log.Println("Failed to store passkey ", err)
+		return nil, ErrServer
+	}
+
+	service.securityEventService.Record(userId, EventPasskeyAdded, ipAddress, userAgent, models.JSONB{"name": name})
+	response := passkeyResponse(entity)
+	return &response, nil
+}
+
+// BeginLogin creates the options of a passwordless login, the browser offers the passkeys it has for this site
+func (service *WebAuthnService) BeginLogin() (*models.PasskeyAssertionResponse, error) {
+	if service.webAuthn == nil {
+		return nil, ErrPasskeyDisabled
+	}
+	// Without a password the passkey is the only factor, so the authenticator must verify the user
+	options, session, err := service.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		log.Println("Failed to begin passkey login ", err)
+		return nil, ErrServer
+	}
+
+	sessionId, err := service.saveSession(webAuthnLogin, 0, session)
+	if err != nil {
+		return nil, err
+	}
+	return &models.PasskeyAssertionResponse{SessionId: sessionId, Options: options}, nil
+}
+
+// FinishLogin verifies the assertion of a passwordless login and issues tokens
+// A user verified passkey is already multi factor, so two factor authentication is not asked again
+func (service *WebAuthnService) FinishLogin(request models.PasskeyLoginRequest, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	if service.webAuthn == nil {
+		return nil, ErrPasskeyDisabled
+	}
+	session, err := service.consumeSession(webAuthnLogin, request.SessionId, 0)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(request.Credential))
+	if err != nil {
+		log.Println("Invalid passkey login response ", err)
+		return nil, ErrPasskey
+	}
+
+	// The user is only known from the user handle stored in the passkey
+	var user *webAuthnUser
+	credential, err := service.webAuthn.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+		var userId int
+		if err := service.db.Model(&models.User{}).Select("id").Where("uuid = ?", string(userHandle)).Row().Scan(&userId); err != nil {
+			return nil, err
+		}
+		found, err := service.loadUser(userId)
+		if err != nil {
+			return nil, err
+		}
+		user = found
+		return found, nil
+	}, *session, parsed)
+	if err != nil {
+		log.Println("Rejected passkey login ", err)
+		return nil, ErrPasskey
+	}
+
+	if err := service.useCredential(user.user, credential, ipAddress, userAgent); err != nil {
+		return nil, err
+	}
+	return service.authService.generateTokenDetails(user.user, ipAddress, userAgent)
+}
+
+// BeginTwoFactor creates the options of the second step of a login, token is the short token returned by the password step
+func (service *WebAuthnService) BeginTwoFactor(token string) (*models.PasskeyAssertionResponse, error) {
+	if service.webAuthn == nil {
+		return nil, ErrPasskeyDisabled
+	}
+	userId, err := utils.ValidateTwoFactorJwtAndGetUserId(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	user, err := service.loadUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	if len(user.credentials) == 0 {
+		return nil, ErrPasskeyNotFound
+	}
+
+	options, session, err := service.webAuthn.BeginLogin(user)
+	if err != nil {
+		log.Println("Failed to begin passkey two factor ", err)
+		return nil, ErrServer
+	}
+
+	sessionId, err := service.saveSession(webAuthnTwoFactor, uint(userId), session)
+	if err != nil {
+		return nil, err
+	}
+	return &models.PasskeyAssertionResponse{SessionId: sessionId, Options: options}, nil
+}
+
+// FinishTwoFactor verifies the assertion of the second step and issues tokens
+func (service *WebAuthnService) FinishTwoFactor(request models.PasskeyTwoFactorRequest, ipAddress, userAgent string) (*models.AuthenticationResponse, error) {
+	if service.webAuthn == nil {
+		return nil, ErrPasskeyDisabled
+	}
+	userId, err := utils.ValidateTwoFactorJwtAndGetUserId(request.Token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	session, err := service.consumeSession(webAuthnTwoFactor, request.SessionId, uint(userId))
+	if err != nil {
+		return nil, err
+	}
+	user, err := service.loadUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(request.Credential))
+	if err != nil {
+		log.Println("Invalid passkey two factor response ", err)
+		return nil, ErrPasskey
+	}
+	credential, err := service.webAuthn.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		log.Println("Rejected passkey two factor ", err)
+		return nil, ErrPasskey
+	}
+
+	if err := service.useCredential(user.user, credential, ipAddress, userAgent); err != nil {
+		return nil, err
+	}
+	return service.authService.generateTokenDetails(user.user, ipAddress, userAgent)
+}
+
+// List returns the passkeys of the user
+func (service *WebAuthnService) List(userId uint) ([]models.PasskeyResponse, error) {
+	var credentials []models.WebAuthnCredential
+	if err := service.db.Where("user_id = ?", userId).Order("created_at").Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+
+	response := make([]models.PasskeyResponse, 0, len(credentials))
+	for _, entity := range credentials {
+		response = append(response, passkeyResponse(entity))
+	}
+	return response, nil
+}
+
+// Rename changes the name the user gave to the passkey
+func (service *WebAuthnService) Rename(userId uint, id, name string) error {
+	credentialId, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return ErrPasskeyNotFound
+	}
+	result := service.db.Model(&models.WebAuthnCredential{}).Where("user_id = ? AND credential_id = ?", userId, credentialId).
+		Update("name", strings.TrimSpace(name))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// Delete removes the passkey, the last one is kept while passkeys are the two factor method of the user
+func (service *WebAuthnService) Delete(userId uint, id, ipAddress, userAgent string) error {
+	credentialId, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return ErrPasskeyNotFound
+	}
+	userDetails := service.userService.Get(int(userId))
+	if userDetails == nil {
+		return ErrUserNotFound
+	}
+
+	var entity models.WebAuthnCredential
+	err = utils.Transaction(service.db, func(db *gorm.DB) error {
+		if err := db.Where("user_id = ? AND credential_id = ?", userId, credentialId).First(&entity).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrPasskeyNotFound
+			}
+			return err
+		}
+		if userDetails.TwoFactorEnabled && userDetails.TwoFactorMethod == "WEBAUTHN" {
+			var count int64
+			if err := db.Model(&models.WebAuthnCredential{}).Where("user_id = ?", userId).Count(&count).Error; err != nil {
+				return err
+			}
+			if count <= 1 {
+				return ErrLastPasskey
+			}
+		}
+		return db.Unscoped().Delete(&entity).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	service.securityEventService.Record(userId, EventPasskeyDeleted, ipAddress, userAgent, models.JSONB{"name": entity.Name})
+	return nil
+}
+
+// EnableTwoFactor makes passkeys the second factor of the user, at least one must be registered
+// The caller re-authenticates the user first, see AuthService.Reauthenticate
+func (service *WebAuthnService) EnableTwoFactor(userId uint) error {
+	var count int64
+	if err := service.db.Model(&models.WebAuthnCredential{}).Where("user_id = ?", userId).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrPasskeyNotFound
+	}
+	return service.userService.setTwoFactorMethod(userId, "WEBAUTHN")
+}
+
+// loadUser returns the active user with its passkeys
+func (service *WebAuthnService) loadUser(userId int) (*webAuthnUser, error) {
+	userDetails := service.userService.Get(userId)
+	if userDetails == nil {
+		return nil, ErrUserNotFound
+	}
+	if !userDetails.Active {
+		return nil, ErrAccountNotActive
+	}
+
+	var entities []models.WebAuthnCredential
+	if err := service.db.Where("user_id = ?", userId).Find(&entities).Error; err != nil {
+		return nil, err
+	}
+	user := &webAuthnUser{user: *userDetails}
+	for _, entity := range entities {
+		transports := make([]protocol.AuthenticatorTransport, 0, len(entity.Transports))
+		for _, transport := range entity.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(transport))
+		}
+		user.credentials = append(user.credentials, webauthn.Credential{
+			ID:              entity.CredentialId,
+			PublicKey:       entity.PublicKey,
+			AttestationType: entity.AttestationType,
+			Transport:       transports,
+			Flags:           webauthn.CredentialFlags{BackupEligible: entity.BackupEligible, BackupState: entity.BackupState},
+			Authenticator:   webauthn.Authenticator{AAGUID: entity.AAGUID, SignCount: entity.SignCount},
+		})
+	}
+	return user, nil
+}
+
+// useCredential stores the new signature counter of a passkey that was used to log in
+// A counter that did not increase means two copies of the key exist, the login is rejected
+func (service *WebAuthnService) useCredential(userDetails models.User, credential *webauthn.Credential, ipAddress, userAgent string) error {
+	if credential.Authenticator.CloneWarning {
+		service.securityEventService.Record(userDetails.ID, EventPasskeyCloned, ipAddress, userAgent, models.JSONB{
+			"credentialId": base64.RawURLEncoding.EncodeToString(credential.ID),
+		})
+		return ErrPasskeyCloned
+	}
+
+	err := service.db.Model(&models.WebAuthnCredential{}).Where("user_id = ? AND credential_id = ?", userDetails.ID, credential.ID).
+		Updates(map[string]interface{}{
+			"sign_count":   credential.Authenticator.SignCount,
+			"backup_state": credential.Flags.BackupState,
+			"last_used_at": sql.NullTime{Time: time.Now(), Valid: true},
+		}).Error
+	if err != nil {
+		log.Println("Failed to update passkey ", err)
+		return ErrServer
+	}
+	return nil
+}
+
+// saveSession stores the challenge of a ceremony and returns the id the client completes it with
+func (service *WebAuthnService) saveSession(purpose string, userId uint, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+
+	sessionId := utils.GenerateOpaqueToken(32)
+	entity := models.WebAuthnSession{
+		SessionHash: utils.HashToken(sessionId),
+		Purpose:     purpose,
+		UserId:      userId,
+		Data:        string(data),
+		ExpireTime:  sql.NullTime{Time: time.Now().Add(service.ceremonyTime), Valid: true},
+	}
+	if err := service.db.Create(&entity).Error; err != nil {
+		log.Println("Failed to create passkey session ", err)
+		return "", ErrServer
+	}
+	return sessionId, nil
+}
+
+// consumeSession deletes the session so its challenge is answered once, and returns its data
+func (service *WebAuthnService) consumeSession(purpose, sessionId string, userId uint) (*webauthn.SessionData, error) {
+	var entity models.WebAuthnSession
+	err := service.db.Where("session_hash = ? AND purpose = ? AND user_id = ? AND expire_time > NOW()", utils.HashToken(sessionId), purpose, userId).
+		First(&entity).Error
+	if err != nil {
+		return nil, ErrPasskey
+	}
+	result := service.db.Unscoped().Delete(&models.WebAuthnSession{}, entity.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrPasskey
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(entity.Data), &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func passkeyResponse(entity models.WebAuthnCredential) models.PasskeyResponse {
+	response := models.PasskeyResponse{
+		Id:         base64.RawURLEncoding.EncodeToString(entity.CredentialId),
+		Name:       entity.Name,
+		Transports: entity.Transports,
+		Synced:     entity.BackupState,
+		CreatedAt:  entity.CreatedAt,
+	}
+	if response.Transports == nil {
+		response.Transports = []string{}
+	}
+	if entity.LastUsedAt.Valid {
+		response.LastUsedAt = &entity.LastUsedAt.Time
+	}
+	return response
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/bachdang2k/security-golang/internal/models"
+	"github.com/bachdang2k/security-golang/internal/utils"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"gorm.io/gorm"
+)
+
+func testPasskeyUser(t *testing.T) models.User {
+	userDetails := NewUserService(db).GetByUsername("john.doe")
+	if userDetails == nil {
+		t.Fatal("Test user not found")
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Where("user_id = ?", userDetails.ID).Delete(&models.WebAuthnCredential{})
+		db.Model(&models.User{}).Where("id = ?", userDetails.ID).
+			Updates(map[string]interface{}{"two_factor_enabled": false, "two_factor_method": ""})
+	})
+	return *userDetails
+}
+
+func createTestPasskey(t *testing.T, userId uint, signCount uint32) models.WebAuthnCredential {
+	entity := models.WebAuthnCredential{
+		UserId:       userId,
+		CredentialId: []byte(utils.GenerateOpaqueToken(32)),
+		Name:         "Test passkey",
+		SignCount:    signCount,
+	}
+	if err := db.Create(&entity).Error; err != nil {
+		t.Fatal("Failed to create passkey ", err)
+	}
+	return entity
+}
+
+func TestConsumeSessionIsSingleUse(t *testing.T) {
+	service := NewWebAuthnService(db)
+	userDetails := testPasskeyUser(t)
+
+	sessionId, err := service.saveSession(webAuthnRegistration, userDetails.ID, &webauthn.SessionData{Challenge: "challenge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.consumeSession(webAuthnLogin, sessionId, userDetails.ID); !errors.Is(err, ErrPasskey) {
+		t.Error("A session must not complete another ceremony, got ", err)
+	}
+	session, err := service.consumeSession(webAuthnRegistration, sessionId, userDetails.ID)
+	if err != nil || session.Challenge != "challenge" {
+		t.Fatal("Failed to consume session ", err)
+	}
+	if _, err := service.consumeSession(webAuthnRegistration, sessionId, userDetails.ID); !errors.Is(err, ErrPasskey) {
+		t.Error("A session must only be consumed once, got ", err)
+	}
+}
+
+func TestConsumeSessionRejectsExpired(t *testing.T) {
+	service := NewWebAuthnService(db)
+	userDetails := testPasskeyUser(t)
+
+	sessionId, err := service.saveSession(webAuthnTwoFactor, userDetails.ID, &webauthn.SessionData{Challenge: "challenge"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&models.WebAuthnSession{}).Where("session_hash = ?", utils.HashToken(sessionId)).
+		Update("expire_time", gorm.Expr("NOW() - INTERVAL '1 minute'"))
+	if _, err := service.consumeSession(webAuthnTwoFactor, sessionId, userDetails.ID); !errors.Is(err, ErrPasskey) {
+		t.Error("An expired session must be rejected, got ", err)
+	}
+}
+
+func TestUseCredentialRejectsClone(t *testing.T) {
+	service := NewWebAuthnService(db)
+	userDetails := testPasskeyUser(t)
+	entity := createTestPasskey(t, userDetails.ID, 10)
+
+	credential := &webauthn.Credential{
+		ID:            entity.CredentialId,
+		Authenticator: webauthn.Authenticator{SignCount: 5, CloneWarning: true},
+	}
+	if err := service.useCredential(userDetails, credential, "", ""); !errors.Is(err, ErrPasskeyCloned) {
+		t.Fatal("A passkey whose counter went back must be rejected, got ", err)
+	}
+	var stored models.WebAuthnCredential
+	db.First(&stored, entity.ID)
+	if stored.SignCount != 10 {
+		t.Errorf("The counter of a cloned passkey must not change, got %d", stored.SignCount)
+	}
+
+	credential.Authenticator = webauthn.Authenticator{SignCount: 11}
+	if err := service.useCredential(userDetails, credential, "", ""); err != nil {
+		t.Fatal("Failed to use passkey ", err)
+	}
+	db.First(&stored, entity.ID)
+	if stored.SignCount != 11 || !stored.LastUsedAt.Valid {
+		t.Error("The counter and last use of the passkey must be updated")
+	}
+}
+
+func TestDeleteKeepsLastPasskey(t *testing.T) {
+	service := NewWebAuthnService(db)
+	userDetails := testPasskeyUser(t)
+	first := createTestPasskey(t, userDetails.ID, 0)
+	db.Model(&models.User{}).Where("id = ?", userDetails.ID).
+		Updates(map[string]interface{}{"two_factor_enabled": true, "two_factor_method": "WEBAUTHN"})
+
+	firstId := base64.RawURLEncoding.EncodeToString(first.CredentialId)
+	if err := service.Delete(userDetails.ID, firstId, "", ""); !errors.Is(err, ErrLastPasskey) {
+		t.Fatal("The last passkey of the two factor method must be kept, got ", err)
+	}
+
+	second := createTestPasskey(t, userDetails.ID, 0)
+	if err := service.Delete(userDetails.ID, firstId, "", ""); err != nil {
+		t.Fatal("Failed to delete passkey ", err)
+	}
+	secondId := base64.RawURLEncoding.EncodeToString(second.CredentialId)
+	if err := service.Delete(userDetails.ID, secondId, "", ""); !errors.Is(err, ErrLastPasskey) {
+		t.Error("The remaining passkey must be kept, got ", err)
+	}
+}
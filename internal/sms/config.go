@@ -0,0 +1,36 @@
+package sms
+
+import (
+	"log"
+	"os"
+)
+
+// SenderFromEnv builds the sender selected by SMS_PROVIDER, it returns false when SMS is not configured
+// twilio uses TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN, TWILIO_FROM and optionally TWILIO_API_URL,
+// file appends the messages to SMS_FILE and stdout prints them, both only for development
+func SenderFromEnv() (Sender, bool) {
+	switch os.Getenv("SMS_PROVIDER") {
+	case "twilio":
+		sender := &TwilioSender{
+			BaseURL:    os.Getenv("TWILIO_API_URL"),
+			AccountSid: os.Getenv("TWILIO_ACCOUNT_SID"),
+			AuthToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
+			From:       os.Getenv("TWILIO_FROM"),
+		}
+		if sender.AccountSid == "" || sender.AuthToken == "" || sender.From == "" {
+			log.Println("SMS is disabled, TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM are required")
+			return nil, false
+		}
+		return sender, true
+	case "file":
+		file, err := os.OpenFile(os.Getenv("SMS_FILE"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Println("SMS is disabled, failed to open SMS_FILE ", err)
+			return nil, false
+		}
+		return NewWriterSender(file), true
+	case "stdout":
+		return NewWriterSender(os.Stdout), true
+	}
+	return nil, false
+}
@@ -0,0 +1,114 @@
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidNumber = errors.New("the phone number is not a valid E.164 number")
+	ErrDelivery      = errors.New("the SMS provider did not accept the message")
+)
+
+// Sender delivers text messages to E.164 phone numbers
+type Sender interface {
+	Send(ctx context.Context, to, message string) error
+}
+
+// NormalizeNumber strips the spaces, dashes, dots and parentheses users type and checks the number is E.164,
+// a plus sign followed by up to 15 digits without a leading zero
+func NormalizeNumber(number string) (string, error) {
+	var normalized strings.Builder
+	for i, c := range strings.TrimSpace(number) {
+		switch {
+		case c == '+' && i == 0:
+			normalized.WriteRune(c)
+		case '0' <= c && c <= '9':
+			normalized.WriteRune(c)
+		case strings.ContainsRune(" -.()", c):
+		default:
+			return "", ErrInvalidNumber
+		}
+	}
+	result := normalized.String()
+	if len(result) < 3 || len(result) > 16 || result[0] != '+' || result[1] == '0' {
+		return "", ErrInvalidNumber
+	}
+	return result, nil
+}
+
+// TwilioSender sends messages with the Twilio Messages API, or any provider exposing the same API
+type TwilioSender struct {
+	// BaseURL defaults to https://api.twilio.com
+	BaseURL    string
+	AccountSid string
+	AuthToken  string
+	// From is the sending number or messaging service sid
+	From       string
+	HTTPClient *http.Client
+}
+
+func (sender *TwilioSender) Send(ctx context.Context, to, message string) error {
+	baseURL := sender.BaseURL
+	if baseURL == "" {
+		baseURL = "https://api.twilio.com"
+	}
+	httpClient := sender.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	form := url.Values{"To": {to}, "Body": {message}}
+	if strings.HasPrefix(sender.From, "MG") {
+		form.Set("MessagingServiceSid", sender.From)
+	} else {
+		form.Set("From", sender.From)
+	}
+	endpoint := strings.TrimSuffix(baseURL, "/") + "/2010-04-01/Accounts/" + url.PathEscape(sender.AccountSid) + "/Messages.json"
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth(sender.AccountSid, sender.AuthToken)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDelivery, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 4<<10))
+		return fmt.Errorf("%w: status %d: %s", ErrDelivery, response.StatusCode, body)
+	}
+	return nil
+}
+
+// WriterSender writes every message to a writer instead of sending it, for development
+type WriterSender struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewWriterSender writes the messages to writer, os.Stdout when it is nil
+func NewWriterSender(writer io.Writer) *WriterSender {
+	if writer == nil {
+		writer = os.Stdout
+	}
+	return &WriterSender{writer: writer}
+}
+
+func (sender *WriterSender) Send(_ context.Context, to, message string) error {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	_, err := fmt.Fprintf(sender.writer, "%s SMS to %s: %s\n", time.Now().Format(time.RFC3339), to, message)
+	return err
+}
@@ -0,0 +1,67 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeNumber(t *testing.T) {
+	valid := map[string]string{
+		"+14155552671":       "+14155552671",
+		" +44 20 7183-8750 ": "+442071838750",
+		"+1 (415) 555.2671":  "+14155552671",
+	}
+	for input, expected := range valid {
+		if number, err := NormalizeNumber(input); err != nil || number != expected {
+			t.Error("Expected", input, "to normalize to", expected, number, err)
+		}
+	}
+	for _, input := range []string{"", "14155552671", "+04155552671", "+1415555267112345", "+1415abc", "+1+415"} {
+		if _, err := NormalizeNumber(input); !errors.Is(err, ErrInvalidNumber) {
+			t.Error("Expected", input, "to be rejected")
+		}
+	}
+}
+
+func TestTwilioSender(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		_ = r.ParseForm()
+		if username, password, _ := r.BasicAuth(); username != "AC123" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sender := &TwilioSender{BaseURL: server.URL, AccountSid: "AC123", AuthToken: "secret", From: "+15005550006"}
+	if err := sender.Send(context.Background(), "+14155552671", "Your code is 123456"); err != nil {
+		t.Fatal("Failed to send", err)
+	}
+	if received.URL.Path != "/2010-04-01/Accounts/AC123/Messages.json" || received.PostForm.Get("To") != "+14155552671" ||
+		received.PostForm.Get("From") != "+15005550006" || received.PostForm.Get("Body") != "Your code is 123456" {
+		t.Error("Unexpected request", received.URL.Path, received.PostForm)
+	}
+
+	sender.AuthToken = "wrong"
+	if err := sender.Send(context.Background(), "+14155552671", "Your code is 123456"); !errors.Is(err, ErrDelivery) {
+		t.Error("Expected a rejected message to fail", err)
+	}
+}
+
+func TestWriterSender(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := NewWriterSender(&buffer).Send(context.Background(), "+14155552671", "Your code is 123456"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "SMS to +14155552671: Your code is 123456") {
+		t.Error("Unexpected output", buffer.String())
+	}
+}
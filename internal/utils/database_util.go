@@ -47,7 +47,8 @@ func GetMainDatabaseConnections(config DatabaseConfig) (*gorm.DB, error) {
 		connectionString = normalConnectionString
 	}
 
-	db, err := gorm.Open(postgres.Open(connectionString))
+	// TranslateError reports unique constraint violations as gorm.ErrDuplicatedKey
+	db, err := gorm.Open(postgres.Open(connectionString), &gorm.Config{TranslateError: true})
 
 	// var databaseConnection *sql.DB
 	// databaseConnection, err := sql.Open("postgres", connectionString)
@@ -81,7 +82,7 @@ func GetMainDatabaseConnections(config DatabaseConfig) (*gorm.DB, error) {
 
 func MigrateDatabase(db *gorm.DB) error {
 	DropUnusedColumns(db, &models.User{})
-	return db.AutoMigrate(&models.User{}, &models.TwoFactorRequest{}, &models.UserRefreshToken{}, &models.ResetPasswordRequest{}, &models.Role{}, &models.OTPRequest{})
+	return db.AutoMigrate(&models.User{}, &models.TwoFactorRequest{}, &models.UserRefreshToken{}, &models.ResetPasswordRequest{}, &models.Role{}, &models.OTPRequest{}, &models.EmailVerification{}, &models.JwtSigningKey{}, &models.SecurityEvent{}, &models.RevokedToken{}, &models.OAuthClient{}, &models.AuthorizationCode{}, &models.DeviceAuthorization{}, &models.FederatedIdentity{}, &models.FederatedLoginRequest{}, &models.SAMLLoginRequest{}, &models.WebAuthnCredential{}, &models.WebAuthnSession{}, &models.RecoveryCode{}, &models.PhoneVerification{}, &models.FailedAttempt{})
 }
 
 func DropUnusedColumns(db *gorm.DB, table interface{}) {
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/bachdang2k/security-golang/internal/models"
 )
@@ -16,6 +18,50 @@ func GetUserIdFromHttpContext(r *http.Request) int {
 	return userId
 }
 
+// GetTokenIdFromHttpContext returns the jti and expiry of the access token used for the request
+func GetTokenIdFromHttpContext(r *http.Request) (string, time.Time) {
+	claims, _ := r.Context().Value("claims").(map[string]interface{})
+	jti, _ := claims["jti"].(string)
+	expires, _ := claims["exp"].(time.Time)
+	return jti, expires
+}
+
+// GetScopeFromHttpContext returns the scope of the access token used for the request, empty for tokens not issued to an OAuth client
+func GetScopeFromHttpContext(r *http.Request) string {
+	claims, _ := r.Context().Value("claims").(map[string]interface{})
+	scope, _ := claims["scope"].(string)
+	return scope
+}
+
+// GetClientIdFromHttpContext returns the OAuth client the access token was issued to, empty for first party tokens
+func GetClientIdFromHttpContext(r *http.Request) string {
+	claims, _ := r.Context().Value("claims").(map[string]interface{})
+	clientId, _ := claims["clientId"].(string)
+	return clientId
+}
+
+// GetSubjectTypeFromHttpContext returns utils.SubjectTypeUser or utils.SubjectTypeClient for the access token used for the request
+func GetSubjectTypeFromHttpContext(r *http.Request) string {
+	claims, _ := r.Context().Value("claims").(map[string]interface{})
+	subjectType, _ := claims["subjectType"].(string)
+	return subjectType
+}
+
+// GetClientSubjectFromHttpContext returns the verified TLS client certificate subject, empty when none was presented
+func GetClientSubjectFromHttpContext(r *http.Request) string {
+	subject, _ := r.Context().Value("clientSubject").(string)
+	return subject
+}
+
+// GetIpAddress returns the address of the client without the port, forwarded headers are not trusted
+func GetIpAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // GetJsonInput Get JsonData from http request
 func GetJsonInput(input interface{}, req *http.Request) error {
 	body, err := io.ReadAll(req.Body)
@@ -53,3 +99,15 @@ func JSONResponse(w http.ResponseWriter, result interface{}) {
 	w.WriteHeader(http.StatusOK)
 	_ = json.NewEncoder(w).Encode(result)
 }
+
+// OAuthError send errors in the RFC 6749 format expected by OAuth clients
+func OAuthError(w http.ResponseWriter, errorCode, description string, code int) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(models.OAuthErrorResponse{Error: errorCode, ErrorDescription: description})
+}
@@ -0,0 +1,327 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnsupportedAlgorithm = errors.New("unsupported JWT signing algorithm")
+	ErrKeyAlgorithmMismatch = errors.New("key type does not match the JWT signing algorithm")
+	ErrUnknownKeyId         = errors.New("unknown JWT key id")
+	ErrEmptySecret          = errors.New("a JWT secret is required for HS256")
+	ErrNoSigningKey         = errors.New("no JWT signing key is configured")
+)
+
+var supportedJwtAlgorithms = []string{
+	jwt.SigningMethodHS256.Alg(),
+	jwt.SigningMethodRS256.Alg(),
+	jwt.SigningMethodES256.Alg(),
+	jwt.SigningMethodEdDSA.Alg(),
+}
+
+// JwtConfig selects the algorithm and key used to sign tokens
+type JwtConfig struct {
+	// Algorithm is one of HS256, RS256, ES256 or EdDSA
+	Algorithm string
+	// Secret is the shared secret used by HS256
+	Secret string
+	// PrivateKeyFile is the PEM encoded private key used by the asymmetric algorithms
+	PrivateKeyFile string
+	// KeyId is placed in the kid header, derived from the public key when empty
+	KeyId string
+}
+
+// SigningKey is a key able to sign or verify tokens for one algorithm
+type SigningKey struct {
+	Id        string
+	Algorithm string
+	method    jwt.SigningMethod
+	private   interface{}
+	public    interface{}
+}
+
+// keySet holds the current signing key and every key tokens may still be verified with
+type keySet struct {
+	mu           sync.RWMutex
+	signing      *SigningKey
+	verification map[string]*SigningKey
+}
+
+var jwtKeys = &keySet{verification: make(map[string]*SigningKey)}
+
+// InitJwtKeys configures the signing key from the config, it replaces every previously configured key
+func InitJwtKeys(config JwtConfig) error {
+	var (
+		key *SigningKey
+		err error
+	)
+	if config.Algorithm == "" || config.Algorithm == jwt.SigningMethodHS256.Alg() {
+		// A zero length key would let anyone sign tokens
+		if config.Secret == "" {
+			return ErrEmptySecret
+		}
+		key = NewHMACSigningKey(config.KeyId, []byte(config.Secret))
+	} else {
+		var keyFile []byte
+		keyFile, err = os.ReadFile(config.PrivateKeyFile)
+		if err != nil {
+			return err
+		}
+		key, err = ParseSigningKeyFromPEM(config.KeyId, config.Algorithm, keyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	jwtKeys.mu.Lock()
+	defer jwtKeys.mu.Unlock()
+	jwtKeys.signing = key
+	jwtKeys.verification = map[string]*SigningKey{key.Id: key}
+	return nil
+}
+
+// SetJwtKeys replaces the key ring, tokens are signed with signing and verified with any of the verification keys
+func SetJwtKeys(signing *SigningKey, verification []*SigningKey) {
+	keys := map[string]*SigningKey{signing.Id: signing}
+	for _, key := range verification {
+		keys[key.Id] = key
+	}
+
+	jwtKeys.mu.Lock()
+	defer jwtKeys.mu.Unlock()
+	jwtKeys.signing = signing
+	jwtKeys.verification = keys
+}
+
+// GenerateSigningKey creates a new random private key for an asymmetric algorithm
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	var (
+		privateKey interface{}
+		err        error
+	)
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		privateKey, err = rsa.GenerateKey(cryptorand.Reader, 2048)
+	case jwt.SigningMethodES256.Alg():
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, privateKey, err = ed25519.GenerateKey(cryptorand.Reader)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey("", algorithm, privateKey)
+}
+
+// PrivateKeyPEM encodes the private key as PKCS#8 so it can be loaded by ParseSigningKeyFromPEM
+func (key *SigningKey) PrivateKeyPEM() ([]byte, error) {
+	if key.method == jwt.SigningMethodHS256 {
+		return nil, ErrUnsupportedAlgorithm
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key.private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// NewHMACSigningKey creates a HS256 key from a shared secret
+func NewHMACSigningKey(keyId string, secret []byte) *SigningKey {
+	if keyId == "" {
+		keyId = "default"
+	}
+	return &SigningKey{Id: keyId, Algorithm: jwt.SigningMethodHS256.Alg(), method: jwt.SigningMethodHS256, private: secret, public: secret}
+}
+
+// ParseSigningKeyFromPEM loads a PKCS#8, PKCS#1 or SEC 1 private key for the algorithm
+func ParseSigningKeyFromPEM(keyId, algorithm string, pemBytes []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found in private key")
+	}
+
+	var (
+		privateKey interface{}
+		err        error
+	)
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(keyId, algorithm, privateKey)
+}
+
+// NewSigningKey wraps a private key, the key type must match the algorithm
+func NewSigningKey(keyId, algorithm string, privateKey interface{}) (*SigningKey, error) {
+	key := &SigningKey{Id: keyId, Algorithm: algorithm, private: privateKey}
+	switch algorithm {
+	case jwt.SigningMethodRS256.Alg():
+		rsaKey, ok := privateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, ErrKeyAlgorithmMismatch
+		}
+		key.method, key.public = jwt.SigningMethodRS256, &rsaKey.PublicKey
+	case jwt.SigningMethodES256.Alg():
+		ecKey, ok := privateKey.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return nil, ErrKeyAlgorithmMismatch
+		}
+		key.method, key.public = jwt.SigningMethodES256, &ecKey.PublicKey
+	case jwt.SigningMethodEdDSA.Alg():
+		edKey, ok := privateKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, ErrKeyAlgorithmMismatch
+		}
+		key.method, key.public = jwt.SigningMethodEdDSA, edKey.Public()
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedAlgorithm, algorithm)
+	}
+
+	if key.Id == "" {
+		der, err := x509.MarshalPKIXPublicKey(key.public)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(der)
+		key.Id = base64.RawURLEncoding.EncodeToString(sum[:8])
+	}
+	return key, nil
+}
+
+// currentSigningKey returns the configured signing key, falling back to HS256 with JWT_SECRET
+// It returns nil when nothing is configured and JWT_SECRET is empty
+func currentSigningKey() *SigningKey {
+	jwtKeys.mu.RLock()
+	key := jwtKeys.signing
+	jwtKeys.mu.RUnlock()
+	if key != nil {
+		return key
+	}
+
+	// Nothing configured yet, read the secret now rather than at package init so .env files are honored
+	_ = InitJwtKeys(JwtConfig{Secret: os.Getenv("JWT_SECRET")})
+	jwtKeys.mu.RLock()
+	defer jwtKeys.mu.RUnlock()
+	return jwtKeys.signing
+}
+
+// SigningAlgorithm returns the algorithm tokens are currently signed with, empty when no key is configured
+func SigningAlgorithm() string {
+	key := currentSigningKey()
+	if key == nil {
+		return ""
+	}
+	return key.Algorithm
+}
+
+// signJwtClaims signs the claims with the current key and sets the kid header
+func signJwtClaims(claims jwt.Claims) (string, error) {
+	key := currentSigningKey()
+	if key == nil {
+		return "", ErrNoSigningKey
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.private)
+}
+
+// jwtVerificationKey is the jwt.Keyfunc resolving the kid header to a verification key
+func jwtVerificationKey(token *jwt.Token) (interface{}, error) {
+	signing := currentSigningKey()
+	keyId, _ := token.Header["kid"].(string)
+
+	jwtKeys.mu.RLock()
+	key, ok := jwtKeys.verification[keyId]
+	jwtKeys.mu.RUnlock()
+	if keyId == "" {
+		// Tokens issued before kid headers were introduced
+		key, ok = signing, true
+	}
+	if !ok || key == nil {
+		return nil, ErrUnknownKeyId
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, ErrKeyAlgorithmMismatch
+	}
+	return key.public, nil
+}
+
+// JSONWebKey is a public key in RFC 7517 format
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// GetJSONWebKeySet returns the public verification keys, shared HS256 secrets are never published
+func GetJSONWebKeySet() JSONWebKeySet {
+	currentSigningKey()
+	jwtKeys.mu.RLock()
+	defer jwtKeys.mu.RUnlock()
+
+	keySet := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range jwtKeys.verification {
+		if jwk, ok := key.JSONWebKey(); ok {
+			keySet.Keys = append(keySet.Keys, jwk)
+		}
+	}
+	return keySet
+}
+
+// JSONWebKey returns the public part of the key, false for symmetric keys
+func (key *SigningKey) JSONWebKey() (JSONWebKey, bool) {
+	jwk := JSONWebKey{KeyId: key.Id, Use: "sig", Algorithm: key.Algorithm}
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = public.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return JSONWebKey{}, false
+	}
+	return jwk, true
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Tokens are signed with HS256 and JWT_SECRET unless a test configures another key
+	if os.Getenv("JWT_SECRET") == "" {
+		os.Setenv("JWT_SECRET", "test-secret")
+	}
+	os.Exit(m.Run())
+}
+
+func TestAsymmetricJwtSigning(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	var tests = []struct {
+		algorithm string
+		key       interface{}
+		keyType   string
+	}{
+		{"RS256", rsaKey, "RSA"},
+		{"ES256", ecKey, "EC"},
+		{"EdDSA", edKey, "OKP"},
+	}
+	defer InitJwtKeys(JwtConfig{Secret: os.Getenv("JWT_SECRET")})
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			der, err := x509.MarshalPKCS8PrivateKey(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyFile := filepath.Join(t.TempDir(), "jwt.pem")
+			if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := InitJwtKeys(JwtConfig{Algorithm: tt.algorithm, PrivateKeyFile: keyFile}); err != nil {
+				t.Fatal("Failed to load key", err)
+			}
+
+			token, err := GenerateJwtToken(104, []string{"USER"}, time.Minute)
+			if err != nil {
+				t.Fatal("Failed to generate token", err)
+			}
+			if _, err := ValidateJwtAndGetClaims(token); err != nil {
+				t.Error("Failed to validate token", err)
+			}
+
+			keySet := GetJSONWebKeySet()
+			if len(keySet.Keys) != 1 || keySet.Keys[0].KeyType != tt.keyType || keySet.Keys[0].KeyId == "" {
+				t.Errorf("Unexpected JWKS %+v", keySet)
+			}
+		})
+	}
+}
+
+func TestSigningKeyAlgorithmMismatch(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := NewSigningKey("", "RS256", ecKey); err != ErrKeyAlgorithmMismatch {
+		t.Error("Expected EC key to be rejected for RS256")
+	}
+}
+
+func TestEmptyHMACSecretIsRejected(t *testing.T) {
+	if err := InitJwtKeys(JwtConfig{Algorithm: "HS256"}); err != ErrEmptySecret {
+		t.Error("Expected an empty HS256 secret to be rejected", err)
+	}
+}
+
+func TestHMACKeyIsNotPublished(t *testing.T) {
+	defer InitJwtKeys(JwtConfig{Secret: os.Getenv("JWT_SECRET")})
+	_ = InitJwtKeys(JwtConfig{Secret: "shared-secret"})
+	if keySet := GetJSONWebKeySet(); len(keySet.Keys) != 0 {
+		t.Error("Expected shared secrets not to be published")
+	}
+}
+
+func TestJwtKeyRotation(t *testing.T) {
+	defer InitJwtKeys(JwtConfig{Secret: os.Getenv("JWT_SECRET")})
+	oldKey, err := GenerateSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := GenerateSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetJwtKeys(oldKey, nil)
+	oldToken, _ := GenerateJwtToken(105, []string{"USER"}, time.Minute)
+
+	// Rotated but the old key is still within its overlap window
+	SetJwtKeys(newKey, []*SigningKey{oldKey})
+	if _, err := ValidateJwtAndGetClaims(oldToken); err != nil {
+		t.Error("Expected token signed with previous key to stay valid", err)
+	}
+	if len(GetJSONWebKeySet().Keys) != 2 {
+		t.Error("Expected both keys to be published")
+	}
+
+	// Old key retired
+	SetJwtKeys(newKey, nil)
+	if _, err := ValidateJwtAndGetClaims(oldToken); err == nil {
+		t.Error("Expected token signed with retired key to be rejected")
+	}
+
+	encoded, err := newKey.PrivateKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSigningKeyFromPEM("", "EdDSA", encoded)
+	if err != nil || parsed.Id != newKey.Id {
+		t.Error("Expected key to round trip through PEM")
+	}
+}
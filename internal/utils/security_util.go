@@ -1,10 +1,15 @@
 package utils
 
 import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math/rand"
-	"os"
+	"math/big"
 	"strconv"
 	"strings"
 	"time"
@@ -16,65 +21,292 @@ import (
 type authClaim struct {
 	UserId int      `json:"userId"`
 	Roles  []string `json:"roles"`
+	// Scope and ClientId are only set on tokens issued to OAuth clients
+	Scope    string `json:"scope,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	// SubjectType tells user tokens from tokens a client obtained for itself, empty means user
+	SubjectType string `json:"sub_type,omitempty"`
 	jwt.RegisteredClaims
 }
 
-var jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+// IDTokenClaims are the claims of an OpenID Connect ID token, the audience is the client id
+type IDTokenClaims struct {
+	Nonce             string           `json:"nonce,omitempty"`
+	AuthTime          *jwt.NumericDate `json:"auth_time,omitempty"`
+	PreferredUsername string           `json:"preferred_username,omitempty"`
+	GivenName         string           `json:"given_name,omitempty"`
+	FamilyName        string           `json:"family_name,omitempty"`
+	Email             string           `json:"email,omitempty"`
+	PhoneNumber       string           `json:"phone_number,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var (
+	ErrInvalidSignedToken = errors.New("signed token is invalid")
+	ErrExpiredSignedToken = errors.New("signed token has expired")
+)
+
+// Subject types of access tokens, client tokens have no user id and their subject is the client id
+const (
+	SubjectTypeUser   = "user"
+	SubjectTypeClient = "client"
+)
+
+// Audiences keep short lived two factor tokens from being accepted as access tokens
+const (
+	AccessTokenAudience    = "access"
+	TwoFactorTokenAudience = "two-factor"
+)
 
 // Generates a Jwt Token return a string or error
 func GenerateJwtToken(userId int, roles []string, expire time.Duration) (string, error) {
-	claims := authClaim{
-		userId,
-		roles,
-		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expire)),
-		},
-	}
-	claimToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return claimToken.SignedString(jwtSecret)
+	return generateJwtToken(authClaim{UserId: userId, Roles: roles, SubjectType: SubjectTypeUser}, expire, AccessTokenAudience)
+}
+
+// GenerateClientJwtToken generates an access token issued to an OAuth client, limited to the granted scope
+func GenerateClientJwtToken(userId int, roles []string, scope, clientId string, expire time.Duration) (string, error) {
+	return generateJwtToken(authClaim{UserId: userId, Roles: roles, Scope: scope, ClientId: clientId, SubjectType: SubjectTypeUser}, expire, AccessTokenAudience)
+}
+
+// GenerateClientCredentialsJwtToken generates an access token a client obtained for itself, its subject is the client id
+func GenerateClientCredentialsJwtToken(clientId, scope string, expire time.Duration) (string, error) {
+	claims := authClaim{Scope: scope, ClientId: clientId, SubjectType: SubjectTypeClient}
+	claims.Subject = clientId
+	return generateJwtToken(claims, expire, AccessTokenAudience)
+}
+
+// GenerateTwoFactorJwtToken generates a token that only proves the password step of a TOTP login
+func GenerateTwoFactorJwtToken(userId int, expire time.Duration) (string, error) {
+	return generateJwtToken(authClaim{UserId: userId, SubjectType: SubjectTypeUser}, expire, TwoFactorTokenAudience)
+}
+
+func generateJwtToken(claims authClaim, expire time.Duration, audience string) (string, error) {
+	claims.ID = GenerateUUID()
+	claims.IssuedAt = jwt.NewNumericDate(time.Now())
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(expire))
+	claims.Audience = jwt.ClaimStrings{audience}
+	return signJwtClaims(claims)
+}
+
+// GenerateIDToken signs an OpenID Connect ID token, it is never accepted as an access token since its audience is the client
+func GenerateIDToken(claims IDTokenClaims, expire time.Duration) (string, error) {
+	claims.ID = GenerateUUID()
+	claims.IssuedAt = jwt.NewNumericDate(time.Now())
+	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(expire))
+	return signJwtClaims(claims)
 }
 
 // ValidatesJWtAndGetClaims the JWT Key and return the claims
 func ValidateJwtAndGetClaims(tokenString string) (map[string]interface{}, error) {
+	claims, err := parseJwtToken(tokenString, AccessTokenAudience)
+	if err != nil {
+		return nil, err
+	}
 	res := make(map[string]interface{})
-	token, err := jwt.ParseWithClaims(tokenString, &authClaim{}, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	res["userId"] = claims.UserId
+	res["roles"] = claims.Roles
+	res["jti"] = claims.ID
+	res["scope"] = claims.Scope
+	res["clientId"] = claims.ClientId
+	res["subjectType"] = claims.SubjectType
+	if claims.SubjectType == "" {
+		// Tokens issued before subject types existed are user tokens
+		res["subjectType"] = SubjectTypeUser
+	}
+	if claims.IssuedAt != nil {
+		res["iat"] = claims.IssuedAt.Time
+	}
+	if claims.ExpiresAt != nil {
+		res["exp"] = claims.ExpiresAt.Time
+	}
+	return res, nil
+}
+
+// ValidateTwoFactorJwtAndGetUserId validates a token made by GenerateTwoFactorJwtToken and returns the user id
+func ValidateTwoFactorJwtAndGetUserId(tokenString string) (int, error) {
+	claims, err := parseJwtToken(tokenString, TwoFactorTokenAudience)
+	if err != nil {
+		return 0, err
+	}
+	return claims.UserId, nil
+}
+
+func parseJwtToken(tokenString, audience string) (*authClaim, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &authClaim{}, jwtVerificationKey,
+		jwt.WithValidMethods(supportedJwtAlgorithms), jwt.WithAudience(audience))
+	if err != nil {
+		return nil, err
+	}
 	if claims, ok := token.Claims.(*authClaim); ok && token.Valid {
-		res["userId"] = claims.UserId
-		res["roles"] = claims.Roles
-		return res, nil
+		return claims, nil
+	}
+	return nil, jwt.ErrTokenInvalidClaims
+}
+
+// VerifyCodeChallenge checks a PKCE code verifier against its S256 code challenge (RFC 7636)
+func VerifyCodeChallenge(codeVerifier, codeChallenge string) bool {
+	// RFC 7636 requires 43 to 128 characters from the unreserved set
+	if len(codeVerifier) < 43 || len(codeVerifier) > 128 {
+		return false
+	}
+	for _, c := range codeVerifier {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("-._~", c)) {
+			return false
+		}
 	}
+	return hmac.Equal([]byte(CodeChallengeS256(codeVerifier)), []byte(codeChallenge))
+}
 
-	return nil, err
+// CodeChallengeS256 derives the S256 PKCE code challenge of a code verifier
+func CodeChallengeS256(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// GenerateCodeVerifier returns a random PKCE code verifier of 43 characters
+func GenerateCodeVerifier() string {
+	verifier := make([]byte, 32)
+	if _, err := cryptorand.Read(verifier); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(verifier)
 }
 
 // GenerateOpaqueToken function to generate random tokens
 func GenerateOpaqueToken(randomCharsLength int) string {
 	var alphaNum = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 	randomLetters := make([]rune, randomCharsLength)
-	randomSource := rand.NewSource(time.Now().UnixNano())
-	random := rand.New(randomSource)
-	fmt.Printf("randomLetters = %v - randomSource = %v - random = %v\n", randomLetters, randomSource, random)
 	for i := range randomLetters {
-		randomLetters[i] = alphaNum[random.Intn(len(randomLetters))]
+		randomLetters[i] = alphaNum[randomInt(len(alphaNum))]
 	}
 	// Convert to sha1 string
 	randomString := string(randomLetters)
 	return fmt.Sprintf("%x", sha1.Sum([]byte(randomString)))
 }
 
+// HashToken returns the hex encoded SHA-256 of a token so it can be stored and looked up without keeping the plain value
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateSignedToken creates a url safe token carrying the payload and expiry, authenticated with HMAC-SHA256
+func GenerateSignedToken(secret []byte, payload string, expires time.Time) string {
+	body := base64.RawURLEncoding.EncodeToString([]byte(payload + "|" + strconv.FormatInt(expires.Unix(), 10)))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	return body + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ParseSignedToken verifies the signature and expiry of a token made by GenerateSignedToken and returns its payload
+func ParseSignedToken(secret []byte, token string) (string, error) {
+	body, signature, found := strings.Cut(token, ".")
+	if !found {
+		return "", ErrInvalidSignedToken
+	}
+	givenMac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return "", ErrInvalidSignedToken
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(body))
+	if !hmac.Equal(givenMac, mac.Sum(nil)) {
+		return "", ErrInvalidSignedToken
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return "", ErrInvalidSignedToken
+	}
+	separator := strings.LastIndex(string(decoded), "|")
+	if separator < 0 {
+		return "", ErrInvalidSignedToken
+	}
+	expires, err := strconv.ParseInt(string(decoded[separator+1:]), 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignedToken
+	}
+	if time.Now().Unix() > expires {
+		return "", ErrExpiredSignedToken
+	}
+	return string(decoded[:separator]), nil
+}
+
+// GenerateUUID generates a random version 4 UUID
+func GenerateUUID() string {
+	uuid := make([]byte, 16)
+	if _, err := cryptorand.Read(uuid); err != nil {
+		panic(err)
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+}
+
 // Generate Random Digits
 func GenerateRandomDigits(length int) string {
-	randomSource := rand.NewSource(time.Now().UnixNano())
-	random := rand.New(randomSource)
 	randNumber := make([]string, length)
 	for i := range randNumber {
-		randNumber[i] = strconv.Itoa(random.Intn(9))
+		randNumber[i] = strconv.Itoa(randomInt(10))
 	}
 	return strings.Join(randNumber, "")
 }
 
+// userCodeAlphabet has no vowels or look-alike characters, as RFC 8628 recommends for codes typed by users
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// GenerateUserCode returns a random device flow user code formatted as XXXX-XXXX
+func GenerateUserCode() string {
+	code := make([]byte, 8)
+	for i := range code {
+		code[i] = userCodeAlphabet[randomInt(len(userCodeAlphabet))]
+	}
+	return string(code[:4]) + "-" + string(code[4:])
+}
+
+// NormalizeUserCode uppercases a user code and drops the dash and any other characters users add while typing it
+func NormalizeUserCode(userCode string) string {
+	var normalized strings.Builder
+	for _, c := range strings.ToUpper(userCode) {
+		if strings.ContainsRune(userCodeAlphabet, c) {
+			normalized.WriteRune(c)
+		}
+	}
+	return normalized.String()
+}
+
+// recoveryCodeAlphabet is lowercase without look-alike characters, recovery codes are read from paper and typed by users
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GenerateRecoveryCode returns a random two factor recovery code formatted as xxxxx-xxxxx
+func GenerateRecoveryCode() string {
+	code := make([]byte, 10)
+	for i := range code {
+		code[i] = recoveryCodeAlphabet[randomInt(len(recoveryCodeAlphabet))]
+	}
+	return string(code[:5]) + "-" + string(code[5:])
+}
+
+// NormalizeRecoveryCode lowercases a recovery code and drops the dash and spaces users add while typing it
+func NormalizeRecoveryCode(code string) string {
+	var normalized strings.Builder
+	for _, c := range strings.ToLower(code) {
+		if strings.ContainsRune(recoveryCodeAlphabet, c) {
+			normalized.WriteRune(c)
+		}
+	}
+	return normalized.String()
+}
+
+// randomInt returns a uniform random number in [0, max) from the system's secure random source
+func randomInt(max int) int {
+	n, err := cryptorand.Int(cryptorand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		panic(err)
+	}
+	return int(n.Int64())
+}
+
 // Function to check for special chars
 func checkSpecialChars(specialChar rune) bool {
 	specialChars := `@#$%^&*()_+\-=\[\]{};':"\\|,.<>\/?`
@@ -117,3 +349,18 @@ func IsStrongPassword(password string) bool {
 
 	return true
 }
+
+// BackoffDelay is how long to wait after the given number of failed attempts, doubling from base up to max
+func BackoffDelay(failures int, base, max time.Duration) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -76,3 +77,137 @@ func TestStrongPasswordCheck(t *testing.T) {
 	}
 
 }
+
+func TestSignedToken(t *testing.T) {
+	secret := []byte("signing-secret")
+	token := GenerateSignedToken(secret, "user:nonce", time.Now().Add(time.Minute))
+
+	payload, err := ParseSignedToken(secret, token)
+	if err != nil || payload != "user:nonce" {
+		t.Error("Failed to parse signed token", err)
+	}
+	if _, err := ParseSignedToken([]byte("other-secret"), token); err != ErrInvalidSignedToken {
+		t.Error("Expected token signed with another secret to be rejected")
+	}
+	if _, err := ParseSignedToken(secret, token+"x"); err != ErrInvalidSignedToken {
+		t.Error("Expected tampered token to be rejected")
+	}
+
+	expired := GenerateSignedToken(secret, "user:nonce", time.Now().Add(-time.Minute))
+	if _, err := ParseSignedToken(secret, expired); err != ErrExpiredSignedToken {
+		t.Error("Expected expired token to be rejected")
+	}
+}
+
+func TestTwoFactorJwtIsNotAnAccessToken(t *testing.T) {
+	token, err := GenerateTwoFactorJwtToken(103, time.Minute)
+	if err != nil {
+		t.Fatal("Failed to generate token", err)
+	}
+	if _, err := ValidateJwtAndGetClaims(token); err == nil {
+		t.Error("Expected two factor token to be rejected as an access token")
+	}
+	userId, err := ValidateTwoFactorJwtAndGetUserId(token)
+	if err != nil || userId != 103 {
+		t.Error("Failed to validate two factor token", err)
+	}
+
+	accessToken, _ := GenerateJwtToken(103, []string{"USER"}, time.Minute)
+	if _, err := ValidateTwoFactorJwtAndGetUserId(accessToken); err == nil {
+		t.Error("Expected access token to be rejected as a two factor token")
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// Example from RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if !VerifyCodeChallenge(verifier, challenge) {
+		t.Error("Expected code verifier to match the challenge")
+	}
+	if VerifyCodeChallenge(verifier+"x", challenge) {
+		t.Error("Expected wrong code verifier to be rejected")
+	}
+	if VerifyCodeChallenge("short", challenge) {
+		t.Error("Expected too short code verifier to be rejected")
+	}
+}
+
+func TestClientJwtCarriesScope(t *testing.T) {
+	token, err := GenerateClientJwtToken(104, []string{"USER"}, "profile email", "client-1", time.Minute)
+	if err != nil {
+		t.Fatal("Failed to generate token", err)
+	}
+	claims, err := ValidateJwtAndGetClaims(token)
+	if err != nil {
+		t.Fatal("Failed to validate token", err)
+	}
+	if claims["scope"] != "profile email" || claims["clientId"] != "client-1" {
+		t.Error("Expected scope and client id in the claims", claims)
+	}
+}
+
+func TestIDTokenIsNotAnAccessToken(t *testing.T) {
+	claims := IDTokenClaims{Nonce: "n-0S6_WzA2Mj"}
+	claims.Subject = "user-uuid"
+	claims.Audience = []string{"client-1"}
+	token, err := GenerateIDToken(claims, time.Minute)
+	if err != nil {
+		t.Fatal("Failed to generate ID token", err)
+	}
+	if _, err := ValidateJwtAndGetClaims(token); err == nil {
+		t.Error("Expected ID token to be rejected as an access token")
+	}
+}
+
+func TestClientCredentialsJwtSubjectType(t *testing.T) {
+	token, err := GenerateClientCredentialsJwtToken("client-2", "reports:read", time.Minute)
+	if err != nil {
+		t.Fatal("Failed to generate token", err)
+	}
+	claims, err := ValidateJwtAndGetClaims(token)
+	if err != nil {
+		t.Fatal("Failed to validate token", err)
+	}
+	if claims["subjectType"] != SubjectTypeClient || claims["userId"] != 0 || claims["clientId"] != "client-2" {
+		t.Error("Expected a client token without user", claims)
+	}
+
+	userToken, _ := GenerateJwtToken(105, []string{"USER"}, time.Minute)
+	claims, _ = ValidateJwtAndGetClaims(userToken)
+	if claims["subjectType"] != SubjectTypeUser {
+		t.Error("Expected a user token", claims)
+	}
+}
+
+func TestUserCode(t *testing.T) {
+	code := GenerateUserCode()
+	if len(code) != 9 || code[4] != '-' {
+		t.Fatal("Unexpected user code format", code)
+	}
+	if NormalizeUserCode(" "+strings.ToLower(code)+" ") != strings.Replace(code, "-", "", 1) {
+		t.Error("Expected typed user code to normalize to the stored code")
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code := GenerateRecoveryCode()
+	if len(code) != 11 || code[5] != '-' {
+		t.Fatal("Unexpected recovery code format", code)
+	}
+	if NormalizeRecoveryCode(" "+strings.ToUpper(code)) != strings.Replace(code, "-", "", 1) {
+		t.Error("Expected typed recovery code to normalize to the generated code")
+	}
+	if GenerateRecoveryCode() == code {
+		t.Error("Expected a different recovery code on every call")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := map[int]time.Duration{0: 0, 1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 6: 30 * time.Second, 100: 30 * time.Second}
+	for failures, expected := range tests {
+		if delay := BackoffDelay(failures, time.Second, 30*time.Second); delay != expected {
+			t.Errorf("Expected a delay of %s after %d failures, got %s", expected, failures, delay)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpPeriod is the length of a TOTP time step in seconds, what authenticator apps use by default
+const totpPeriod = 30
+
+// ValidateTOTP checks a 6 digit SHA-1 TOTP code, accepting codes up to skew time steps before or after at
+// It returns the time step the code belongs to, so callers can refuse a step that was already used
+func ValidateTOTP(code, secret string, at time.Time, skew uint) (int64, bool) {
+	if len(code) != 6 {
+		return 0, false
+	}
+	opts := totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	counter := at.Unix() / totpPeriod
+	for step := counter - int64(skew); step <= counter+int64(skew); step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
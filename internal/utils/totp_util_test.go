@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestValidateTOTP(t *testing.T) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: "SpeedyAuth", AccountName: "jane"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000015, 0)
+	code, _ := totp.GenerateCode(key.Secret(), now)
+
+	step, ok := ValidateTOTP(code, key.Secret(), now, 1)
+	if !ok || step != now.Unix()/30 {
+		t.Fatal("Expected the current code to be valid", step, ok)
+	}
+	if step, ok := ValidateTOTP(code, key.Secret(), now.Add(30*time.Second), 1); !ok || step != now.Unix()/30 {
+		t.Error("Expected the previous code to be accepted within the skew", step, ok)
+	}
+	if _, ok := ValidateTOTP(code, key.Secret(), now.Add(90*time.Second), 1); ok {
+		t.Error("Expected a code outside the skew to be rejected")
+	}
+	if _, ok := ValidateTOTP(code, key.Secret(), now.Add(30*time.Second), 0); ok {
+		t.Error("Expected the previous code to be rejected without skew")
+	}
+	if _, ok := ValidateTOTP("", key.Secret(), now, 1); ok {
+		t.Error("Expected an empty code to be rejected")
+	}
+}